@@ -2,6 +2,7 @@ package p2p
 
 import (
 	"crypto/ed25519"
+	"encoding/hex"
 	"sync"
 	"time"
 
@@ -12,6 +13,7 @@ import (
 
 // ActiveConnection is a current websocket connection
 type ActiveConnection struct {
+	core    *core
 	conn    *websocket.Conn
 	host    string
 	authed  bool
@@ -19,28 +21,101 @@ type ActiveConnection struct {
 	vID     uuid.UUID
 	signkey ed25519.PublicKey
 	sealKey []byte
-	mu      sync.Mutex
+	codec   string
+	version int
+	caps    capabilitySet
+	seq     seqCounter
+	// difficulty is the difficulty of the puzzle in our challenge.
+	difficulty int
+	queue      *sendQueue
+	download   *bandwidth
+
+	closeCode   CloseCode
+	closeReason string
+	since       time.Time
+
+	mu sync.Mutex
 }
 
+// send queues a frame for the peer.
 func (ac *ActiveConnection) send(msg []byte) {
+	ac.queue.push(ac.core.sealFrame(msg))
+}
+
+// sendNow writes a frame right away, ahead of the queued ones, for close
+// frames that must go out before the connection is closed.
+func (ac *ActiveConnection) sendNow(msg []byte) {
+	ac.write(ac.core.sealFrame(msg))
+}
+
+func (ac *ActiveConnection) write(frame []byte) {
 	ac.mu.Lock()
 	defer ac.mu.Unlock()
-	ac.conn.WriteMessage(2, msg)
+	ac.conn.WriteMessage(2, frame)
+}
+
+// cast seals a broadcast for this connection and sends it with the next
+// sequence number.
+func (ac *ActiveConnection) cast(msg []byte, meta broadcast) {
+	ac.seq.stamp(func(seq uint64) {
+		byteCast, err := ac.core.sealBroadcast(msg, meta, seq, ac.sealKey, ac.codec)
+		if err != nil {
+			ac.core.log.Error("Could not seal broadcast", "messageID", meta.MessageID, "err", err)
+			return
+		}
+		ac.send(byteCast)
+	})
+}
+
+func (ac *ActiveConnection) peerKey() string {
+	return hex.EncodeToString(ac.signkey)
+}
+
+func (ac *ActiveConnection) supports(capability string) bool {
+	return ac.caps[capability]
 }
 
+func (ac *ActiveConnection) toString() string {
+	return ac.host
+}
+
+// reject sends the peer a close frame and closes the connection.
+func (ac *ActiveConnection) reject(code CloseCode, reason string) {
+	if !ac.authed {
+		ac.core.handshake(false)
+	}
+	ac.closeCode = code
+	ac.closeReason = reason
+	closeWith(ac, code, reason)
+	ac.conn.Close()
+}
+
+// authenticate sends the challenge, and closes the connection if it was not
+// answered within the AuthTimeout.
 func (ac *ActiveConnection) authenticate() {
-	b, err := msgpack.Marshal(&challenge{Type: "challenge", Challenge: ac.vID.String()})
+	ch := challenge{
+		Type:         "challenge",
+		Challenge:    ac.vID.String(),
+		Codecs:       ac.core.codecs(),
+		Version:      protocolVersion,
+		Capabilities: ac.core.capabilities(),
+		Difficulty:   ac.difficulty,
+	}
+	if ac.core.permissions != nil {
+		ac.core.prove(&ch)
+	}
+	b, err := msgpack.Marshal(&ch)
 	if err != nil {
 		panic(err)
 	}
 	ac.send(b)
 
-	time.Sleep(3 * time.Second)
-
-	if !ac.authed {
-		log.Warning("Peer " + ac.host + " did not authorize in time, closing connection.")
-		ac.conn.Close()
-	}
+	time.AfterFunc(ac.core.config.AuthTimeout, func() {
+		if !ac.authed {
+			ac.core.log.Warn("Peer did not authorize in time, closing connection", "host", ac.host)
+			ac.reject(CloseAuthTimeout, "did not authorize in time")
+		}
+	})
 }
 
 func (ac *ActiveConnection) pong() {
@@ -49,7 +124,7 @@ func (ac *ActiveConnection) pong() {
 		panic(err)
 	}
 
-	ac.send(b)
+	ac.queue.pushUrgent(ac.core.sealFrame(b))
 }
 
 func (ac *ActiveConnection) ping() {
@@ -64,7 +139,7 @@ func (ac *ActiveConnection) ping() {
 		if err != nil {
 			panic(err)
 		}
-		ac.send(b)
+		ac.queue.pushUrgent(ac.core.sealFrame(b))
 
 		time.Sleep(5 * time.Second)
 	}
@@ -0,0 +1,279 @@
+package p2p
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type clientStatus struct {
+	Host    string    `json:"host"`
+	SignKey string    `json:"signKey"`
+	State   string    `json:"state"`
+	RTT     string    `json:"rtt"`
+	Since   time.Time `json:"since"`
+}
+
+type connectionStatus struct {
+	Host    string    `json:"host"`
+	SignKey string    `json:"signKey"`
+	Authed  bool      `json:"authed"`
+	Since   time.Time `json:"since"`
+}
+
+type peerStatus struct {
+	Host     string    `json:"host"`
+	Port     int       `json:"port"`
+	SignKey  string    `json:"signKey"`
+	Score    int       `json:"score"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+type seenStatus struct {
+	Server   int    `json:"server"`
+	Client   int    `json:"client"`
+	Tree     int    `json:"tree"`
+	Capacity int    `json:"capacity"`
+	TTL      string `json:"ttl"`
+	Bloom    bool   `json:"bloom"`
+}
+
+type nodeStatus struct {
+	Version     string             `json:"version"`
+	SignKey     string             `json:"signKey"`
+	Clients     []clientStatus     `json:"clients"`
+	Connections []connectionStatus `json:"connections"`
+	Peers       []peerStatus       `json:"peers"`
+	Seen        seenStatus         `json:"seen"`
+	Metrics     Metrics            `json:"metrics"`
+}
+
+type adminRequest struct {
+	Host    string `json:"host"`
+	Port    int    `json:"port"`
+	SignKey string `json:"signKey"`
+}
+
+// status collects everything the admin API and the home page show.
+func (a *api) status() nodeStatus {
+	c := a.core
+	s := nodeStatus{
+		Version:     version,
+		SignKey:     hex.EncodeToString(c.keys.signKeys.Pub),
+		Clients:     []clientStatus{},
+		Connections: []connectionStatus{},
+		Peers:       []peerStatus{},
+		Seen: seenStatus{
+			Capacity: c.config.SeenCacheSize,
+			TTL:      c.config.SeenCacheTTL.String(),
+			Bloom:    c.config.SeenCacheBloom,
+		},
+		Metrics: a.metrics(),
+	}
+
+	c.clientManager.clientMu.Lock()
+	for _, client := range c.clientManager.clients {
+		state := "connecting"
+		if client.authorized {
+			state = "authorized"
+		}
+		if client.failed {
+			state = "failed"
+		}
+		s.Clients = append(s.Clients, clientStatus{
+			Host:    client.toString(),
+			SignKey: client.peer.SignKey,
+			State:   state,
+			RTT:     client.pingTime.String(),
+			Since:   client.since,
+		})
+	}
+	c.clientManager.clientMu.Unlock()
+
+	a.acMu.Lock()
+	for _, ac := range a.ac {
+		if c.keys.isSelf(ac.signkey) {
+			continue
+		}
+		s.Connections = append(s.Connections, connectionStatus{
+			Host:    ac.host,
+			SignKey: ac.peerKey(),
+			Authed:  ac.authed,
+			Since:   ac.since,
+		})
+	}
+	a.acMu.Unlock()
+
+	for _, peer := range c.db.getPeerList() {
+		s.Peers = append(s.Peers, peerStatus{
+			Host:     peer.Host,
+			Port:     peer.Port,
+			SignKey:  peer.SignKey,
+			Score:    peer.Score,
+			LastSeen: peer.LastSeen,
+		})
+	}
+
+	if a.serverReceived != nil {
+		s.Seen.Server = a.serverReceived.len()
+	}
+	if c.clientManager.clientReceived != nil {
+		s.Seen.Client = c.clientManager.clientReceived.len()
+	}
+	if c.tree != nil {
+		s.Seen.Tree = c.tree.seen.len()
+	}
+
+	return s
+}
+
+// disconnect closes every connection to a peer, in both directions.
+func (a *api) disconnect(signKey string, code CloseCode, reason string) int {
+	count := a.core.clientManager.disconnect(signKey, code, reason)
+
+	a.acMu.Lock()
+	defer a.acMu.Unlock()
+	for _, ac := range a.ac {
+		if ac.authed && ac.peerKey() == signKey {
+			ac.reject(code, reason)
+			count++
+		}
+	}
+	return count
+}
+
+// adminAuth only lets requests carrying the configured admin token through.
+// Browsers can pass it as the password of basic authentication, to open the
+// dashboard.
+func (a *api) adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		a.core.log.Info("HTTP", "method", req.Method, "url", req.URL, "remote", GetIP(req))
+
+		if !a.admin(req) {
+			if req.URL.Path == "/" {
+				res.Header().Set("WWW-Authenticate", `Basic realm="admin"`)
+			}
+			res.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(res, req)
+	})
+}
+
+// admin reports whether a request carries the admin token, as a bearer token
+// or a basic auth password. It is always false when there is no AdminToken.
+func (a *api) admin(req *http.Request) bool {
+	if a.core.config.AdminToken == "" {
+		return false
+	}
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if _, password, ok := req.BasicAuth(); ok {
+		token = password
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.core.config.AdminToken)) == 1
+}
+
+func writeJSON(res http.ResponseWriter, status int, value interface{}) {
+	byteRes, err := json.Marshal(value)
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	res.Write(byteRes)
+}
+
+func readAdminRequest(res http.ResponseWriter, req *http.Request) (adminRequest, bool) {
+	body := adminRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeJSON(res, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return body, false
+	}
+	return body, true
+}
+
+// AdminStatusHandler serves the node status, or the part of it named by the
+// last element of the path.
+func (a *api) AdminStatusHandler() http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		s := a.status()
+		switch req.URL.Path {
+		case "/admin/clients":
+			writeJSON(res, http.StatusOK, s.Clients)
+		case "/admin/connections":
+			writeJSON(res, http.StatusOK, s.Connections)
+		case "/admin/peers":
+			writeJSON(res, http.StatusOK, s.Peers)
+		case "/admin/seen":
+			writeJSON(res, http.StatusOK, s.Seen)
+		default:
+			writeJSON(res, http.StatusOK, s)
+		}
+	})
+}
+
+// AdminConnectHandler dials the given host and port.
+func (a *api) AdminConnectHandler() http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, ok := readAdminRequest(res, req)
+		if !ok {
+			return
+		}
+		if body.Host == "" || body.Port == 0 {
+			writeJSON(res, http.StatusBadRequest, map[string]string{"error": "host and port are required"})
+			return
+		}
+
+		a.core.clientManager.connect(Peer{Host: body.Host, Port: body.Port, SignKey: body.SignKey})
+		writeJSON(res, http.StatusAccepted, map[string]string{"connecting": body.Host + ":" + strconv.Itoa(body.Port)})
+	})
+}
+
+// AdminDisconnectHandler closes every connection to a peer.
+func (a *api) AdminDisconnectHandler() http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, ok := readAdminRequest(res, req)
+		if !ok {
+			return
+		}
+
+		count := a.disconnect(body.SignKey, CloseNormal, "disconnected by operator")
+		writeJSON(res, http.StatusOK, map[string]int{"closed": count})
+	})
+}
+
+// AdminBanHandler bans a peer and closes every connection to it.
+func (a *api) AdminBanHandler() http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, ok := readAdminRequest(res, req)
+		if !ok {
+			return
+		}
+
+		if !hexSignKey(body.SignKey) {
+			writeJSON(res, http.StatusBadRequest, map[string]string{"error": "signKey must be a hex sign key"})
+			return
+		}
+		if !a.core.db.ban(body.SignKey) {
+			writeJSON(res, http.StatusNotFound, map[string]string{"error": "no peer was banned"})
+			return
+		}
+		a.core.events.emit(Event{Type: PeerBanned, Peer: body.SignKey, Code: CloseBanned, Reason: "banned by operator"})
+		count := a.disconnect(body.SignKey, CloseBanned, "banned by operator")
+		writeJSON(res, http.StatusOK, map[string]int{"closed": count})
+	})
+}
+
+// AdminDiscoverHandler starts a round of peer discovery.
+func (a *api) AdminDiscoverHandler() http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		go a.core.clientManager.discover()
+		writeJSON(res, http.StatusAccepted, map[string]bool{"discovering": true})
+	})
+}
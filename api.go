@@ -1,12 +1,14 @@
 package p2p
 
 import (
-	"crypto/ed25519"
 	"encoding/hex"
 	"encoding/json"
+	"html"
 	"net/http"
+	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/handlers"
@@ -14,7 +16,6 @@ import (
 	"github.com/gorilla/websocket"
 	uuid "github.com/satori/go.uuid"
 	"github.com/vmihailenco/msgpack"
-	"golang.org/x/crypto/nacl/box"
 )
 
 type api struct {
@@ -24,49 +25,81 @@ type api struct {
 	ac     []*ActiveConnection
 	acMu   sync.Mutex
 
-	serverReceived lockList
+	serverReceived  *seenCache
+	originLimit     *rateLimiter
+	connectionLimit *rateLimiter
 }
 
 func (a *api) initialize(core *core) {
 	a.core = core
 	a.ac = []*ActiveConnection{}
+	a.serverReceived = core.newSeenCache()
+	a.originLimit = newRateLimiter(core.config.OriginRate, core.config.OriginBurst)
+	a.connectionLimit = newRateLimiter(core.config.ConnectionRate, core.config.ConnectionBurst)
 	a.getRouter()
 }
 
 // Run starts the server.
 func (a *api) run() {
-	log.Info(colors.boldYellow+"HTTP"+colors.reset, "Starting API on port "+strconv.Itoa(a.core.config.Port)+".")
-	log.Fatal(http.ListenAndServe(":"+strconv.Itoa(a.core.config.Port),
-		handlers.CORS(handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Authorization"}),
+	a.core.log.Info("Starting API", "port", a.core.config.Port)
+	err := http.ListenAndServe(":"+strconv.Itoa(a.core.config.Port),
+		a.guard(handlers.CORS(handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Authorization", networkKeyHeader}),
 			handlers.AllowedMethods([]string{"GET", "POST", "PUT", "HEAD", "OPTIONS", "PATCH"}),
 			handlers.AllowedOrigins([]string{"*"}))(a.router)))
+	a.core.log.Error("API stopped", "port", a.core.config.Port, "err", err)
+	os.Exit(1)
 }
 
 func (a *api) getRouter() {
 	// initialize router
 	a.router = mux.NewRouter()
-	a.router.Handle("/", a.HomeHandler()).Methods("GET")
+	if a.core.config.AdminToken != "" {
+		a.router.Handle("/", a.adminAuth(a.DashboardHandler())).Methods("GET")
+	} else {
+		a.router.Handle("/", a.HomeHandler()).Methods("GET")
+	}
 	a.router.Handle("/info", a.InfoHandler()).Methods("GET")
 	a.router.Handle("/peers", a.PeerHandler()).Methods("GET", "POST")
 	a.router.Handle("/socket", a.SocketHandler()).Methods("GET")
+	if a.core.config.Metrics {
+		a.router.Handle("/metrics", a.MetricsHandler()).Methods("GET")
+	}
+	if a.core.config.AdminToken != "" {
+		admin := a.router.PathPrefix("/admin").Subrouter()
+		admin.Use(a.adminAuth)
+		admin.Handle("/status", a.AdminStatusHandler()).Methods("GET")
+		admin.Handle("/clients", a.AdminStatusHandler()).Methods("GET")
+		admin.Handle("/connections", a.AdminStatusHandler()).Methods("GET")
+		admin.Handle("/peers", a.AdminStatusHandler()).Methods("GET")
+		admin.Handle("/seen", a.AdminStatusHandler()).Methods("GET")
+		admin.Handle("/connect", a.AdminConnectHandler()).Methods("POST")
+		admin.Handle("/disconnect", a.AdminDisconnectHandler()).Methods("POST")
+		admin.Handle("/ban", a.AdminBanHandler()).Methods("POST")
+		admin.Handle("/discover", a.AdminDiscoverHandler()).Methods("POST")
+	}
 }
 
 // PeerHandler handles the status endpoint.
 func (a *api) PeerHandler() http.Handler {
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-		log.Info(colors.boldYellow+"HTTP"+colors.reset, req.Method, req.URL, GetIP(req))
+		a.core.log.Info("HTTP", "method", req.Method, "url", req.URL, "remote", GetIP(req))
 
 		switch req.Method {
 		case "GET":
-			peerList := a.core.db.getPeerList()
+			// peers banned before we ever learned their address are not
+			// worth sharing
+			peerList := []Peer{}
+			for _, peer := range a.core.db.getPeerList() {
+				if peer.Host != "" {
+					peerList = append(peerList, peer)
+				}
+			}
 			byteRes, err := json.Marshal(peerList)
 			if err != nil {
 				res.WriteHeader(http.StatusInternalServerError)
 			}
 
-			res.Header().Set("Content-Type", "application/json")
-			res.WriteHeader(http.StatusOK)
-			res.Write(byteRes)
+			a.respond(res, byteRes)
 		}
 
 	})
@@ -75,12 +108,13 @@ func (a *api) PeerHandler() http.Handler {
 // InfoHandler handles the info endpoint.
 func (a *api) InfoHandler() http.Handler {
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-		log.Info(colors.boldYellow+"HTTP"+colors.reset, req.Method, req.URL, GetIP(req))
+		a.core.log.Info("HTTP", "method", req.Method, "url", req.URL, "remote", GetIP(req))
 
 		infoRes := infoRes{
 			PubSignKey: hex.EncodeToString(a.core.keys.signKeys.Pub),
 			PubSealKey: hex.EncodeToString(a.core.keys.sealKeys.Pub[:]),
 			Version:    version,
+			Protocol:   protocolVersion,
 		}
 
 		byteRes, err := json.Marshal(&infoRes)
@@ -88,17 +122,16 @@ func (a *api) InfoHandler() http.Handler {
 			res.WriteHeader(http.StatusInternalServerError)
 		}
 
-		res.Header().Set("Content-Type", "application/json")
-		res.WriteHeader(http.StatusOK)
-		res.Write(byteRes)
+		a.respond(res, byteRes)
 	})
 }
 
 // HomeHandler handles the server homepage.
 func (a *api) HomeHandler() http.Handler {
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-		log.Info(colors.boldYellow+"HTTP"+colors.reset, req.Method, req.URL, GetIP(req))
+		a.core.log.Info("HTTP", "method", req.Method, "url", req.URL, "remote", GetIP(req))
 
+		res.Header().Set("Content-Type", "text/html; charset=utf-8")
 		res.WriteHeader(http.StatusOK)
 
 		res.Write([]byte("<!DOCTYPE html>"))
@@ -110,8 +143,68 @@ func (a *api) HomeHandler() http.Handler {
 		res.Write([]byte("<h2>Server Information</h2>"))
 		res.Write([]byte("<ul>"))
 		res.Write([]byte("<li>Version: &nbsp;&nbsp;&nbsp;&nbsp;" + version + " </li>"))
-		res.Write([]byte("<li>Hostname: &nbsp;&nbsp;&nbsp;" + req.Host + "</li>"))
+		res.Write([]byte("<li>Hostname: &nbsp;&nbsp;&nbsp;" + html.EscapeString(req.Host) + "</li>"))
+		res.Write([]byte("</ul>"))
+		res.Write([]byte("<p>© LogicBite LLC 2019-2020. See included LICENSE for details.</p>"))
+		res.Write([]byte("</body>"))
+		res.Write([]byte("</html>"))
+	})
+}
+
+// DashboardHandler handles the admin dashboard, a page that refreshes itself
+// and is built from the same status as the admin API.
+func (a *api) DashboardHandler() http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		status := a.status()
+		m := status.Metrics
+
+		res.Header().Set("Content-Type", "text/html; charset=utf-8")
+		res.WriteHeader(http.StatusOK)
+
+		res.Write([]byte("<!DOCTYPE html>"))
+		res.Write([]byte("<html>"))
+		res.Write([]byte("<head><meta http-equiv=\"refresh\" content=\"5\"></head>"))
+		res.Write([]byte("<style> body { width: 50em; margin: 0 auto; font-family: monospace; } ul { list-style: none } td { padding-right: 2em; } </style>"))
+		res.Write([]byte("<body>"))
+		res.Write([]byte("<h1>extrap2p</h1>"))
+		res.Write([]byte("<p>If you can see this, the node is running.</p>"))
+		res.Write([]byte("<h2>Server Information</h2>"))
+		res.Write([]byte("<ul>"))
+		res.Write([]byte("<li>Version: &nbsp;&nbsp;&nbsp;&nbsp;" + version + " </li>"))
+		res.Write([]byte("<li>Hostname: &nbsp;&nbsp;&nbsp;" + html.EscapeString(req.Host) + "</li>"))
+		res.Write([]byte("<li>Sign key: &nbsp;&nbsp;&nbsp;" + status.SignKey + "</li>"))
 		res.Write([]byte("</ul>"))
+		res.Write([]byte("<h2>Network</h2>"))
+		res.Write([]byte("<ul>"))
+		res.Write([]byte("<li>Outbound: &nbsp;&nbsp;&nbsp;" + strconv.Itoa(m.OutboundConnections) + "</li>"))
+		res.Write([]byte("<li>Inbound: &nbsp;&nbsp;&nbsp;&nbsp;" + strconv.Itoa(m.InboundConnections) + "</li>"))
+		res.Write([]byte("<li>Known peers: " + strconv.Itoa(m.PeerTableSize) + "</li>"))
+		res.Write([]byte("<li>Seen cache: &nbsp;" + strconv.Itoa(m.SeenCacheSize) + "</li>"))
+		res.Write([]byte("</ul>"))
+		res.Write([]byte("<h2>Traffic</h2>"))
+		res.Write([]byte("<ul>"))
+		res.Write([]byte("<li>Sent: &nbsp;&nbsp;&nbsp;&nbsp;&nbsp;&nbsp;&nbsp;&nbsp;" + strconv.FormatUint(m.MessagesSent, 10) + " (" + strconv.FormatUint(m.BytesSent, 10) + " bytes)</li>"))
+		res.Write([]byte("<li>Received: &nbsp;&nbsp;&nbsp;" + strconv.FormatUint(m.MessagesReceived, 10) + " (" + strconv.FormatUint(m.BytesReceived, 10) + " bytes)</li>"))
+		res.Write([]byte("<li>Relayed: &nbsp;&nbsp;&nbsp;&nbsp;" + strconv.FormatUint(m.MessagesRelayed, 10) + "</li>"))
+		res.Write([]byte("<li>Duplicates: &nbsp;" + strconv.FormatUint(m.MessagesDeduplicated, 10) + "</li>"))
+		res.Write([]byte("<li>Dropped: &nbsp;&nbsp;&nbsp;&nbsp;" + strconv.FormatUint(m.MessagesDropped+m.DecryptFailures, 10) + "</li>"))
+		res.Write([]byte("</ul>"))
+		res.Write([]byte("<h2>Outbound Connections</h2>"))
+		res.Write([]byte("<table>"))
+		for _, c := range status.Clients {
+			res.Write([]byte("<tr><td>" + html.EscapeString(c.Host) + "</td><td>" + c.State + "</td><td>" + c.RTT + "</td></tr>"))
+		}
+		res.Write([]byte("</table>"))
+		res.Write([]byte("<h2>Inbound Connections</h2>"))
+		res.Write([]byte("<table>"))
+		for _, c := range status.Connections {
+			state := "authenticating"
+			if c.Authed {
+				state = "authorized"
+			}
+			res.Write([]byte("<tr><td>" + html.EscapeString(c.Host) + "</td><td>" + state + "</td><td>" + time.Since(c.Since).Round(time.Second).String() + "</td></tr>"))
+		}
+		res.Write([]byte("</table>"))
 		res.Write([]byte("<p>© LogicBite LLC 2019-2020. See included LICENSE for details.</p>"))
 		res.Write([]byte("</body>"))
 		res.Write([]byte("</html>"))
@@ -121,43 +214,65 @@ func (a *api) HomeHandler() http.Handler {
 // SocketHandler handles the websocket connection messages and responses.
 func (a *api) SocketHandler() http.Handler {
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-		log.Info(colors.boldYellow+"HTTP"+colors.reset, req.Method, req.URL, GetIP(req))
+		a.core.log.Info("HTTP", "method", req.Method, "url", req.URL, "remote", GetIP(req))
+
+		if status, reason := a.admit(req); status != 0 {
+			a.refuse(res, req, status, reason)
+			return
+		}
 
 		var upgrader = websocket.Upgrader{
-			ReadBufferSize:  1024,
-			WriteBufferSize: 1024,
+			ReadBufferSize:  socketBufferSize,
+			WriteBufferSize: socketBufferSize,
 		}
 
 		upgrader.CheckOrigin = func(req *http.Request) bool { return true }
 
 		conn, err := upgrader.Upgrade(res, req, nil)
 		if err != nil {
-			log.Warning(err)
+			a.core.log.Warn("Websocket upgrade failed", "remote", GetIP(req), "err", err)
 			return
 		}
+		conn.SetReadLimit(a.core.frameLimit())
 
 		ac := ActiveConnection{
-			conn:   conn,
-			host:   GetIP(req),
-			alive:  true,
-			authed: false,
-			vID:    uuid.NewV4(),
+			core:       a.core,
+			conn:       conn,
+			host:       GetIP(req),
+			alive:      true,
+			authed:     false,
+			vID:        uuid.NewV4(),
+			since:      time.Now(),
+			difficulty: a.difficulty(),
+			download:   newBandwidth(a.core.config.DownloadRate),
 		}
+		ac.queue = newSendQueue(a.core, ac.write)
 
 		a.acMu.Lock()
 		a.ac = append(a.ac, &ac)
 		a.acMu.Unlock()
 
-		log.Info(colors.boldYellow+"HTTP"+colors.reset, "UPGRADED", GetIP(req))
+		a.core.log.Info("Upgraded connection", "host", ac.host, "direction", "inbound")
+		a.core.events.emit(Event{Type: PeerConnected, Host: ac.host, Direction: "inbound"})
 
-		go ac.authenticate()
-		go ac.ping()
+		ac.authenticate()
 
 		for {
 			_, data, err := conn.ReadMessage()
 
 			if err != nil {
-				log.Error(err)
+				a.core.log.Error("Read failed", "peer", ac.peerKey(), "host", ac.host, "err", err)
+				conn.Close()
+				a.removeConnection(&ac)
+				break
+			}
+			if !a.core.keys.isSelf(ac.signkey) {
+				throttle(len(data), &a.core.counters.downloadWait, ac.download, a.core.download)
+			}
+			data, err = a.core.openFrame(data)
+			if err != nil {
+				a.core.log.Warn("Frame not sealed with the network key", "host", ac.host, "err", err)
+				atomic.AddUint64(&a.core.counters.decryptFailures, 1)
 				conn.Close()
 				a.removeConnection(&ac)
 				break
@@ -167,8 +282,9 @@ func (a *api) SocketHandler() http.Handler {
 			err = msgpack.Unmarshal(data, &msg)
 
 			if err != nil {
-				log.Error(err)
-				conn.Close()
+				a.core.log.Error("Malformed frame", "host", ac.host, "err", err)
+				ac.reject(CloseProtocolError, "malformed frame")
+				a.removeConnection(&ac)
 				break
 			}
 
@@ -178,35 +294,70 @@ func (a *api) SocketHandler() http.Handler {
 				err = msgpack.Unmarshal(data, &response)
 
 				if response.NetworkID != a.core.config.NetworkID {
-					log.Warning(response.NetworkID, a.core.config.NetworkID)
-					log.Warning("Peer has incorrect network ID. Terminating connection.")
-					conn.Close()
+					a.core.log.Warn("Peer has incorrect network ID. Terminating connection.", "host", ac.host, "networkID", response.NetworkID)
+					ac.reject(CloseWrongNetwork, "network ID "+response.NetworkID+" does not match")
 					a.removeConnection(&ac)
+					break
+				}
+
+				if !puzzleSolved(ac.vID.String(), ac.difficulty, response.Solution) {
+					a.core.log.Warn("Client did not solve the puzzle", "peer", response.SignKey, "host", ac.host, "difficulty", ac.difficulty)
+					ac.reject(CloseBadPuzzle, "puzzle not solved")
+					break
 				}
 
 				peerSignKey, err := hex.DecodeString(response.SignKey)
 				if err != nil {
-					log.Error(err)
+					a.core.log.Error("Invalid sign key", "host", ac.host, "err", err)
 					break
 				}
 				peerSealKey, err := hex.DecodeString(response.SealKey)
 				if err != nil {
-					log.Error(err)
+					a.core.log.Error("Invalid seal key", "host", ac.host, "err", err)
 					break
 				}
 				signed, err := hex.DecodeString(response.Signed)
 				if err != nil {
-					log.Error(err)
+					a.core.log.Error("Invalid challenge signature", "host", ac.host, "err", err)
+					break
+				}
+
+				if ok, reason := a.core.compatible(response.Version); !ok {
+					a.core.log.Warn("Refused incompatible client", "peer", response.SignKey, "host", ac.host, "reason", reason)
+					ac.reject(CloseIncompatible, reason)
 					break
 				}
 
-				if ed25519.Verify(peerSignKey, []byte(ac.vID.String()), signed) {
+				if a.core.db.banned(response.SignKey) {
+					a.core.log.Warn("Refused banned client", "peer", response.SignKey, "host", ac.host)
+					ac.reject(CloseBanned, "banned")
+					break
+				}
+
+				if a.core.verifyResponse(response, ac.vID.String(), peerSignKey, signed) {
+					if !a.core.admitted(response.SignKey, response.Certificate) {
+						a.core.log.Warn("Refused client that is not admitted", "peer", response.SignKey, "host", ac.host)
+						ac.reject(CloseNotAdmitted, "not admitted to the network")
+						break
+					}
 					ac.authed = true
+					ac.version = response.Version
+					ac.caps = a.core.negotiate(response.Capabilities)
 					ac.signkey = peerSignKey
 					ac.sealKey = peerSealKey
+					ac.codec = a.core.chooseCodec([]string{response.Codec})
 
 					byteMessage, _ := msgpack.Marshal(message{Type: "authorized"})
 					ac.send(byteMessage)
+					go ac.ping()
+
+					if a.core.keys.isSelf(peerSignKey) {
+						ac.queue.exempt()
+					} else {
+						a.core.linkUp(&ac)
+						a.core.handshake(true)
+						a.core.events.emit(linkEvent(PeerAuthenticated, &ac))
+					}
 
 					baseIP, _ := splitIP(GetIP(req))
 					if baseIP != "127.0.0.1" {
@@ -222,25 +373,34 @@ func (a *api) SocketHandler() http.Handler {
 							}
 							if newPeer.online() {
 								a.core.db.db.Create(&newPeer)
-								log.Debug("Discovered peer: " + newPeer.toString(false))
+								a.core.log.Debug("Discovered peer", "peer", newPeer.SignKey, "host", newPeer.toString(false))
+								a.core.events.emit(Event{Type: PeerDiscovered, Peer: newPeer.SignKey, Host: newPeer.toString(false)})
 							}
 						} else {
 							a.core.db.db.Model(&Peer{}).Where("sign_key = ?", dbEntry.SignKey).Updates(Peer{SealKey: response.SealKey, LastSeen: time.Now()})
 						}
 					}
 				} else {
-					log.Warning("Client " + GetIP(req) + " invalid auth signature.")
-					ac.conn.Close()
+					a.core.log.Warn("Client sent an invalid auth signature", "peer", response.SignKey, "host", ac.host)
+					ac.reject(CloseBadSignature, "challenge signature does not match sign key")
 					break
 				}
 
+			case "close":
+				closeFrame := closeFrame{}
+				msgpack.Unmarshal(data, &closeFrame)
+				a.core.log.Warn("Client closed the connection", "peer", ac.peerKey(), "host", ac.host, "code", closeFrame.Code, "reason", closeFrame.Reason)
+				ac.closeCode = closeFrame.Code
+				ac.closeReason = closeFrame.Reason
+				conn.Close()
 			case "ping":
 				ac.pong()
 			case "pong":
 				ac.alive = true
 			case "broadcast":
 				if !ac.authed {
-					log.Warning("Peer attempted to use broadcast without being authed.")
+					a.core.log.Warn("Peer attempted to use broadcast without being authed", "host", ac.host)
+					ac.reject(CloseUnauthenticated, "broadcast before authentication")
 					break
 				}
 
@@ -248,38 +408,62 @@ func (a *api) SocketHandler() http.Handler {
 				err = msgpack.Unmarshal(data, &broadcast)
 
 				if err != nil {
-					log.Error(err)
+					a.core.log.Error("Could not decode broadcast", "peer", ac.peerKey(), "err", err)
 					break
 				}
 
-				crypt, err := hex.DecodeString(broadcast.Secret)
+				unsealed, err := a.core.openBroadcast(&broadcast, ac.sealKey, &ac.seq)
 				if err != nil {
-					log.Error(err)
+					a.core.log.Warn("Dropped broadcast", "peer", ac.peerKey(), "messageID", broadcast.MessageID, "direction", "inbound", "err", err)
+					a.core.dropped(&ac, broadcast, err.Error())
 					break
 				}
 
-				nonceS, err := hex.DecodeString(broadcast.Nonce)
-				if err != nil {
-					log.Error(err)
+				if a.core.tree != nil {
+					if !a.core.keys.isSelf(ac.signkey) {
+						a.core.tree.receive(&ac, unsealed, broadcast)
+					}
 					break
 				}
-				var nonceA [24]byte
-				copy(nonceA[:], nonceS[:24])
+				a.core.arrived(&ac, &broadcast)
 
-				var theirPublicKey [32]byte
-				copy(theirPublicKey[:], ac.sealKey[:32])
-
-				unsealed, success := box.Open(nil, crypt, &nonceA, &theirPublicKey, &a.core.keys.sealKeys.Priv)
-				if success {
-					if !a.serverReceived.contains([]byte(broadcast.MessageID)) {
-						a.serverReceived.push([]byte(broadcast.MessageID))
-						a.emitBroadcast(unsealed, broadcast.MessageID)
+				if a.serverReceived.add(broadcast.MessageID) {
+					if !a.originLimit.allow(broadcast.Origin) {
+						a.core.log.Warn("Origin exceeded its rate limit", "origin", broadcast.Origin, "messageID", broadcast.MessageID)
+						a.core.dropped(&ac, broadcast, "rate limited")
+						break
 					}
+					a.emitBroadcast(unsealed, broadcast)
 				} else {
-					log.Warning("Decryption failed.")
+					a.core.dropped(&ac, broadcast, "duplicate")
+				}
+			case "direct":
+				if !ac.authed {
+					a.core.log.Warn("Peer attempted to send a direct frame without being authed", "host", ac.host)
+					ac.reject(CloseUnauthenticated, "direct frame before authentication")
+					break
+				}
+
+				direct := broadcast{}
+				err = msgpack.Unmarshal(data, &direct)
+				if err != nil {
+					a.core.log.Error("Could not decode direct frame", "peer", ac.peerKey(), "err", err)
+					break
+				}
+
+				unsealed, err := a.core.openBroadcast(&direct, ac.sealKey, &ac.seq)
+				if err != nil {
+					a.core.log.Warn("Dropped direct frame", "peer", ac.peerKey(), "messageID", direct.MessageID, "err", err)
+					a.core.dropped(&ac, direct, err.Error())
+					break
+				}
+				a.core.direct(&ac, unsealed, direct)
+			case "ihave", "graft", "prune":
+				if a.core.tree != nil && ac.authed {
+					a.core.tree.handle(&ac, msg.Type, data)
 				}
 			default:
-				log.Warning("Unsupported message: ", msg.Type)
+				a.core.log.Warn("Unsupported message", "type", msg.Type, "host", ac.host)
 			}
 
 		}
@@ -287,6 +471,8 @@ func (a *api) SocketHandler() http.Handler {
 }
 
 func (a *api) removeConnection(connection *ActiveConnection) {
+	a.core.linkDown(connection)
+	connection.queue.close()
 	a.acMu.Lock()
 	defer a.acMu.Unlock()
 	for i, c := range a.ac {
@@ -294,31 +480,34 @@ func (a *api) removeConnection(connection *ActiveConnection) {
 			a.ac[i] = a.ac[len(a.ac)-1] // Copy last element to index i.
 			a.ac[len(a.ac)-1] = nil     // Erase last element (write zero value).
 			a.ac = a.ac[:len(a.ac)-1]
+
+			if !a.core.keys.isSelf(connection.signkey) {
+				e := linkEvent(PeerDisconnected, connection)
+				e.Code = connection.closeCode
+				e.Reason = connection.closeReason
+				a.core.events.emit(e)
+			}
 			break
 		}
 	}
 }
 
-func (a *api) emitBroadcast(message []byte, messageID string) {
+// emitBroadcast relays a broadcast to our inbound connections. Once its hop
+// limit is used up it is only handed to our own client, which delivers it.
+func (a *api) emitBroadcast(message []byte, meta broadcast) {
+	relay, ok := a.core.relay(meta)
 	for _, ac := range a.ac {
 		if ac.conn == nil {
 			continue
 		}
+		if !ok && !a.core.keys.isSelf(ac.signkey) {
+			continue
+		}
 		if ac.authed {
-			nonce := makeNonce()
-			secret := box.Seal(nil, message, nonce.bytes, keySliceConvert(ac.sealKey), &a.core.keys.sealKeys.Priv)
-			broadcast := broadcast{
-				Type:      "broadcast",
-				Secret:    hex.EncodeToString(secret),
-				Nonce:     nonce.str,
-				MessageID: messageID,
-			}
-			byteCast, err := msgpack.Marshal(broadcast)
-			if err != nil {
-				log.Error(err)
-			} else {
-				ac.send(byteCast)
-			}
+			ac.cast(message, relay)
 		}
 	}
+	if ok {
+		a.core.relayed(relay)
+	}
 }
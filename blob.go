@@ -0,0 +1,593 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/vmihailenco/msgpack"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	errBlobNotFound = errors.New("blob not found on any peer")
+	errBlobChunk    = errors.New("no peer sent a valid copy of a chunk")
+	errBlobManifest = errors.New("invalid blob manifest")
+	errBlobTooLarge = errors.New("blob exceeds the blob store size")
+)
+
+// storedBlob is a blob in the local store. Its data is kept in a file named
+// after its hash.
+type storedBlob struct {
+	Hash     string `gorm:"primaryKey"`
+	Size     int64
+	Manifest []byte
+	Pinned   bool
+	Used     time.Time `gorm:"index"`
+}
+
+func (storedBlob) TableName() string {
+	return "blobs"
+}
+
+// blobHolder is a peer that announced it holds a blob.
+type blobHolder struct {
+	Hash string `gorm:"primaryKey"`
+	Peer string `gorm:"primaryKey"`
+	Seen time.Time
+}
+
+func (blobHolder) TableName() string {
+	return "blob_holders"
+}
+
+// BlobStore shares content addressed blobs with other nodes. A blob is
+// split into chunks of blobChunkSize, and addressed by the hash of its
+// manifest, the list of its chunk hashes. Storing a blob only broadcasts a
+// small announcement, and nodes that want it fetch the manifest and then the
+// chunks from the peers that announced it, verifying each chunk on arrival.
+// A node that fetched a blob announces it in turn.
+//
+// Blobs stored with Put are pinned, and blobs fetched from peers are kept
+// as a cache that is cut down to BlobMaxBytes, least recently used first.
+type BlobStore struct {
+	core *core
+	db   *gorm.DB
+	dir  string
+
+	mu       sync.Mutex
+	requests map[string]chan blobFrame
+	// serving counts the requests being served, in total and per peer
+	serving     int
+	servingPeer map[string]int
+}
+
+func newBlobStore(core *core) *BlobStore {
+	core.db.db.AutoMigrate(&storedBlob{}, &blobHolder{})
+	b := &BlobStore{
+		core:        core,
+		db:          core.db.db,
+		dir:         filepath.Join(homedir, "."+progName, core.config.NetworkID, "blobs"),
+		requests:    make(map[string]chan blobFrame),
+		servingPeer: make(map[string]int),
+	}
+	go b.gcLoop()
+	return b
+}
+
+// Blobs returns the node's blob store.
+func (d *DP2P) Blobs() *BlobStore {
+	for d.core.blobs == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+	return d.core.blobs
+}
+
+// Put stores data as a pinned blob, announces it to the network, and
+// returns its hash.
+func (b *BlobStore) Put(data []byte) (string, error) {
+	if int64(len(data)) > b.core.config.BlobMaxBytes {
+		return "", errBlobTooLarge
+	}
+	m := blobManifest{Size: int64(len(data)), ChunkSize: blobChunkSize}
+	for offset := 0; offset < len(data); offset += blobChunkSize {
+		end := offset + blobChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		sum := sha256.Sum256(data[offset:end])
+		m.Chunks = append(m.Chunks, sum[:])
+	}
+	manifest, err := msgpack.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	hash := blobHash(manifest)
+
+	if err := b.write(hash, func(f *os.File) error {
+		_, err := f.Write(data)
+		return err
+	}); err != nil {
+		return "", err
+	}
+	err = b.db.Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "hash"}}, DoUpdates: clause.AssignmentColumns([]string{"pinned", "used"})}).
+		Create(&storedBlob{Hash: hash, Size: m.Size, Manifest: manifest, Pinned: true, Used: time.Now()}).Error
+	if err != nil {
+		return "", err
+	}
+	b.announce(hash, m.Size)
+	return hash, nil
+}
+
+// Get returns a blob, from the local store if it is there and otherwise
+// from the peers that announced it. Chunks are fetched from several peers
+// at once.
+func (b *BlobStore) Get(ctx context.Context, hash string) ([]byte, error) {
+	if data, err := b.local(hash); err == nil {
+		return data, nil
+	}
+
+	m, manifest, providers, err := b.find(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	if m.Size > b.core.config.BlobMaxBytes {
+		return nil, errBlobTooLarge
+	}
+
+	err = b.write(hash, func(f *os.File) error {
+		return b.fetchChunks(ctx, hash, m, providers, f)
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = b.db.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&storedBlob{Hash: hash, Size: m.Size, Manifest: manifest, Used: time.Now()}).Error
+	if err != nil {
+		return nil, err
+	}
+	b.core.log.Info("Fetched blob", "hash", hash, "size", m.Size, "chunks", len(m.Chunks), "peers", len(providers))
+	b.announce(hash, m.Size)
+	return b.local(hash)
+}
+
+// Has reports whether a blob is in the local store.
+func (b *BlobStore) Has(hash string) bool {
+	var count int64
+	b.db.Model(&storedBlob{}).Where("hash = ?", hash).Count(&count)
+	return count > 0
+}
+
+// Pin keeps a blob in the local store until it is unpinned.
+func (b *BlobStore) Pin(hash string) error {
+	return b.setPinned(hash, true)
+}
+
+// Unpin lets the garbage collector remove a blob once the store is full.
+func (b *BlobStore) Unpin(hash string) error {
+	return b.setPinned(hash, false)
+}
+
+func (b *BlobStore) setPinned(hash string, pinned bool) error {
+	result := b.db.Model(&storedBlob{}).Where("hash = ?", hash).Update("pinned", pinned)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errBlobNotFound
+	}
+	return nil
+}
+
+// GC removes unpinned blobs, least recently used first, until the store
+// fits in BlobMaxBytes, and returns the number of bytes freed.
+func (b *BlobStore) GC() int64 {
+	b.db.Where("seen < ?", time.Now().Add(-blobHolderTTL)).Delete(&blobHolder{})
+
+	var total int64
+	b.db.Model(&storedBlob{}).Select("COALESCE(SUM(size), 0)").Scan(&total)
+	rows := []storedBlob{}
+	b.db.Select("hash", "size").Where("pinned = ?", false).Order("used").Find(&rows)
+
+	var freed int64
+	for _, row := range rows {
+		if total <= b.core.config.BlobMaxBytes {
+			break
+		}
+		b.db.Where("hash = ?", row.Hash).Delete(&storedBlob{})
+		if err := os.Remove(b.path(row.Hash)); err != nil && !os.IsNotExist(err) {
+			b.core.log.Warn("Could not remove blob", "hash", row.Hash, "err", err)
+		}
+		total -= row.Size
+		freed += row.Size
+	}
+	if freed > 0 {
+		b.core.log.Debug("Collected blobs", "freed", freed)
+	}
+	return freed
+}
+
+func (b *BlobStore) gcLoop() {
+	for {
+		time.Sleep(blobGCInterval)
+		b.GC()
+	}
+}
+
+func (b *BlobStore) path(hash string) string {
+	return filepath.Join(b.dir, hash)
+}
+
+// local reads a blob from the local store.
+func (b *BlobStore) local(hash string) ([]byte, error) {
+	if !b.Has(hash) {
+		return nil, errBlobNotFound
+	}
+	data, err := ioutil.ReadFile(b.path(hash))
+	if err != nil {
+		return nil, err
+	}
+	b.db.Model(&storedBlob{}).Where("hash = ?", hash).Update("used", time.Now())
+	return data, nil
+}
+
+// write creates a blob's file through a temporary file, so that a blob is
+// never served half written.
+func (b *BlobStore) write(hash string, fill func(f *os.File) error) error {
+	if err := os.MkdirAll(b.dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(b.dir, "partial-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := fill(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), b.path(hash))
+}
+
+func blobHash(manifest []byte) string {
+	sum := sha256.Sum256(manifest)
+	return hex.EncodeToString(sum[:])
+}
+
+func (b *BlobStore) announce(hash string, size int64) {
+	data, err := msgpack.Marshal(blobHave{Hash: hash, Size: size})
+	if err != nil {
+		b.core.log.Error("Could not encode blob announcement", "hash", hash, "err", err)
+		return
+	}
+	b.core.broadcast(data, withKind("have"))
+}
+
+// announced records a peer's announcement of a blob.
+func (b *BlobStore) announced(meta broadcast, data []byte) {
+	if meta.Origin == b.core.keys.signKeyHex() {
+		return
+	}
+	have := blobHave{}
+	if err := msgpack.Unmarshal(data, &have); err != nil {
+		b.core.log.Warn("Could not decode blob announcement", "origin", meta.Origin, "err", err)
+		return
+	}
+	b.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&blobHolder{Hash: have.Hash, Peer: meta.Origin, Seen: time.Now()})
+}
+
+// find fetches a blob's manifest, asking again while the peers that have
+// it are still being dialed, or are still fetching it themselves.
+func (b *BlobStore) find(ctx context.Context, hash string) (blobManifest, []byte, []link, error) {
+	deadline := time.Now().Add(blobFindTimeout)
+	for {
+		m, manifest, providers, err := b.manifest(ctx, hash, b.providers(hash))
+		if err != errBlobNotFound {
+			return m, manifest, providers, err
+		}
+		if time.Now().After(deadline) {
+			return blobManifest{}, nil, nil, errBlobNotFound
+		}
+		select {
+		case <-ctx.Done():
+			return blobManifest{}, nil, nil, ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// providers returns the links to the peers a blob can be fetched from. The
+// peers that announced it come first, and we dial the ones we know from the
+// peer table but are not connected to. The other peers we are connected to
+// follow, in case they have it without us having seen their announcement.
+func (b *BlobStore) providers(hash string) []link {
+	holders := []blobHolder{}
+	b.db.Where("hash = ?", hash).Order("seen desc").Find(&holders)
+
+	providers := []link{}
+	seen := make(map[string]bool)
+	for _, h := range holders {
+		links := b.core.links.byKey(h.Peer)
+		if len(links) == 0 {
+			b.dial(h.Peer)
+		}
+		for _, l := range links {
+			if l.supports(capBlob) && !seen[h.Peer] {
+				seen[h.Peer] = true
+				providers = append(providers, l)
+			}
+		}
+	}
+	for _, l := range b.core.links.all() {
+		if l.supports(capBlob) && !seen[l.peerKey()] {
+			seen[l.peerKey()] = true
+			providers = append(providers, l)
+		}
+	}
+	return providers
+}
+
+func (b *BlobStore) dial(signKey string) {
+	peer := Peer{}
+	b.db.Where("sign_key = ?", signKey).Find(&peer)
+	if peer.SignKey != "" && peer.Score > banScore && !b.core.clientManager.inClientList(peer) {
+		b.core.clientManager.connect(peer)
+	}
+}
+
+// manifest fetches and checks a blob's manifest, and returns the providers
+// that did not say they lack the blob.
+func (b *BlobStore) manifest(ctx context.Context, hash string, providers []link) (blobManifest, []byte, []link, error) {
+	remaining := []link{}
+	var found []byte
+	for _, l := range providers {
+		if found != nil {
+			remaining = append(remaining, l)
+			continue
+		}
+		res, err := b.request(ctx, l, blobFrame{Type: "manifest", Hash: hash})
+		if ctx.Err() != nil {
+			return blobManifest{}, nil, nil, ctx.Err()
+		}
+		if err != nil {
+			continue
+		}
+		if res.Type == "busy" {
+			continue
+		}
+		if res.Type != "manifest" {
+			b.db.Where("hash = ? AND peer = ?", hash, l.peerKey()).Delete(&blobHolder{})
+			continue
+		}
+		if blobHash(res.Data) != hash {
+			b.core.log.Warn("Peer sent a manifest that does not match the blob hash", "peer", l.peerKey(), "hash", hash)
+			continue
+		}
+		found = res.Data
+		remaining = append(remaining, l)
+	}
+	if found == nil {
+		return blobManifest{}, nil, nil, errBlobNotFound
+	}
+
+	m := blobManifest{}
+	if err := msgpack.Unmarshal(found, &m); err != nil {
+		return blobManifest{}, nil, nil, err
+	}
+	if m.Size < 0 || m.ChunkSize <= 0 || m.ChunkSize > blobChunkSize ||
+		int64(len(m.Chunks)) != (m.Size+int64(m.ChunkSize)-1)/int64(m.ChunkSize) {
+		return blobManifest{}, nil, nil, errBlobManifest
+	}
+	return m, found, remaining, nil
+}
+
+// fetchChunks fetches every chunk of a blob into f, from several providers
+// at once.
+func (b *BlobStore) fetchChunks(ctx context.Context, hash string, m blobManifest, providers []link, f *os.File) error {
+	if err := f.Truncate(m.Size); err != nil {
+		return err
+	}
+	jobs := make(chan int, len(m.Chunks))
+	for i := range m.Chunks {
+		jobs <- i
+	}
+	close(jobs)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	workers := blobParallel
+	if workers > len(m.Chunks) {
+		workers = len(m.Chunks)
+	}
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if err := b.fetchChunk(ctx, hash, m, i, providers, f); err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// fetchChunk fetches and verifies a single chunk, trying the providers in
+// turn, starting with a different one for each chunk.
+func (b *BlobStore) fetchChunk(ctx context.Context, hash string, m blobManifest, index int, providers []link, f *os.File) error {
+	offset := int64(index) * int64(m.ChunkSize)
+	size := m.Size - offset
+	if size > int64(m.ChunkSize) {
+		size = int64(m.ChunkSize)
+	}
+	for attempt := 0; attempt < len(providers)*blobChunkRetries; attempt++ {
+		l := providers[(index+attempt)%len(providers)]
+		res, err := b.request(ctx, l, blobFrame{Type: "chunk", Hash: hash, Index: index})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil || res.Type != "chunk" {
+			continue
+		}
+		sum := sha256.Sum256(res.Data)
+		if int64(len(res.Data)) != size || !bytes.Equal(sum[:], m.Chunks[index]) {
+			b.core.log.Warn("Peer sent a chunk that does not match the manifest", "peer", l.peerKey(), "hash", hash, "index", index)
+			continue
+		}
+		_, err = f.WriteAt(res.Data, offset)
+		return err
+	}
+	return errBlobChunk
+}
+
+// request sends a request to a peer and waits for its answer.
+func (b *BlobStore) request(ctx context.Context, l link, req blobFrame) (blobFrame, error) {
+	req.ID = uuid.NewV4().String()
+	answer := make(chan blobFrame, 1)
+	b.mu.Lock()
+	b.requests[req.ID] = answer
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.requests, req.ID)
+		b.mu.Unlock()
+	}()
+
+	if err := b.send(l, req); err != nil {
+		return blobFrame{}, err
+	}
+	timer := time.NewTimer(blobRequestTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-answer:
+		return res, nil
+	case <-timer.C:
+		return blobFrame{}, context.DeadlineExceeded
+	case <-ctx.Done():
+		return blobFrame{}, ctx.Err()
+	}
+}
+
+func (b *BlobStore) send(l link, f blobFrame) error {
+	data, err := msgpack.Marshal(f)
+	if err != nil {
+		return err
+	}
+	l.cast(data, b.core.newDirect(data, capBlob))
+	return nil
+}
+
+// handle answers a blob request from a peer, or hands an answer to the
+// request waiting for it.
+func (b *BlobStore) handle(from link, data []byte) {
+	f := blobFrame{}
+	if err := msgpack.Unmarshal(data, &f); err != nil {
+		b.core.log.Warn("Could not decode blob frame", "peer", from.peerKey(), "err", err)
+		return
+	}
+	if f.Reply {
+		b.mu.Lock()
+		answer, ok := b.requests[f.ID]
+		b.mu.Unlock()
+		if ok {
+			select {
+			case answer <- f:
+			default:
+			}
+		}
+		return
+	}
+	// a peer that is serving as many requests as it can says so, and the
+	// requester moves on to the next provider
+	if !b.acquire(from.peerKey()) {
+		b.send(from, blobFrame{Type: "busy", ID: f.ID, Hash: f.Hash, Index: f.Index, Reply: true})
+		return
+	}
+	go func() {
+		defer b.release(from.peerKey())
+		b.serve(from, f)
+	}()
+}
+
+// acquire takes one of the blobServeTotal slots for serving requests, and
+// one of the blobServePeer slots of the peer, if both are free.
+func (b *BlobStore) acquire(peer string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.serving >= blobServeTotal || b.servingPeer[peer] >= blobServePeer {
+		return false
+	}
+	b.serving++
+	b.servingPeer[peer]++
+	return true
+}
+
+func (b *BlobStore) release(peer string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.serving--
+	if b.servingPeer[peer]--; b.servingPeer[peer] == 0 {
+		delete(b.servingPeer, peer)
+	}
+}
+
+func (b *BlobStore) serve(to link, req blobFrame) {
+	res := blobFrame{Type: "missing", ID: req.ID, Hash: req.Hash, Index: req.Index, Reply: true}
+	row := storedBlob{}
+	b.db.Where("hash = ?", req.Hash).Find(&row)
+	if row.Hash != "" {
+		switch req.Type {
+		case "manifest":
+			res.Type, res.Data = "manifest", row.Manifest
+		case "chunk":
+			if data, err := b.readChunk(row, req.Index); err == nil {
+				res.Type, res.Data = "chunk", data
+			}
+		}
+	}
+	b.send(to, res)
+}
+
+func (b *BlobStore) readChunk(row storedBlob, index int) ([]byte, error) {
+	m := blobManifest{}
+	if err := msgpack.Unmarshal(row.Manifest, &m); err != nil {
+		return nil, err
+	}
+	offset := int64(index) * int64(m.ChunkSize)
+	if index < 0 || offset >= m.Size {
+		return nil, errBlobManifest
+	}
+	size := m.Size - offset
+	if size > int64(m.ChunkSize) {
+		size = int64(m.ChunkSize)
+	}
+	f, err := os.Open(b.path(row.Hash))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data := make([]byte, size)
+	if _, err := f.ReadAt(data, offset); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
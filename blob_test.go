@@ -0,0 +1,201 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// blobLink connects the blob stores of two test cores. A corrupting link
+// flips a byte of every chunk sent back over it.
+type blobLink struct {
+	self, peer *core
+	corrupt    bool
+}
+
+func (l *blobLink) cast(msg []byte, meta broadcast) {
+	switch meta.Kind {
+	case "have":
+		l.peer.blobs.announced(meta, msg)
+	case capBlob:
+		f := blobFrame{}
+		msgpack.Unmarshal(msg, &f)
+		if l.corrupt && f.Type == "chunk" && len(f.Data) > 0 {
+			f.Data[0] ^= 0xff
+			msg, _ = msgpack.Marshal(f)
+		}
+		back := &blobLink{self: l.peer, peer: l.self, corrupt: l.corrupt}
+		go l.peer.blobs.handle(back, msg)
+	}
+}
+
+func (l *blobLink) send(msg []byte)                 {}
+func (l *blobLink) peerKey() string                 { return l.peer.keys.signKeyHex() }
+func (l *blobLink) supports(capability string) bool { return true }
+func (l *blobLink) toString() string                { return l.peerKey() }
+
+func newTestBlobCore(t *testing.T) *core {
+	t.Helper()
+	c := newTestCore(t)
+	c.tree = newPlumtree(c)
+	c.blobs = newBlobStore(c)
+	c.blobs.dir = t.TempDir()
+	return c
+}
+
+// connect links a to b, and b to a unless the link corrupts chunks.
+func connectBlobs(a, b *core, corrupt bool) {
+	a.links.add(&blobLink{self: a, peer: b, corrupt: corrupt})
+	if !corrupt {
+		b.links.add(&blobLink{self: b, peer: a})
+	}
+}
+
+func randomBlob(t *testing.T, size int) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestBlobPutGet(t *testing.T) {
+	a, b := newTestBlobCore(t), newTestBlobCore(t)
+	connectBlobs(a, b, false)
+	data := randomBlob(t, 3*blobChunkSize+blobChunkSize/2)
+
+	hash, err := a.blobs.Put(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := a.blobs.Get(context.Background(), hash); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("local Get = %d bytes, %v", len(got), err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	got, err := b.blobs.Get(ctx, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("fetched blob differs from the stored one")
+	}
+	if !b.blobs.Has(hash) {
+		t.Fatal("fetched blob was not kept")
+	}
+}
+
+func TestBlobChunkVerification(t *testing.T) {
+	bad, good, fetcher := newTestBlobCore(t), newTestBlobCore(t), newTestBlobCore(t)
+	data := randomBlob(t, 2*blobChunkSize)
+	hash, err := bad.blobs.Put(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every chunk from the only provider is corrupted on the way
+	connectBlobs(fetcher, bad, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := fetcher.blobs.Get(ctx, hash); err != errBlobChunk {
+		t.Fatalf("Get from a corrupting peer = %v, want %v", err, errBlobChunk)
+	}
+	if fetcher.blobs.Has(hash) {
+		t.Fatal("kept a blob with corrupted chunks")
+	}
+
+	// the chunks are fetched from the peer that sends them intact
+	if _, err := good.blobs.Put(data); err != nil {
+		t.Fatal(err)
+	}
+	connectBlobs(fetcher, good, false)
+	got, err := fetcher.blobs.Get(ctx, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("fetched blob differs from the stored one")
+	}
+}
+
+func TestBlobPinAndGC(t *testing.T) {
+	c := newTestBlobCore(t)
+	if err := c.blobs.Pin("unknown"); err != errBlobNotFound {
+		t.Fatalf("Pin of an unknown blob = %v, want %v", err, errBlobNotFound)
+	}
+
+	hashes := []string{}
+	for i := 0; i < 3; i++ {
+		hash, err := c.blobs.Put(randomBlob(t, blobChunkSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+		time.Sleep(10 * time.Millisecond)
+	}
+	pinned, older, newer := hashes[0], hashes[1], hashes[2]
+	c.blobs.Unpin(older)
+	c.blobs.Unpin(newer)
+
+	c.blobs.core.config.BlobMaxBytes = 3 * blobChunkSize
+	if freed := c.blobs.GC(); freed != 0 {
+		t.Fatalf("GC freed %d bytes from a store that fits", freed)
+	}
+
+	// the least recently used unpinned blob goes first, and pinned blobs
+	// stay however old they are
+	c.blobs.core.config.BlobMaxBytes = 2 * blobChunkSize
+	if freed := c.blobs.GC(); freed != blobChunkSize {
+		t.Fatalf("GC freed %d bytes, want %d", freed, blobChunkSize)
+	}
+	if c.blobs.Has(older) || !c.blobs.Has(newer) || !c.blobs.Has(pinned) {
+		t.Fatalf("GC kept older %v, newer %v, pinned %v", c.blobs.Has(older), c.blobs.Has(newer), c.blobs.Has(pinned))
+	}
+	if _, err := c.blobs.local(older); err != errBlobNotFound {
+		t.Fatalf("collected blob is still readable: %v", err)
+	}
+
+	c.blobs.core.config.BlobMaxBytes = 0
+	c.blobs.GC()
+	if c.blobs.Has(newer) || !c.blobs.Has(pinned) {
+		t.Fatal("GC must collect every unpinned blob and no pinned one")
+	}
+}
+
+func TestBlobServeLimit(t *testing.T) {
+	c := newTestBlobCore(t)
+	for i := 0; i < blobServePeer; i++ {
+		if !c.blobs.acquire("peer") {
+			t.Fatalf("refused request %d of a peer", i)
+		}
+	}
+
+	// the peer is told to ask elsewhere, other peers are still served
+	busy := &testLink{key: "peer"}
+	req, _ := msgpack.Marshal(blobFrame{Type: "manifest", ID: "1", Hash: "unknown"})
+	c.blobs.handle(busy, req)
+	frames := busy.frames()
+	res := blobFrame{}
+	if len(frames) != 1 || msgpack.Unmarshal(frames[0], &res) != nil || res.Type != "busy" || !res.Reply {
+		t.Fatalf("peer over its limit got %+v", res)
+	}
+	for i := blobServePeer; i < blobServeTotal; i++ {
+		if !c.blobs.acquire("other" + string(rune('a'+i%4))) {
+			t.Fatalf("refused request %d in total", i)
+		}
+	}
+	if c.blobs.acquire("another") {
+		t.Fatal("served more than blobServeTotal requests at once")
+	}
+
+	c.blobs.release("peer")
+	if !c.blobs.acquire("another") {
+		t.Fatal("a released slot was not reused")
+	}
+}
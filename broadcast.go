@@ -0,0 +1,317 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/vmihailenco/msgpack"
+	"golang.org/x/crypto/nacl/box"
+)
+
+var (
+	errDecrypt = errors.New("decryption failed")
+	errReplay  = errors.New("frame out of sequence")
+	errStale   = errors.New("frame outside of clock skew window")
+	errOrigin  = errors.New("invalid origin signature")
+)
+
+// seqCounter tracks the sequence numbers of sealed frames on a single
+// authenticated connection, in both directions.
+type seqCounter struct {
+	sendMu sync.Mutex
+	sent   uint64
+
+	recvMu sync.Mutex
+	recv   uint64
+}
+
+// stamp calls send with the next outgoing sequence number. The counter stays
+// locked until send returns so frames leave the connection in order.
+func (s *seqCounter) stamp(send func(seq uint64)) {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	s.sent++
+	send(s.sent)
+}
+
+// accept records seq if it is newer than every frame seen so far.
+func (s *seqCounter) accept(seq uint64) bool {
+	s.recvMu.Lock()
+	defer s.recvMu.Unlock()
+	if seq <= s.recv {
+		return false
+	}
+	s.recv = seq
+	return true
+}
+
+// makeSeqNonce builds a nonce that binds the sequence number and origin
+// timestamp of a frame, so neither can be altered without breaking the seal.
+func makeSeqNonce(seq uint64, timestamp int64) xNonce {
+	xn := xNonce{}
+
+	var nonce [24]byte
+	binary.BigEndian.PutUint64(nonce[0:8], seq)
+	binary.BigEndian.PutUint64(nonce[8:16], uint64(timestamp))
+	rand.Read(nonce[16:])
+
+	xn.bytes = &nonce
+	xn.str = hex.EncodeToString(nonce[:])
+
+	return xn
+}
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// fresh reports whether an origin timestamp is within the configured clock
+// skew of the local clock.
+func (c *core) fresh(timestamp int64) bool {
+	skew := int64(c.config.ClockSkew / time.Millisecond)
+	delta := unixMillis(time.Now()) - timestamp
+	return delta <= skew && delta >= -skew
+}
+
+// BroadcastOption changes how a single broadcast is sent.
+type BroadcastOption func(*broadcastOptions)
+
+type broadcastOptions struct {
+	ttl         int
+	kind        string
+	trace       bool
+	traceReport bool
+	ack         bool
+	ref         string
+	recipients  []string
+	clock       vectorClock
+}
+
+// WithTTL overrides the configured DefaultTTL for one broadcast.
+func WithTTL(ttl int) BroadcastOption {
+	return func(o *broadcastOptions) {
+		o.ttl = ttl
+	}
+}
+
+// WithTrace asks every node the broadcast reaches to record its arrival,
+// which fires a MessageTraced event on that node. With report set, the
+// records are also sent back to us, and DP2P.Trace rebuilds how the message
+// spread from them. Broadcasts sent as streams are traced chunk by chunk.
+func WithTrace(report bool) BroadcastOption {
+	return func(o *broadcastOptions) {
+		o.trace = true
+		o.traceReport = report
+	}
+}
+
+// withKind marks a broadcast as carrying one of our own payload types rather
+// than application data.
+func withKind(kind string) BroadcastOption {
+	return func(o *broadcastOptions) {
+		o.kind = kind
+	}
+}
+
+// withClock sends a broadcast with a vector clock that was already stamped,
+// when a message is sent again.
+func withClock(clock vectorClock) BroadcastOption {
+	return func(o *broadcastOptions) {
+		o.clock = clock
+	}
+}
+
+// newBroadcast creates the metadata for a message originating from this node
+// and signs it with our sign key.
+func (c *core) newBroadcast(msg []byte, messageID string, opts ...BroadcastOption) broadcast {
+	options := broadcastOptions{ttl: c.config.DefaultTTL}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.ttl > c.config.MaxTTL {
+		options.ttl = c.config.MaxTTL
+	}
+	if options.clock == nil && options.kind == "" && c.causal != nil {
+		options.clock = c.causal.stamp()
+	}
+
+	b := broadcast{
+		Type:      "broadcast",
+		MessageID: messageID,
+		Timestamp: unixMillis(time.Now()),
+		TTL:       options.ttl,
+		Kind:      options.kind,
+		Origin:    hex.EncodeToString(c.keys.signKeys.Pub),
+
+		Trace:       options.trace,
+		TraceReport: options.trace && options.traceReport,
+
+		Ack:   options.ack,
+		Ref:   options.ref,
+		Clock: options.clock,
+	}
+	b.Signature = hex.EncodeToString(ed25519.Sign(c.keys.signKeys.Priv, originDigest(&b, msg)))
+	return b
+}
+
+// newDirect creates the metadata for a frame sent to a single peer. Direct
+// frames are sealed and signed like broadcasts but are never relayed.
+func (c *core) newDirect(msg []byte, kind string) broadcast {
+	b := broadcast{
+		Type:      "direct",
+		MessageID: uuid.NewV4().String(),
+		Timestamp: unixMillis(time.Now()),
+		Kind:      kind,
+		Origin:    hex.EncodeToString(c.keys.signKeys.Pub),
+	}
+	b.Signature = hex.EncodeToString(ed25519.Sign(c.keys.signKeys.Priv, originDigest(&b, msg)))
+	return b
+}
+
+// originDigest is what the origin of a broadcast signs. It covers everything
+// that stays the same from hop to hop.
+func originDigest(b *broadcast, msg []byte) []byte {
+	hash := sha256.Sum256(msg)
+	digest := []byte(b.Type + "\x00" + b.Kind + "\x00" + b.MessageID)
+	digest = append(digest, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(digest[len(digest)-8:], uint64(b.Timestamp))
+	digest = append(digest, hash[:]...)
+	if len(b.Clock) > 0 {
+		digest = append(digest, 0)
+		digest = append(digest, b.Clock.bytes()...)
+	}
+	// flags are only added when set, so that plain broadcasts are signed
+	// the same as before
+	if flags := b.flags(); flags != 0 {
+		digest = append(digest, 1, flags)
+	}
+	if b.Ref != "" {
+		digest = append(digest, 2)
+		digest = append(digest, b.Ref...)
+	}
+	return digest
+}
+
+// flags packs the options that change how nodes handle a broadcast, for the
+// signature.
+func (b *broadcast) flags() byte {
+	var flags byte
+	if b.Trace {
+		flags |= 1
+	}
+	if b.TraceReport {
+		flags |= 2
+	}
+	if b.Ack {
+		flags |= 4
+	}
+	return flags
+}
+
+// setFlags restores the options packed by flags.
+func (b *broadcast) setFlags(flags byte) {
+	b.Trace = flags&1 != 0
+	b.TraceReport = flags&2 != 0
+	b.Ack = flags&4 != 0
+}
+
+// verifyOrigin checks the origin's signature on a received broadcast.
+func verifyOrigin(b *broadcast, msg []byte) bool {
+	origin, err := hex.DecodeString(b.Origin)
+	if err != nil || len(origin) != ed25519.PublicKeySize {
+		return false
+	}
+	signature, err := hex.DecodeString(b.Signature)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(origin, originDigest(b, msg), signature)
+}
+
+// relay returns the metadata to forward a received broadcast with, and
+// whether its hop limit allows it to be forwarded at all.
+func (c *core) relay(b broadcast) (broadcast, bool) {
+	if b.TTL > c.config.MaxTTL {
+		b.TTL = c.config.MaxTTL
+	}
+	if b.TTL <= 0 {
+		b.TTL = 0
+		return b, false
+	}
+	b.TTL--
+	return b, true
+}
+
+// sealBroadcast compresses msg with the connection's codec, seals it for the
+// holder of theirKey and returns the packed frame built from meta, which is a
+// broadcast unless meta says otherwise.
+func (c *core) sealBroadcast(msg []byte, meta broadcast, seq uint64, theirKey []byte, codec string) ([]byte, error) {
+	plain, codec := c.compress(msg, codec)
+	nonce := makeSeqNonce(seq, meta.Timestamp)
+	secret := box.Seal(nil, plain, nonce.bytes, keySliceConvert(theirKey), &c.keys.sealKeys.Priv)
+
+	if meta.Type == "" {
+		meta.Type = "broadcast"
+	}
+	meta.Secret = hex.EncodeToString(secret)
+	meta.Nonce = nonce.str
+	meta.Seq = seq
+	meta.Codec = codec
+
+	atomic.AddUint64(&c.counters.messagesSent, 1)
+	atomic.AddUint64(&c.counters.bytesSent, uint64(len(secret)))
+	return msgpack.Marshal(meta)
+}
+
+// openBroadcast unseals a broadcast frame from the holder of theirKey and
+// checks it against the connection's sequence and the clock skew window.
+func (c *core) openBroadcast(b *broadcast, theirKey []byte, seq *seqCounter) ([]byte, error) {
+	crypt, err := hex.DecodeString(b.Secret)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hex.DecodeString(b.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != 24 || len(theirKey) < 32 {
+		return nil, errDecrypt
+	}
+
+	unsealed, success := box.Open(nil, crypt, nonceSliceConvert(nonce), keySliceConvert(theirKey), &c.keys.sealKeys.Priv)
+	if !success {
+		return nil, errDecrypt
+	}
+	unsealed, err = decompress(unsealed, b.Codec, c.config.MaxFrameSize)
+	if err != nil {
+		return nil, err
+	}
+
+	expected := makeSeqNonce(b.Seq, b.Timestamp)
+	if !bytes.Equal(nonce[:16], expected.bytes[:16]) {
+		return nil, errDecrypt
+	}
+	if !seq.accept(b.Seq) {
+		return nil, errReplay
+	}
+	if !c.fresh(b.Timestamp) {
+		return nil, errStale
+	}
+	if !verifyOrigin(b, unsealed) {
+		return nil, errOrigin
+	}
+
+	atomic.AddUint64(&c.counters.messagesReceived, 1)
+	atomic.AddUint64(&c.counters.bytesReceived, uint64(len(crypt)))
+
+	return unsealed, nil
+}
@@ -0,0 +1,174 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+	"time"
+)
+
+// vectorClock counts the messages from each origin, keyed by hex sign key.
+type vectorClock map[string]uint64
+
+func (v vectorClock) copy() vectorClock {
+	c := make(vectorClock, len(v))
+	for k, n := range v {
+		c[k] = n
+	}
+	return c
+}
+
+// bytes encodes the clock deterministically, for signing.
+func (v vectorClock) bytes() []byte {
+	keys := make([]string, 0, len(v))
+	for k := range v {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := []byte{}
+	for _, k := range keys {
+		out = append(out, k...)
+		out = append(out, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(out[len(out)-8:], v[k])
+	}
+	return out
+}
+
+// causalMessage is a message waiting for its causal predecessors.
+type causalMessage struct {
+	message Message
+	clock   vectorClock
+	since   time.Time
+}
+
+// causal delivers messages in causal order. Every application broadcast
+// carries the origin's vector clock: the number of messages it had
+// delivered from each origin when it sent the message, with its own entry
+// counting the message itself. A message is held back until everything it
+// depends on was delivered here, which also keeps the messages of each
+// origin in the order they were sent.
+//
+// Messages whose predecessors do not show up within CausalTimeout are
+// delivered anyway, and the missing predecessors are delivered whenever they
+// arrive. We start counting an origin's messages at the first one we see, so
+// a node that joins late does not wait for what was sent before it joined.
+type causal struct {
+	core *core
+
+	mu        sync.Mutex
+	delivered vectorClock
+	pending   []*causalMessage
+}
+
+func newCausal(core *core) *causal {
+	c := &causal{core: core, delivered: vectorClock{}}
+	go c.expireLoop()
+	return c
+}
+
+// stamp counts a message we are about to send and returns its clock.
+func (c *causal) stamp() vectorClock {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.delivered[c.core.keys.signKeyHex()]++
+	return c.delivered.copy()
+}
+
+// receive delivers a message once its causal predecessors are delivered.
+// Messages without a clock are delivered right away.
+func (c *causal) receive(m Message, clock vectorClock) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// our own messages were counted when they were stamped
+	if len(clock) == 0 || m.Origin == c.core.keys.signKeyHex() {
+		c.core.deliver(m)
+		return
+	}
+	for k, n := range clock {
+		if _, ok := c.delivered[k]; ok {
+			continue
+		}
+		c.delivered[k] = n
+		if k == m.Origin && n > 0 {
+			c.delivered[k] = n - 1
+		}
+	}
+
+	c.pending = append(c.pending, &causalMessage{message: m, clock: clock, since: time.Now()})
+	if len(c.pending) > causalBufferSize {
+		c.force(c.pending[0])
+	}
+	c.drain()
+}
+
+// ready reports whether a waiting message can be delivered. Messages we
+// gave up waiting for predecessors of are delivered when they arrive.
+func (c *causal) ready(p *causalMessage) bool {
+	origin := p.message.Origin
+	if p.clock[origin] <= c.delivered[origin] {
+		return true
+	}
+	if p.clock[origin] != c.delivered[origin]+1 {
+		return false
+	}
+	for k, n := range p.clock {
+		if k != origin && n > c.delivered[k] {
+			return false
+		}
+	}
+	return true
+}
+
+// drain delivers every waiting message that became ready, in order.
+func (c *causal) drain() {
+	for progress := true; progress; {
+		progress = false
+		for i, p := range c.pending {
+			if !c.ready(p) {
+				continue
+			}
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			c.advance(p)
+			c.core.deliver(p.message)
+			progress = true
+			break
+		}
+	}
+}
+
+func (c *causal) advance(p *causalMessage) {
+	origin := p.message.Origin
+	if p.clock[origin] > c.delivered[origin] {
+		c.delivered[origin] = p.clock[origin]
+	}
+}
+
+// force delivers a message without waiting for its predecessors any longer.
+func (c *causal) force(p *causalMessage) {
+	c.core.log.Debug("Delivering message without its causal predecessors", "messageID", p.message.ID, "origin", p.message.Origin)
+	for i, other := range c.pending {
+		if other == p {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			break
+		}
+	}
+	for k, n := range p.clock {
+		if n > c.delivered[k] {
+			c.delivered[k] = n
+		}
+	}
+	c.core.deliver(p.message)
+}
+
+func (c *causal) expireLoop() {
+	for {
+		time.Sleep(1 * time.Second)
+		c.mu.Lock()
+		for len(c.pending) > 0 && time.Since(c.pending[0].since) > c.core.config.CausalTimeout {
+			c.force(c.pending[0])
+			c.drain()
+		}
+		c.mu.Unlock()
+	}
+}
@@ -0,0 +1,145 @@
+package p2p
+
+import (
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/vmihailenco/msgpack"
+)
+
+// Channel is a named stream of messages kept apart from the ones delivered
+// through Receive, for protocols built on top of the network, such as the
+// kv package. Messages on channels nobody opened are dropped.
+type Channel struct {
+	core     *core
+	name     string
+	messages chan Message
+	ordered  chan Message
+}
+
+// channelSet holds the open channels by name. The zero value is ready to
+// use.
+type channelSet struct {
+	mu       sync.Mutex
+	channels map[string]*Channel
+	inboxes  map[string]*inbox
+	ordered  map[string]*inbox
+}
+
+// Channel opens the channel with the given name, or returns it if it is
+// already open. It can be called before Initialize.
+func (d *DP2P) Channel(name string) *Channel {
+	s := &d.core.channels
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ch, ok := s.channels[name]; ok {
+		return ch
+	}
+	if s.channels == nil {
+		s.channels = make(map[string]*Channel)
+		s.inboxes = make(map[string]*inbox)
+		s.ordered = make(map[string]*inbox)
+	}
+	ch := &Channel{core: &d.core, name: name, messages: make(chan Message), ordered: make(chan Message)}
+	s.channels[name] = ch
+	s.inboxes[name] = newInbox(ch.messages)
+	s.ordered[name] = newInbox(ch.ordered)
+	return ch
+}
+
+// SignKey returns this node's hex encoded sign key, which identifies it on
+// the network. It blocks until the keys are loaded by Initialize.
+func (d *DP2P) SignKey() string {
+	for d.core.keys.signKeys.Pub == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+	return d.core.keys.signKeyHex()
+}
+
+// Broadcast sends data to the channel on every node, ourselves included.
+func (ch *Channel) Broadcast(data []byte, opts ...BroadcastOption) (uuid.UUID, error) {
+	frame, err := msgpack.Marshal(channelFrame{Channel: ch.name, Data: data})
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+	return ch.core.broadcast(frame, append(opts, withKind("channel"))...), nil
+}
+
+// OrderedBroadcast sends data to the channel on every node, ourselves
+// included, in the same order as every other ordered broadcast. It is
+// delivered through ReceiveOrdered, and otherwise behaves like
+// DP2P.OrderedBroadcast.
+func (ch *Channel) OrderedBroadcast(data []byte) (uuid.UUID, error) {
+	if ch.core.ordered == nil {
+		return uuid.UUID{}, errNoVoters
+	}
+	frame, err := msgpack.Marshal(channelFrame{Channel: ch.name, Data: data})
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+	if len(frame) > ch.core.config.ChunkSize {
+		return uuid.UUID{}, errOrderedSize
+	}
+	return ch.core.broadcast(frame, withKind("channelPropose")), nil
+}
+
+// Send sends data to the channel on a single peer we are connected to,
+// identified by its hex sign key.
+func (ch *Channel) Send(peer string, data []byte) error {
+	links := ch.core.links.byKey(peer)
+	if len(links) == 0 {
+		return errNotConnected
+	}
+	if !links[0].supports(capChannel) {
+		return errUnsupported
+	}
+	frame, err := msgpack.Marshal(channelFrame{Channel: ch.name, Data: data})
+	if err != nil {
+		return err
+	}
+	links[0].cast(frame, ch.core.newDirect(frame, "channel"))
+	return nil
+}
+
+// Receive returns the next message on the channel. It blocks until one is
+// ready. Messages sent with Send have Peer set to the sender.
+func (ch *Channel) Receive() Message {
+	return <-ch.messages
+}
+
+// ReceiveOrdered returns the next ordered broadcast on the channel, with
+// Message.Seq set to its position among all ordered broadcasts. It blocks
+// until one is ready.
+func (ch *Channel) ReceiveOrdered() Message {
+	return <-ch.ordered
+}
+
+// deliverOrdered delivers an ordered broadcast to the channel it names.
+func (s *channelSet) deliverOrdered(name string, m Message) {
+	s.mu.Lock()
+	in, ok := s.ordered[name]
+	s.mu.Unlock()
+	if ok {
+		in.push(m)
+	}
+}
+
+// channel delivers a channel frame to the channel it names.
+func (c *core) channel(meta broadcast, data []byte, peer string) {
+	frame := channelFrame{}
+	if err := msgpack.Unmarshal(data, &frame); err != nil {
+		c.log.Warn("Could not decode channel frame", "origin", meta.Origin, "err", err)
+		return
+	}
+	c.channels.mu.Lock()
+	in, ok := c.channels.inboxes[frame.Channel]
+	c.channels.mu.Unlock()
+	if !ok {
+		c.log.Debug("Dropped message for a channel that is not open", "channel", frame.Channel, "origin", meta.Origin)
+		return
+	}
+	m := newMessage(meta, frame.Data, false)
+	m.Peer = peer
+	in.push(m)
+}
@@ -4,26 +4,27 @@ import (
 	"crypto/ed25519"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"encoding/hex"
 	"encoding/json"
-	"io/ioutil"
-	"net/http"
 	"net/url"
 
 	"github.com/gorilla/websocket"
 	"github.com/vmihailenco/msgpack"
-	"golang.org/x/crypto/nacl/box"
 )
 
 type client struct {
 	core     *core
-	received *lockList
+	received *seenCache
 	readMu   *sync.Mutex
 
 	peer *Peer
-	conn *websocket.Conn
+	// conn is set once the websocket is open, and read through connection,
+	// since propagate looks at it from other goroutines
+	conn   *websocket.Conn
+	connMu sync.Mutex
 
 	serverInfo   infoRes
 	authorized   bool
@@ -31,11 +32,20 @@ type client struct {
 	failed       bool
 	isSelfClient bool
 	pingTime     time.Duration
+	seq          seqCounter
+	codec        string
+	version      int
+	caps         capabilitySet
+	closeCode    CloseCode
+	closeReason  string
+	since        time.Time
+	queue        *sendQueue
+	download     *bandwidth
 
 	mu sync.Mutex
 }
 
-func (client *client) initialize(core *core, peer *Peer, received *lockList, readMu *sync.Mutex, selfClient bool) {
+func (client *client) initialize(core *core, peer *Peer, received *seenCache, readMu *sync.Mutex, selfClient bool) {
 	client.core = core
 	client.connecting = true
 	client.readMu = readMu
@@ -49,54 +59,96 @@ func (client *client) initialize(core *core, peer *Peer, received *lockList, rea
 
 func (client *client) handshake() {
 
-	httpClient := http.Client{
-		Timeout: 1 * time.Second,
-	}
-
 	startPing := time.Now()
-	infoURL := url.URL{Scheme: "http", Host: client.toString(), Path: "/info"}
-	iRes, err := httpClient.Get(infoURL.String())
+	infoBody, err := client.core.get(client.toString(), "/info", 1*time.Second)
 	if err != nil {
 		client.fail()
 		return
 	}
 	client.pingTime = time.Since(startPing)
 
-	infoBody, err := ioutil.ReadAll(iRes.Body)
-	if err != nil {
-		client.fail()
-		return
-	}
-
 	info := infoRes{}
 	json.Unmarshal(infoBody, &info)
 
 	client.serverInfo = info
+	if client.peer.SignKey == "" {
+		client.peer.SignKey = info.PubSignKey
+	}
+
+	if ok, reason := client.core.compatible(info.Protocol); !ok {
+		client.core.log.Warn("Not connecting to incompatible peer", "host", client.toString(), "reason", reason)
+		client.fail()
+		return
+	}
 
 	u := url.URL{Scheme: "ws", Host: client.toString(), Path: "/socket"}
 
-	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	dialer := websocket.Dialer{
+		HandshakeTimeout: websocket.DefaultDialer.HandshakeTimeout,
+		ReadBufferSize:   socketBufferSize,
+		WriteBufferSize:  socketBufferSize,
+	}
+	c, _, err := dialer.Dial(u.String(), client.core.authorize("GET", u.Host, u.Path))
 	if err != nil {
 		client.fail()
 		return
 	}
+	c.SetReadLimit(client.core.frameLimit())
+	// the queue is set up before conn, since propagate sends to every
+	// client whose conn is set
+	client.queue = newSendQueue(client.core, client.write)
+	if client.isSelfClient {
+		client.queue.exempt()
+	} else {
+		client.download = newBandwidth(client.core.config.DownloadRate)
+	}
+	client.connMu.Lock()
 	client.conn = c
+	client.connMu.Unlock()
+	if !client.isSelfClient {
+		client.core.events.emit(Event{Type: PeerConnected, Peer: client.peer.SignKey, Host: client.toString(), Direction: "outbound"})
+	}
 	go client.listen()
 }
 
+// connection returns the client's websocket, or nil until it is open.
+func (client *client) connection() *websocket.Conn {
+	client.connMu.Lock()
+	defer client.connMu.Unlock()
+	return client.conn
+}
+
+func (client *client) peerKey() string {
+	return client.peer.SignKey
+}
+
+func (client *client) supports(capability string) bool {
+	return client.caps[capability]
+}
+
 func (client *client) toString() string {
 	return client.peer.Host + ":" + strconv.Itoa(client.peer.Port)
 }
 
 func (client *client) listen() {
 	for {
-		_, rawMessage, err := client.conn.ReadMessage()
+		_, rawMessage, err := client.connection().ReadMessage()
 		if err != nil {
 			client.fail()
 			return
 		}
+		if !client.isSelfClient {
+			throttle(len(rawMessage), &client.core.counters.downloadWait, client.download, client.core.download)
+		}
+		rawMessage, err = client.core.openFrame(rawMessage)
+		if err != nil {
+			client.core.log.Warn("Frame not sealed with the network key", "host", client.toString(), "err", err)
+			atomic.AddUint64(&client.core.counters.decryptFailures, 1)
+			client.fail()
+			return
+		}
 		if client.core.config.LogLevel > 1 {
-			log.Infof(colors.boldCyan+"RECV"+colors.reset+" %s", rawMessage)
+			client.core.log.Debug("RECV", "host", client.toString(), "direction", "inbound", "frame", rawMessage)
 		}
 
 		msg := message{}
@@ -117,43 +169,66 @@ func (client *client) listen() {
 		case "authorized":
 			client.authorized = true
 			client.connecting = false
-			log.Info(colors.boldGreen+"AUTH"+colors.reset, "Logged in to "+client.peer.toString(false))
+			client.since = time.Now()
+			client.core.log.Info("Logged in", "peer", client.peer.SignKey, "host", client.toString(), "direction", "outbound")
+			if !client.isSelfClient {
+				client.core.linkUp(client)
+				client.core.db.adjustScore(client.peer.SignKey, 1)
+				client.core.handshake(true)
+				client.core.events.emit(linkEvent(PeerAuthenticated, client))
+				if client.core.history != nil && client.supports(capSync) {
+					go client.core.history.sync(client)
+				}
+			}
 		case "broadcast":
 			client.parse(rawMessage)
+		case "direct":
+			client.parseDirect(rawMessage)
+		case "close":
+			closeFrame := closeFrame{}
+			msgpack.Unmarshal(rawMessage, &closeFrame)
+			client.closed(closeFrame)
+			return
+		case "ihave", "graft", "prune":
+			if client.core.tree != nil && client.authorized {
+				client.core.tree.handle(client, msg.Type, rawMessage)
+			}
 		default:
-			log.Warning("unknown message type: " + msg.Type)
+			client.core.log.Warn("Unknown message type", "type", msg.Type, "host", client.toString())
 		}
 	}
 }
 
-func (client *client) decrypt(msg string, nonce string, theirKey string) ([]byte, bool) {
-	bMes, err := hex.DecodeString(msg)
-	if err != nil {
-		client.fail()
-	}
-
-	bNonce, err := hex.DecodeString(nonce)
-	if err != nil {
-		client.fail()
-	}
-
-	bTheirKey, err := hex.DecodeString(theirKey)
-
-	unsealed, success := box.Open(nil, bMes, nonceSliceConvert(bNonce), keySliceConvert(bTheirKey), &client.core.keys.sealKeys.Priv)
-	if !success {
-		log.Warning("Decryption failed from " + client.toString())
-		client.fail()
+// closed handles a close frame from the server. The reason is logged and
+// kept on the client, and counted against the peer's score if it shows the
+// peer is at fault.
+func (client *client) closed(frame closeFrame) {
+	client.closeCode = frame.Code
+	client.closeReason = frame.Reason
+	client.core.log.Warn("Peer closed the connection", "peer", client.peer.SignKey, "host", client.toString(), "code", frame.Code, "reason", frame.Reason)
+	if penalty := frame.Code.penalty(); penalty != 0 && !client.isSelfClient {
+		if client.core.db.adjustScore(client.peer.SignKey, penalty) {
+			client.core.log.Warn("Banned peer after it refused us", "peer", client.peer.SignKey, "host", client.toString(), "code", frame.Code)
+			client.core.events.emit(Event{Type: PeerBanned, Peer: client.peer.SignKey, Host: client.toString(), Code: frame.Code, Reason: frame.Reason})
+		}
 	}
-	return unsealed, success
+	client.fail()
 }
 
 func (client *client) fail() {
-	if client.conn != nil {
-		client.conn.Close()
+	if client.queue != nil {
+		client.queue.close()
+	}
+	if conn := client.connection(); conn != nil {
+		conn.Close()
+		if client.connecting && !client.isSelfClient {
+			client.core.handshake(false)
+		}
 	}
 	client.failed = true
 	client.connecting = false
 	client.authorized = false
+	client.core.linkDown(client)
 }
 
 func (client *client) parse(msg []byte) {
@@ -163,43 +238,133 @@ func (client *client) parse(msg []byte) {
 	broadcast := broadcast{}
 	msgpack.Unmarshal(msg, &broadcast)
 
-	unsealed, decrypted := client.decrypt(broadcast.Secret, broadcast.Nonce, client.serverInfo.PubSealKey)
-	if decrypted {
-		if !client.received.contains([]byte(broadcast.MessageID)) {
-			client.received.push([]byte(broadcast.MessageID))
-			log.Info(colors.boldMagenta+"CAST"+colors.reset, colors.boldYellow+"***"+colors.reset, broadcast.MessageID)
-			go client.emit(unsealed)
-			client.core.clientManager.propagate(unsealed, broadcast.MessageID)
-		} else {
-			if client.core.config.LogLevel > 1 {
-				log.Info(colors.boldMagenta+"CAST"+colors.reset, broadcast.MessageID)
-			}
+	theirKey, err := hex.DecodeString(client.serverInfo.PubSealKey)
+	if err != nil {
+		client.fail()
+		return
+	}
+
+	unsealed, err := client.core.openBroadcast(&broadcast, theirKey, &client.seq)
+	if err == errDecrypt {
+		client.core.log.Warn("Decryption failed", "peer", client.peer.SignKey, "host", client.toString(), "messageID", broadcast.MessageID)
+		client.core.dropped(client, broadcast, err.Error())
+		client.fail()
+		return
+	}
+	if err != nil {
+		client.core.log.Warn("Dropped broadcast", "peer", client.peer.SignKey, "messageID", broadcast.MessageID, "direction", "inbound", "err", err)
+		client.core.dropped(client, broadcast, err.Error())
+		return
+	}
+
+	if client.core.tree != nil {
+		if !client.isSelfClient {
+			client.core.tree.receive(client, unsealed, broadcast)
 		}
+		return
+	}
+	if !client.isSelfClient {
+		client.core.arrived(client, &broadcast)
+	}
+
+	if client.received.add(broadcast.MessageID) {
+		if !client.core.clientManager.originLimit.allow(broadcast.Origin) {
+			client.core.log.Warn("Origin exceeded its rate limit", "origin", broadcast.Origin, "messageID", broadcast.MessageID)
+			client.core.dropped(client, broadcast, "rate limited")
+			return
+		}
+		client.core.log.Info("CAST", "messageID", broadcast.MessageID, "origin", broadcast.Origin, "peer", client.peer.SignKey)
+		client.emit(unsealed, broadcast)
+		if relay, ok := client.core.relay(broadcast); ok {
+			client.core.clientManager.propagate(unsealed, relay)
+			client.core.relayed(relay)
+		}
+	} else {
+		client.core.dropped(client, broadcast, "duplicate")
+		if client.core.config.LogLevel > 1 {
+			client.core.log.Debug("CAST duplicate", "messageID", broadcast.MessageID, "peer", client.peer.SignKey)
+		}
+	}
+}
+
+func (client *client) parseDirect(msg []byte) {
+	direct := broadcast{}
+	if err := msgpack.Unmarshal(msg, &direct); err != nil {
+		client.core.log.Error("Could not decode direct frame", "host", client.toString(), "err", err)
+		return
+	}
+
+	theirKey, err := hex.DecodeString(client.serverInfo.PubSealKey)
+	if err != nil {
+		client.fail()
+		return
+	}
+
+	unsealed, err := client.core.openBroadcast(&direct, theirKey, &client.seq)
+	if err != nil {
+		client.core.log.Warn("Dropped direct frame", "peer", client.peer.SignKey, "messageID", direct.MessageID, "err", err)
+		client.core.dropped(client, direct, err.Error())
+		return
 	}
+	client.core.direct(client, unsealed, direct)
 }
 
-func (client *client) emit(data []byte) {
-	*client.core.messages <- data
+func (client *client) emit(data []byte, meta broadcast) {
+	client.core.accept(data, meta)
 }
 
 func (client *client) response(msg []byte) {
 	challenge := challenge{}
 	msgpack.Unmarshal(msg, &challenge)
 
-	signed := ed25519.Sign(client.core.keys.signKeys.Priv, []byte(challenge.Challenge))
+	if ok, reason := client.core.compatible(challenge.Version); !ok {
+		client.core.log.Warn("Disconnecting from incompatible peer", "host", client.toString(), "reason", reason)
+		closeWith(client, CloseIncompatible, reason)
+		client.fail()
+		return
+	}
+
+	if client.core.permissions != nil && !client.isSelfClient {
+		if ok, reason := client.core.verifyServer(client, challenge); !ok {
+			client.core.log.Warn("Disconnecting from peer that is not admitted", "peer", client.peer.SignKey, "host", client.toString(), "reason", reason)
+			closeWith(client, CloseNotAdmitted, reason)
+			client.fail()
+			return
+		}
+	}
+
+	if challenge.Difficulty > maxPuzzleDifficulty {
+		client.core.log.Warn("Disconnecting from peer with a puzzle too hard to solve", "host", client.toString(), "difficulty", challenge.Difficulty)
+		closeWith(client, CloseProtocolError, "puzzle too hard")
+		client.fail()
+		return
+	}
+
+	sealKey := hex.EncodeToString(sealToString(client.core.keys.sealKeys.Pub))
+	signed := ed25519.Sign(client.core.keys.signKeys.Priv, responseDigest(challenge.Challenge, sealKey, client.peer.SignKey))
+	client.codec = client.core.chooseCodec(challenge.Codecs)
+	client.version = challenge.Version
+	client.caps = client.core.negotiate(challenge.Capabilities)
 
 	response := response{
-		Type:      "response",
-		Signed:    hex.EncodeToString(signed),
-		SignKey:   hex.EncodeToString(client.core.keys.signKeys.Pub),
-		SealKey:   hex.EncodeToString(sealToString(client.core.keys.sealKeys.Pub)),
-		Port:      client.core.config.Port,
-		NetworkID: client.core.config.NetworkID,
+		Type:         "response",
+		Signed:       hex.EncodeToString(signed),
+		SignKey:      hex.EncodeToString(client.core.keys.signKeys.Pub),
+		SealKey:      sealKey,
+		Port:         client.core.config.Port,
+		NetworkID:    client.core.config.NetworkID,
+		Codec:        client.codec,
+		Version:      protocolVersion,
+		Capabilities: client.core.capabilities(),
+		Solution:     solvePuzzle(challenge.Challenge, challenge.Difficulty),
+	}
+	if client.core.config.Certificate.Signature != "" {
+		response.Certificate = &client.core.config.Certificate
 	}
 
 	bMes, err := msgpack.Marshal(response)
 	if err != nil {
-		log.Error(err)
+		client.core.log.Error("Could not encode response", "err", err)
 		client.fail()
 		return
 	}
@@ -207,22 +372,52 @@ func (client *client) response(msg []byte) {
 	client.send(bMes)
 }
 
+// cast seals a broadcast for the server and sends it with the next sequence
+// number.
+func (client *client) cast(msg []byte, meta broadcast) {
+	theirKey, err := hex.DecodeString(client.serverInfo.PubSealKey)
+	if err != nil {
+		client.core.log.Error("Invalid seal key", "host", client.toString(), "err", err)
+		return
+	}
+	client.seq.stamp(func(seq uint64) {
+		byteCast, err := client.core.sealBroadcast(msg, meta, seq, theirKey, client.codec)
+		if err != nil {
+			client.core.log.Error("Could not seal broadcast", "messageID", meta.MessageID, "err", err)
+			return
+		}
+		client.send(byteCast)
+	})
+}
+
+// send queues a frame for the server.
 func (client *client) send(msg []byte) {
+	if client.core.config.LogLevel > 1 {
+		client.core.log.Debug("SEND", "host", client.toString(), "direction", "outbound", "frame", msg)
+	}
+	client.queue.push(client.core.sealFrame(msg))
+}
+
+// sendNow writes a frame right away, ahead of the queued ones, for close
+// frames that must go out before the connection is closed.
+func (client *client) sendNow(msg []byte) {
 	client.mu.Lock()
 	defer client.mu.Unlock()
-	err := client.conn.WriteMessage(websocket.BinaryMessage, msg)
+	client.connection().WriteMessage(websocket.BinaryMessage, client.core.sealFrame(msg))
+}
+
+func (client *client) write(frame []byte) {
+	client.mu.Lock()
+	err := client.connection().WriteMessage(websocket.BinaryMessage, frame)
+	client.mu.Unlock()
 	if err != nil {
-		log.Error(err)
+		client.core.log.Error("Write failed", "host", client.toString(), "err", err)
 		client.fail()
-		return
-	}
-	if client.core.config.LogLevel > 1 {
-		log.Infof(colors.boldCyan+"SEND"+colors.reset+" %s", msg)
 	}
 }
 
 func (client *client) ping() {
 	pong := message{Type: "pong"}
 	bMes, _ := msgpack.Marshal(pong)
-	client.send(bMes)
+	client.queue.pushUrgent(client.core.sealFrame(bMes))
 }
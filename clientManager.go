@@ -3,14 +3,8 @@ package p2p
 import (
 	"encoding/hex"
 	"encoding/json"
-	"io/ioutil"
-	"net/http"
-	"net/url"
 	"sync"
 	"time"
-
-	"github.com/vmihailenco/msgpack"
-	"golang.org/x/crypto/nacl/box"
 )
 
 // clientManager handles active outgoing clients.
@@ -20,12 +14,15 @@ type clientManager struct {
 	clientMu       sync.Mutex
 	clients        []*client
 	selfClient     *client
-	clientReceived lockList
+	clientReceived *seenCache
+	originLimit    *rateLimiter
 	readMu         sync.Mutex
 }
 
 func (cm *clientManager) initialize(core *core) {
 	cm.core = core
+	cm.clientReceived = core.newSeenCache()
+	cm.originLimit = newRateLimiter(core.config.OriginRate, core.config.OriginBurst)
 	cm.initSelfClient()
 
 	go cm.takePeers()
@@ -37,19 +34,13 @@ func (cm *clientManager) initialize(core *core) {
 func (cm *clientManager) logging() {
 	for {
 		time.Sleep(1 * time.Minute)
-		log.Debug("║ Current OUT:")
-		for _, client := range cm.clients {
-			output := "║ " + client.toString()
-			if client.authorized {
-				output += " ✅  Ping: " + client.pingTime.String()
-			}
-			if client.failed {
-				output += " ❌"
-			}
-			if client.connecting {
-				output += " ⏳"
-			}
-			log.Debug(output)
+		cm.clientMu.Lock()
+		clients := append([]*client(nil), cm.clients...)
+		cm.clientMu.Unlock()
+		cm.core.log.Debug("Current outbound clients", "count", len(clients))
+		for _, client := range clients {
+			cm.core.log.Debug("Outbound client", "peer", client.peer.SignKey, "host", client.toString(),
+				"authorized", client.authorized, "connecting", client.connecting, "failed", client.failed, "ping", client.pingTime)
 		}
 	}
 }
@@ -62,100 +53,113 @@ func (cm *clientManager) initSelfClient() {
 		SealKey: hex.EncodeToString(cm.core.keys.sealKeys.Pub[:]),
 	}
 	selfClient := client{}
-	selfClient.initialize(cm.core, &selfPeer, &cm.clientReceived, &cm.readMu, true)
+	selfClient.initialize(cm.core, &selfPeer, cm.clientReceived, &cm.readMu, true)
 	cm.selfClient = &selfClient
 }
 
-func (cm *clientManager) propagate(msg []byte, messageID string) {
-	for _, consumer := range append(cm.clients, cm.selfClient) {
-		if consumer.conn == nil {
+func (cm *clientManager) propagate(msg []byte, meta broadcast) {
+	cm.clientMu.Lock()
+	consumers := append(append([]*client(nil), cm.clients...), cm.selfClient)
+	cm.clientMu.Unlock()
+	for _, consumer := range consumers {
+		// nothing is connected until initialize runs
+		if consumer == nil || consumer.connection() == nil {
 			continue
 		}
-		byteKey, err := hex.DecodeString(consumer.serverInfo.PubSealKey)
-		if err != nil {
-			log.Error(err)
-			return
-		}
-		nonce := makeNonce()
-		secret := box.Seal(nil, msg, nonce.bytes, keySliceConvert(byteKey), &cm.core.keys.sealKeys.Priv)
-		broadcast := broadcast{
-			Type:      "broadcast",
-			Secret:    hex.EncodeToString(secret),
-			Nonce:     nonce.str,
-			MessageID: messageID,
-		}
-		byteCast, err := msgpack.Marshal(broadcast)
-		if err != nil {
-			log.Error(err)
-		} else {
-			consumer.send(byteCast)
-		}
+		consumer.cast(msg, meta)
 	}
 }
 
 func (cm *clientManager) findPeers() {
 	for {
-		peerList := cm.core.db.getPeerList()
-		for _, peer := range peerList {
-
-			httpClient := http.Client{
-				Timeout: 1 * time.Second,
-			}
-			peerURL := url.URL{Scheme: "http", Host: peer.toString(false), Path: "/peers"}
+		cm.discover()
+		time.Sleep(3 * time.Minute)
+	}
+}
 
-			res, err := httpClient.Get(peerURL.String())
-			if err != nil {
-				continue
-			}
+// discover asks every known peer for its peer list and adds the peers we
+// did not know about yet.
+func (cm *clientManager) discover() {
+	peerList := cm.core.db.getPeerList()
+	for _, peer := range peerList {
 
-			peerBody, err := ioutil.ReadAll(res.Body)
-			if err != nil {
-				continue
-			}
+		peerBody, err := cm.core.get(peer.toString(false), "/peers", 1*time.Second)
+		if err != nil {
+			continue
+		}
 
-			newList := []Peer{}
-			json.Unmarshal(peerBody, &newList)
-
-			for _, newPeer := range newList {
-				checkPeer := Peer{}
-				cm.core.db.db.Find(&checkPeer, "sign_key = ?", newPeer.SignKey)
-				if checkPeer == (Peer{}) {
-					if newPeer.online() {
-						cm.core.db.db.Create(&newPeer)
-						log.Debug("Discovered peer: " + newPeer.toString(false))
-					}
+		newList := []Peer{}
+		json.Unmarshal(peerBody, &newList)
+
+		for _, newPeer := range newList {
+			checkPeer := Peer{}
+			cm.core.db.db.Find(&checkPeer, "sign_key = ?", newPeer.SignKey)
+			if checkPeer == (Peer{}) {
+				if newPeer.online() {
+					cm.core.db.db.Create(&newPeer)
+					cm.core.log.Debug("Discovered peer", "peer", newPeer.SignKey, "host", newPeer.toString(false))
+					cm.core.events.emit(Event{Type: PeerDiscovered, Peer: newPeer.SignKey, Host: newPeer.toString(false)})
 				}
 			}
 		}
-		time.Sleep(3 * time.Minute)
 	}
-
 }
 
 func (cm *clientManager) takePeers() {
 	for {
 		if len(cm.clients) < 8 {
 			peer := Peer{}
-			cm.core.db.db.Raw("SELECT * FROM peers ORDER BY RANDOM() LIMIT 1;").Scan(&peer)
+			cm.core.db.db.Raw("SELECT * FROM peers WHERE score > ? ORDER BY RANDOM() LIMIT 1;", banScore).Scan(&peer)
 			if !cm.inClientList(peer) {
-				c := client{}
-				go c.initialize(cm.core, &peer, &cm.clientReceived, &cm.readMu, false)
-				cm.addToCoClientList(&c)
+				cm.connect(peer)
 			}
 		}
 		time.Sleep(5 * time.Second)
 	}
 }
 
+// connect dials a peer. The peer's sign key may be left empty, in which case
+// it is taken from the peer's info endpoint.
+func (cm *clientManager) connect(peer Peer) {
+	c := client{}
+	go c.initialize(cm.core, &peer, cm.clientReceived, &cm.readMu, false)
+	cm.addToCoClientList(&c)
+}
+
+// disconnect closes our outbound connections to a peer.
+func (cm *clientManager) disconnect(signKey string, code CloseCode, reason string) int {
+	cm.clientMu.Lock()
+	defer cm.clientMu.Unlock()
+	count := 0
+	for _, c := range cm.clients {
+		if c.peer.SignKey == signKey && c.connection() != nil && !c.failed {
+			closeWith(c, code, reason)
+			c.closeCode = code
+			c.closeReason = reason
+			c.fail()
+			count++
+		}
+	}
+	return count
+}
+
 func (cm *clientManager) pruneList() {
 	for {
 		cm.clientMu.Lock()
-		for i, c := range cm.clients {
-			if c.failed {
-				cm.clients = append(cm.clients[:i], cm.clients[i+1:]...)
-				break
+		alive := cm.clients[:0]
+		for _, c := range cm.clients {
+			if !c.failed {
+				alive = append(alive, c)
+				continue
+			}
+			if c.connection() != nil {
+				e := linkEvent(PeerDisconnected, c)
+				e.Code = c.closeCode
+				e.Reason = c.closeReason
+				cm.core.events.emit(e)
 			}
 		}
+		cm.clients = alive
 		cm.clientMu.Unlock()
 		time.Sleep(5 * time.Second)
 	}
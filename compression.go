@@ -0,0 +1,95 @@
+package p2p
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+const codecDeflate = "deflate"
+
+var errCodec = errors.New("unsupported or corrupt compression")
+
+// CompressionStats counts the payload bytes of frames we compressed, before
+// and after compression.
+type CompressionStats struct {
+	Uncompressed uint64
+	Compressed   uint64
+}
+
+// codecs lists the compression codecs we offer in the handshake, in order
+// of preference.
+func (c *core) codecs() []string {
+	if c.config.DisableCompression {
+		return []string{}
+	}
+	return []string{codecDeflate}
+}
+
+// chooseCodec picks the first codec offered by the server that we support.
+func (c *core) chooseCodec(offered []string) string {
+	for _, codec := range offered {
+		for _, ours := range c.codecs() {
+			if codec == ours {
+				return codec
+			}
+		}
+	}
+	return ""
+}
+
+// compress compresses msg with codec if it is large enough to be worth it.
+// It returns the data to seal and the codec that was actually applied.
+func (c *core) compress(msg []byte, codec string) ([]byte, string) {
+	if codec != codecDeflate || len(msg) < c.config.CompressThreshold {
+		return msg, ""
+	}
+
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		c.log.Error("Could not compress message", "codec", codec, "err", err)
+		return msg, ""
+	}
+	w.Write(msg)
+	if err := w.Close(); err != nil {
+		c.log.Error("Could not compress message", "codec", codec, "err", err)
+		return msg, ""
+	}
+	if buf.Len() >= len(msg) {
+		return msg, ""
+	}
+
+	atomic.AddUint64(&c.compression.Uncompressed, uint64(len(msg)))
+	atomic.AddUint64(&c.compression.Compressed, uint64(buf.Len()))
+	return buf.Bytes(), codec
+}
+
+// decompress reverses compress, refusing to inflate past limit bytes.
+func decompress(data []byte, codec string, limit int64) ([]byte, error) {
+	switch codec {
+	case "":
+		return data, nil
+	case codecDeflate:
+		r := flate.NewReader(bytes.NewReader(data))
+		defer r.Close()
+		out, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+		if err != nil || int64(len(out)) > limit {
+			return nil, errCodec
+		}
+		return out, nil
+	default:
+		return nil, errCodec
+	}
+}
+
+// CompressionStats returns the compression counters of this node.
+func (d *DP2P) CompressionStats() CompressionStats {
+	return CompressionStats{
+		Uncompressed: atomic.LoadUint64(&d.core.compression.Uncompressed),
+		Compressed:   atomic.LoadUint64(&d.core.compression.Compressed),
+	}
+}
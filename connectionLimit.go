@@ -0,0 +1,93 @@
+package p2p
+
+import (
+	"crypto/sha256"
+	"math/bits"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// admit decides whether to accept an inbound connection before it is
+// upgraded to a websocket, so that the connections we refuse cost us as
+// little as possible. It returns the HTTP status to refuse it with, or zero.
+// Connections are counted by the address they come from, not the one a
+// proxy claims to forward for, which anybody can set.
+func (a *api) admit(req *http.Request) (int, string) {
+	if max := a.core.config.MaxInbound; max > 0 && a.inbound() >= max {
+		return http.StatusServiceUnavailable, "too many connections"
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	if !a.connectionLimit.allow(host) {
+		return http.StatusTooManyRequests, "too many connections from " + host
+	}
+	return 0, ""
+}
+
+// refuse turns an inbound connection away before the upgrade. A flood of
+// connections is refused as fast as it comes in, so each one is only logged
+// at debug level, and counted in connectionsRefused.
+func (a *api) refuse(res http.ResponseWriter, req *http.Request, status int, reason string) {
+	a.core.log.Debug("Refused inbound connection", "remote", GetIP(req), "reason", reason)
+	atomic.AddUint64(&a.core.counters.connectionsRefused, 1)
+	http.Error(res, http.StatusText(status), status)
+}
+
+// inbound counts our inbound connections, authenticated or not.
+func (a *api) inbound() int {
+	a.acMu.Lock()
+	defer a.acMu.Unlock()
+	return len(a.ac)
+}
+
+// difficulty is the number of leading zero bits we ask a new connection's
+// puzzle solution to have. It grows from PuzzleDifficulty with no inbound
+// connections to PuzzleMaxDifficulty at MaxInbound.
+func (a *api) difficulty() int {
+	config := a.core.config
+	if config.PuzzleDifficulty <= 0 {
+		return 0
+	}
+	max := config.MaxInbound
+	if max <= 0 {
+		max = defaultMaxInbound
+	}
+	load := a.inbound()
+	if load > max {
+		load = max
+	}
+	return config.PuzzleDifficulty + (config.PuzzleMaxDifficulty-config.PuzzleDifficulty)*load/max
+}
+
+// solvePuzzle finds a solution with the given number of leading zero bits
+// for a challenge. It takes about 2^difficulty hashes.
+func solvePuzzle(challenge string, difficulty int) uint64 {
+	var solution uint64
+	for !puzzleSolved(challenge, difficulty, solution) {
+		solution++
+	}
+	return solution
+}
+
+// puzzleSolved checks a puzzle solution. Every puzzle is tied to the
+// challenge of a single connection, so solutions cannot be computed ahead
+// of time or reused.
+func puzzleSolved(challenge string, difficulty int, solution uint64) bool {
+	if difficulty <= 0 {
+		return true
+	}
+	hash := sha256.Sum256([]byte("puzzle\x00" + challenge + "\x00" + strconv.FormatUint(solution, 10)))
+	zeros := 0
+	for _, b := range hash {
+		if b != 0 {
+			zeros += bits.LeadingZeros8(b)
+			break
+		}
+		zeros += 8
+	}
+	return zeros >= difficulty
+}
@@ -2,11 +2,83 @@ package p2p
 
 import (
 	"os"
-
-	"github.com/op/go-logging"
+	"time"
 )
 
 var progName string = "ExtraP2P"
 var version string = "v0.2.1"
-var log *logging.Logger = logging.MustGetLogger(progName)
 var homedir, _ = os.UserHomeDir()
+
+const (
+	defaultClockSkew           = 1 * time.Minute
+	defaultSeenCacheSize       = 100000
+	defaultSeenCacheTTL        = 5 * time.Minute
+	defaultTTL                 = 16
+	defaultMaxTTL              = 64
+	defaultOriginRate          = 100
+	defaultOriginBurst         = 200
+	defaultChunkSize           = 64 * 1024
+	defaultMaxFrameSize        = 1024 * 1024
+	defaultMaxStreamSize       = 16 * 1024 * 1024
+	defaultMaxStreams          = 16
+	defaultMaxStreamsPerOrigin = 4
+	defaultStreamTimeout       = 30 * time.Second
+	socketBufferSize           = 32 * 1024
+	networkKeyHeader           = "X-Network-Key"
+	defaultMaxInbound          = 256
+	defaultConnectionRate      = 2
+	defaultConnectionBurst     = 16
+	defaultAuthTimeout         = 3 * time.Second
+	defaultPuzzleSpread        = 6
+	maxPuzzleDifficulty        = 24
+	defaultSendQueueSize       = 16 * 1024 * 1024
+	defaultCompressThreshold   = 512
+	eventQueueSize             = 1024
+	metricsPrefix              = "extrap2p"
+	banScore                   = -100
+	maxScore                   = 10
+	treeCacheSize              = 4096
+	treeGraftTimeout           = 1 * time.Second
+	treeLazyInterval           = 200 * time.Millisecond
+	treeAnnounceSize           = 512
+	treeMissingSize            = 4096
+	traceCacheSize             = 1024
+	replyRouteSize             = 16384
+	reliableRetries            = 3
+	defaultHistoryMaxMessages  = 10000
+	defaultHistoryMaxBytes     = 64 * 1024 * 1024
+	defaultHistoryMaxAge       = 24 * time.Hour
+	historyPruneInterval       = 1 * time.Minute
+	syncBucketWidth            = 10 * time.Minute
+	syncBatchSize              = 1024
+	defaultCausalTimeout       = 10 * time.Second
+	causalBufferSize           = 4096
+	raftTick                   = 50 * time.Millisecond
+	raftHeartbeat              = 250 * time.Millisecond
+	raftElectionTimeout        = 1500 * time.Millisecond
+	raftBatchSize              = 64
+	raftLogRetain              = 4096
+	orderedRetryInterval       = 2 * time.Second
+	orderedPendingTTL          = 30 * time.Second
+	orderedGapTimeout          = 10 * time.Second
+	orderedReplaySize          = 64
+	orderedLinkInterval        = 5 * time.Second
+	defaultBlobMaxBytes        = 1024 * 1024 * 1024
+	blobChunkSize              = 32 * 1024
+	blobParallel               = 8
+	blobChunkRetries           = 2
+	blobRequestTimeout         = 5 * time.Second
+	blobFindTimeout            = 10 * time.Second
+	blobHolderTTL              = 24 * time.Hour
+	blobGCInterval             = 1 * time.Minute
+	blobServePeer              = 2 * blobParallel
+	blobServeTotal             = 64
+	defaultProbeInterval       = 1 * time.Second
+	defaultProbeTimeout        = 500 * time.Millisecond
+	defaultIndirectProbes      = 3
+	defaultSuspicionMult       = 4
+	memberRetransmitMult       = 4
+	memberPiggyback            = 8
+	memberTombstoneTTL         = 5 * time.Minute
+	memberIncarnationGap       = 24 * 60 * 60
+)
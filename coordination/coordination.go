@@ -0,0 +1,281 @@
+// Package coordination offers leader elections and locks among the nodes of
+// a p2p network.
+//
+// Both are leases: the node that wins an election or takes a lock keeps it
+// for as long as it renews it, and loses it a TTL after it stops, when it
+// fails or is cut off. Every lease carries a fencing token that grows with
+// each new holder of the same election or lock, so that the resources it
+// guards can turn away a holder that lost it without knowing yet.
+//
+// When the network has Voters, claims are put in order by them, and every
+// node agrees on who holds what. This is safe under partitions, since only
+// the side with a majority of the voters can grant anything. Without
+// voters, claims are broadcast and each node picks the oldest one, which is
+// best effort: both sides of a partition grant the same lock, and a node
+// may be granted one before hearing about an older claim.
+//
+// Usage:
+//
+//	node := p2p.DP2P{}
+//	go node.Initialize(config)
+//	c := coordination.Open(&node, coordination.Config{})
+//	lease, err := c.Campaign(ctx, "scheduler")
+//	// lead until <-lease.Done(), passing lease.Token() along
+package coordination
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ExtraHash/p2p"
+	"github.com/vmihailenco/msgpack"
+)
+
+const (
+	defaultChannel = "coordination"
+	defaultTTL     = 10 * time.Second
+	checkInterval  = 250 * time.Millisecond
+)
+
+// Config is the configuration of a Coordinator.
+type Config struct {
+	// Channel is the p2p channel claims are sent on. Nodes only coordinate
+	// with the ones on the same channel. Defaults to "coordination".
+	Channel string
+	// TTL is how long a lease outlives its last renewal. Holders renew
+	// three times per TTL. Defaults to 10 seconds.
+	TTL time.Duration
+	// Logger defaults to p2p.SlogLogger(nil).
+	Logger p2p.Logger
+}
+
+// command is what coordinators send each other on their channel. A claim
+// creates or renews a claim on a key, and a release drops it.
+type command struct {
+	Type string `msgpack:"type"`
+	Key  string `msgpack:"key"`
+	ID   string `msgpack:"id"`
+	// Rank is the position of the claim, which is its log position when
+	// claims are ordered, and the time it was made otherwise. It is left
+	// out of the first claim when ordered, since nobody knows it yet.
+	Rank uint64 `msgpack:"rank,omitempty"`
+	// TTL is the lease's TTL in milliseconds.
+	TTL int64 `msgpack:"ttl,omitempty"`
+}
+
+// Coordinator runs elections and locks over a node.
+//
+// Every coordinator keeps the queue of claims on each key. A claim joins
+// the queue when it is first seen, and drops out when it is released or
+// when it was not renewed within its TTL. The first claim in the queue
+// holds the key. With voters, claims are applied in the order they agreed
+// on, with the time of the latest claim as the clock, so every node's
+// queues are the same. Without voters, claims are ranked by the time they
+// were made, and a claim only holds a key after being first for half a TTL.
+type Coordinator struct {
+	node    *p2p.DP2P
+	channel *p2p.Channel
+	self    string
+	ordered bool
+	ttl     time.Duration
+	log     p2p.Logger
+	opened  time.Time
+
+	mu sync.Mutex
+	// heard is when we first heard from another coordinator. Every live
+	// claim is renewed within a third of a TTL, so we know them all half a
+	// TTL later, and may grant leases.
+	heard     time.Time
+	queues    map[string]*queue
+	clock     time.Time
+	leases    map[string]*Lease
+	campaigns map[string]*Lease
+}
+
+// Open starts coordinating over node, and blocks until node is initialized.
+func Open(node *p2p.DP2P, config Config) *Coordinator {
+	if config.Channel == "" {
+		config.Channel = defaultChannel
+	}
+	if config.TTL == 0 {
+		config.TTL = defaultTTL
+	}
+	if config.Logger == nil {
+		config.Logger = p2p.SlogLogger(nil)
+	}
+	c := &Coordinator{
+		node:      node,
+		channel:   node.Channel(config.Channel),
+		self:      node.SignKey(),
+		ordered:   len(node.Voters()) > 0,
+		ttl:       config.TTL,
+		log:       config.Logger,
+		opened:    time.Now(),
+		queues:    make(map[string]*queue),
+		leases:    make(map[string]*Lease),
+		campaigns: make(map[string]*Lease),
+	}
+	go c.listen()
+	go c.checkLoop()
+	return c
+}
+
+// listen applies the claims coordinators send on the channel.
+func (c *Coordinator) listen() {
+	for {
+		var m p2p.Message
+		if c.ordered {
+			m = c.channel.ReceiveOrdered()
+		} else {
+			m = c.channel.Receive()
+		}
+		cmd := command{}
+		if err := msgpack.Unmarshal(m.Data, &cmd); err != nil {
+			c.log.Warn("Could not decode coordination command", "origin", m.Origin, "err", err)
+			continue
+		}
+		c.mu.Lock()
+		now := time.Now()
+		if c.heard.IsZero() && m.Origin != c.self {
+			c.heard = now
+		}
+		if c.ordered {
+			if m.Time.After(c.clock) {
+				c.clock = m.Time
+			}
+			now = c.clock
+		}
+		c.apply(m, cmd, now)
+		lost := c.check()
+		c.mu.Unlock()
+		c.releaseAll(lost)
+	}
+}
+
+// apply applies a command to the queue of its key.
+func (c *Coordinator) apply(m p2p.Message, cmd command, now time.Time) {
+	q, ok := c.queues[cmd.Key]
+	if !ok {
+		q = &queue{}
+		c.queues[cmd.Key] = q
+	}
+	q.prune(now)
+
+	switch cmd.Type {
+	case "claim":
+		if cmd.TTL <= 0 {
+			break
+		}
+		expires := now.Add(time.Duration(cmd.TTL) * time.Millisecond)
+		existing := q.find(cmd.ID)
+		if existing != nil && existing.node != m.Origin {
+			c.log.Warn("Dropped claim renewed by another node", "key", cmd.Key, "origin", m.Origin)
+			break
+		}
+		if existing != nil {
+			existing.expires = expires
+		} else {
+			rank := cmd.Rank
+			// until we know every live claim, a claim we did not know may
+			// be older than the holder we saw
+			if rank == 0 || (c.ready() && rank < q.fence) {
+				rank = c.position(m, now)
+			}
+			existing = &claim{id: cmd.ID, node: m.Origin, rank: rank, expires: expires}
+			q.insert(existing)
+		}
+		if l, ok := c.leases[cmd.ID]; ok && m.Origin == c.self {
+			l.rank = existing.rank
+			if m.Time.After(l.confirmed) {
+				l.confirmed = m.Time
+			}
+		}
+	case "release":
+		if existing := q.find(cmd.ID); existing != nil && existing.node == m.Origin {
+			q.remove(cmd.ID)
+		}
+	default:
+		c.log.Warn("Unsupported coordination command", "type", cmd.Type, "origin", m.Origin)
+	}
+
+	q.update(time.Now())
+	if len(q.claims) == 0 {
+		delete(c.queues, cmd.Key)
+	}
+}
+
+// ready reports whether we know every live claim. A coordinator that hears
+// nobody for two TTLs is taken to be alone.
+func (c *Coordinator) ready() bool {
+	if c.heard.IsZero() {
+		return time.Since(c.opened) > 2*c.ttl
+	}
+	return time.Since(c.heard) > c.ttl/2
+}
+
+// position ranks a new claim behind every claim before it.
+func (c *Coordinator) position(m p2p.Message, now time.Time) uint64 {
+	if c.ordered {
+		return m.Seq
+	}
+	return uint64(now.UnixNano())
+}
+
+// check grants our leases that got to the front of their queue, and ends
+// the ones that lost it or could not be renewed in time. It returns the
+// leases that were lost.
+func (c *Coordinator) check() []*Lease {
+	lost := []*Lease{}
+	for _, l := range c.leases {
+		q := c.queues[l.key]
+		first := q != nil && q.holder == l.id
+		if !l.held {
+			if first && c.ready() && (c.ordered || time.Since(q.front) >= c.ttl/2) {
+				l.held = true
+				l.token = l.rank
+				close(l.granted)
+				c.log.Info("Lease granted", "key", l.key, "token", l.token)
+			}
+			continue
+		}
+		if !first || time.Since(l.confirmed) > c.ttl {
+			c.log.Warn("Lease lost", "key", l.key, "token", l.token)
+			c.end(l)
+			lost = append(lost, l)
+		}
+	}
+	return lost
+}
+
+func (c *Coordinator) checkLoop() {
+	for range time.Tick(checkInterval) {
+		c.mu.Lock()
+		lost := c.check()
+		c.mu.Unlock()
+		c.releaseAll(lost)
+	}
+}
+
+// releaseAll releases lost leases, so that nobody waits for them to
+// expire.
+func (c *Coordinator) releaseAll(leases []*Lease) {
+	for _, l := range leases {
+		c.send(command{Type: "release", Key: l.key, ID: l.id})
+	}
+}
+
+func (c *Coordinator) send(cmd command) error {
+	data, err := msgpack.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	if c.ordered {
+		_, err = c.channel.OrderedBroadcast(data)
+	} else {
+		_, err = c.channel.Broadcast(data)
+	}
+	if err != nil {
+		c.log.Debug("Could not send coordination command", "type", cmd.Type, "key", cmd.Key, "err", err)
+	}
+	return err
+}
@@ -0,0 +1,184 @@
+package coordination
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+var (
+	errCampaigning    = errors.New("already campaigning in this election")
+	errNotCampaigning = errors.New("not campaigning in this election")
+	errEnded          = errors.New("lease ended before it was granted")
+)
+
+// Lease is an election won or a lock taken. It is renewed in the
+// background until it is released or lost.
+type Lease struct {
+	c    *Coordinator
+	name string
+	key  string
+	id   string
+
+	// the fields below are guarded by the coordinator's lock
+	rank      uint64
+	token     uint64
+	confirmed time.Time
+	held      bool
+	ended     bool
+	granted   chan struct{}
+	done      chan struct{}
+}
+
+// Name returns the name of the election or lock.
+func (l *Lease) Name() string {
+	return l.name
+}
+
+// Token returns the lease's fencing token. Successive holders of the same
+// election or lock get growing tokens, so a resource that remembers the
+// highest token it saw can refuse requests from earlier holders.
+func (l *Lease) Token() uint64 {
+	l.c.mu.Lock()
+	defer l.c.mu.Unlock()
+	return l.token
+}
+
+// Done is closed when the lease is released, or lost because it could not
+// be renewed in time.
+func (l *Lease) Done() <-chan struct{} {
+	return l.done
+}
+
+// Release gives the lease up, so that the next claim can be granted
+// without waiting for it to expire.
+func (l *Lease) Release() error {
+	l.c.mu.Lock()
+	ended := l.ended
+	l.c.end(l)
+	l.c.mu.Unlock()
+	if ended {
+		return nil
+	}
+	return l.c.send(command{Type: "release", Key: l.key, ID: l.id})
+}
+
+// Campaign runs for leader of the named election, and returns the lease
+// once we win, or an error when ctx is done first or we resign.
+func (c *Coordinator) Campaign(ctx context.Context, name string) (*Lease, error) {
+	c.mu.Lock()
+	if _, ok := c.campaigns[name]; ok {
+		c.mu.Unlock()
+		return nil, errCampaigning
+	}
+	l := c.newLease(name, "election/"+name)
+	c.campaigns[name] = l
+	c.mu.Unlock()
+	return c.acquire(ctx, l)
+}
+
+// Leader returns the hex sign key of the leader of the named election, and
+// whether it has one.
+func (c *Coordinator) Leader(name string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	q, ok := c.queues["election/"+name]
+	if !ok || len(q.claims) == 0 || !q.claims[0].expires.After(time.Now()) {
+		return "", false
+	}
+	return q.claims[0].node, true
+}
+
+// Resign steps down as leader of the named election, or stops campaigning
+// in it.
+func (c *Coordinator) Resign(name string) error {
+	c.mu.Lock()
+	l, ok := c.campaigns[name]
+	c.mu.Unlock()
+	if !ok {
+		return errNotCampaigning
+	}
+	return l.Release()
+}
+
+// Lock takes the named lock, waiting for it until ctx is done. Release the
+// lease to unlock it.
+func (c *Coordinator) Lock(ctx context.Context, name string) (*Lease, error) {
+	c.mu.Lock()
+	l := c.newLease(name, "lock/"+name)
+	c.mu.Unlock()
+	return c.acquire(ctx, l)
+}
+
+func (c *Coordinator) newLease(name, key string) *Lease {
+	l := &Lease{
+		c:       c,
+		name:    name,
+		key:     key,
+		id:      uuid.NewV4().String(),
+		granted: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if !c.ordered {
+		l.rank = uint64(time.Now().UnixNano())
+	}
+	c.leases[l.id] = l
+	return l
+}
+
+// acquire claims a lease's key, and waits until it is granted.
+func (c *Coordinator) acquire(ctx context.Context, l *Lease) (*Lease, error) {
+	if err := l.renew(); err != nil {
+		c.mu.Lock()
+		c.end(l)
+		c.mu.Unlock()
+		return nil, err
+	}
+	go l.keepAlive()
+
+	select {
+	case <-l.granted:
+		return l, nil
+	case <-l.done:
+		return nil, errEnded
+	case <-ctx.Done():
+		l.Release()
+		return nil, ctx.Err()
+	}
+}
+
+func (l *Lease) renew() error {
+	l.c.mu.Lock()
+	cmd := command{Type: "claim", Key: l.key, ID: l.id, Rank: l.rank, TTL: int64(l.c.ttl / time.Millisecond)}
+	l.c.mu.Unlock()
+	return l.c.send(cmd)
+}
+
+func (l *Lease) keepAlive() {
+	ticker := time.NewTicker(l.c.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.renew()
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// end forgets a lease and closes its done channel. The caller holds the
+// lock.
+func (c *Coordinator) end(l *Lease) {
+	if l.ended {
+		return
+	}
+	l.ended = true
+	delete(c.leases, l.id)
+	if c.campaigns[l.name] == l {
+		delete(c.campaigns, l.name)
+	}
+	close(l.done)
+}
@@ -0,0 +1,82 @@
+package coordination
+
+import (
+	"sort"
+	"time"
+)
+
+// claim is a node's claim on a key.
+type claim struct {
+	id      string
+	node    string
+	rank    uint64
+	expires time.Time
+}
+
+// queue holds the claims on one key, in rank order. The first claim holds
+// the key.
+type queue struct {
+	claims []*claim
+	// fence is the highest rank that held the key. A claim renewed after
+	// it expired may not go back ahead of it, so that tokens only grow.
+	fence uint64
+	// holder is the claim that holds the key, and front when it got to the
+	// front of the queue, as seen here.
+	holder string
+	front  time.Time
+}
+
+func (q *queue) find(id string) *claim {
+	for _, c := range q.claims {
+		if c.id == id {
+			return c
+		}
+	}
+	return nil
+}
+
+func (q *queue) insert(c *claim) {
+	q.claims = append(q.claims, c)
+	sort.Slice(q.claims, func(i, j int) bool {
+		if q.claims[i].rank != q.claims[j].rank {
+			return q.claims[i].rank < q.claims[j].rank
+		}
+		return q.claims[i].id < q.claims[j].id
+	})
+}
+
+func (q *queue) remove(id string) {
+	for i, c := range q.claims {
+		if c.id == id {
+			q.claims = append(q.claims[:i], q.claims[i+1:]...)
+			return
+		}
+	}
+}
+
+// prune drops the claims that expired by now.
+func (q *queue) prune(now time.Time) {
+	live := q.claims[:0]
+	for _, c := range q.claims {
+		if c.expires.After(now) {
+			live = append(live, c)
+		}
+	}
+	q.claims = live
+}
+
+// update notes a change of holder.
+func (q *queue) update(now time.Time) {
+	if len(q.claims) == 0 {
+		q.holder = ""
+		return
+	}
+	first := q.claims[0]
+	if first.id != q.holder {
+		q.holder = first.id
+		q.front = now
+	}
+	if first.rank > q.fence {
+		q.fence = first.rank
+	}
+}
@@ -10,10 +10,12 @@ import (
 type db struct {
 	db     *gorm.DB
 	config NetworkConfig
+	log    Logger
 }
 
 func (d *db) initialize(config NetworkConfig) {
 	d.config = config
+	d.log = config.Logger
 	// initialize database, support sqlite and mysql
 	homedir, err := os.UserHomeDir()
 	check(err)
@@ -35,7 +37,7 @@ func (d *db) initialize(config NetworkConfig) {
 	}
 
 	d.db = db
-	log.Info(colors.boldWhite+"DATA"+colors.reset, "Database ready.")
+	d.log.Info("Database ready.", "component", "db")
 }
 
 func (d *db) getPeerList() []Peer {
@@ -53,3 +55,37 @@ func (d *db) getPeer(ip string) Peer {
 	d.db.Where("host = ?", ip).Find(&peer)
 	return peer
 }
+
+// adjustScore changes the reputation of a peer, keeping it at or below
+// maxScore. Returns true if this change got the peer banned.
+func (d *db) adjustScore(signKey string, delta int) bool {
+	peer := Peer{}
+	d.db.Where("sign_key = ?", signKey).Find(&peer)
+	if peer == (Peer{}) {
+		return false
+	}
+	score := peer.Score + delta
+	if score > maxScore {
+		score = maxScore
+	}
+	d.db.Model(&Peer{}).Where("sign_key = ?", signKey).Update("score", score)
+	return peer.Score > banScore && score <= banScore
+}
+
+// banned reports whether a peer's score has dropped to the ban threshold.
+func (d *db) banned(signKey string) bool {
+	peer := Peer{}
+	d.db.Where("sign_key = ?", signKey).Find(&peer)
+	return peer != (Peer{}) && peer.Score <= banScore
+}
+
+// ban drops a peer's score to the ban threshold. A peer we never dialed,
+// such as one that only connected to us, is added to the table without an
+// address, so that it stays banned. Returns false if nothing was banned.
+func (d *db) ban(signKey string) bool {
+	result := d.db.Model(&Peer{}).Where("sign_key = ?", signKey).Update("score", banScore)
+	if result.Error == nil && result.RowsAffected > 0 {
+		return true
+	}
+	return d.db.Create(&Peer{SignKey: signKey, Score: banScore}).RowsAffected > 0
+}
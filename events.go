@@ -0,0 +1,193 @@
+package p2p
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventType identifies what an Event is about.
+type EventType int
+
+// The events fired by a node.
+const (
+	// PeerConnected fires when a websocket to or from a peer is opened.
+	PeerConnected EventType = iota
+	// PeerAuthenticated fires when a peer completes the handshake.
+	PeerAuthenticated
+	// PeerDisconnected fires when a connection is closed. Code and Reason
+	// are set when a close frame was exchanged.
+	PeerDisconnected
+	// PeerDiscovered fires when a new peer is added to the peer table.
+	PeerDiscovered
+	// PeerBanned fires when a peer's score drops low enough that we stop
+	// dialing it.
+	PeerBanned
+	// MessageReceived fires when a new broadcast reaches this node.
+	MessageReceived
+	// MessageRelayed fires when a broadcast is forwarded to other peers.
+	MessageRelayed
+	// MessageDropped fires when a frame is discarded, with the reason.
+	MessageDropped
+	// MessageTraced fires when a broadcast sent with WithTrace reaches this
+	// node from a peer, including duplicate copies.
+	MessageTraced
+	// MemberJoined fires when a node joins the membership, or rejoins it
+	// after failing or leaving.
+	MemberJoined
+	// MemberLeft fires when a member announces that it left.
+	MemberLeft
+	// MemberFailed fires when a suspected member did not refute the
+	// suspicion in time.
+	MemberFailed
+)
+
+func (t EventType) String() string {
+	switch t {
+	case PeerConnected:
+		return "peer connected"
+	case PeerAuthenticated:
+		return "peer authenticated"
+	case PeerDisconnected:
+		return "peer disconnected"
+	case PeerDiscovered:
+		return "peer discovered"
+	case PeerBanned:
+		return "peer banned"
+	case MessageReceived:
+		return "message received"
+	case MessageRelayed:
+		return "message relayed"
+	case MessageDropped:
+		return "message dropped"
+	case MessageTraced:
+		return "message traced"
+	case MemberJoined:
+		return "member joined"
+	case MemberLeft:
+		return "member left"
+	case MemberFailed:
+		return "member failed"
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes something that happened on the network. Fields that do
+// not apply to the event type are left empty.
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	// Peer is the hex sign key of the peer involved, Host its address, and
+	// Direction is "inbound" or "outbound" for connection events.
+	Peer      string
+	Host      string
+	Direction string
+
+	MessageID string
+	Origin    string
+	Kind      string
+
+	// Hop and Duplicate describe a traced message's arrival.
+	Hop       int
+	Duplicate bool
+
+	Code   CloseCode
+	Reason string
+}
+
+// eventBus hands events to the registered handlers on a single goroutine,
+// in order. Events are dropped rather than blocking the network when the
+// handlers fall behind. The zero value is ready to use.
+type eventBus struct {
+	once     sync.Once
+	mu       sync.Mutex
+	handlers []func(Event)
+	queue    chan Event
+}
+
+func (b *eventBus) start() {
+	b.once.Do(func() {
+		b.queue = make(chan Event, eventQueueSize)
+		go b.dispatch()
+	})
+}
+
+func (b *eventBus) subscribe(handler func(Event)) {
+	b.start()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, handler)
+}
+
+func (b *eventBus) emit(e Event) {
+	b.start()
+	b.mu.Lock()
+	listening := len(b.handlers) > 0
+	b.mu.Unlock()
+	if !listening {
+		return
+	}
+
+	e.Time = time.Now()
+	select {
+	case b.queue <- e:
+	default:
+	}
+}
+
+func (b *eventBus) dispatch() {
+	for e := range b.queue {
+		b.mu.Lock()
+		handlers := append([]func(Event){}, b.handlers...)
+		b.mu.Unlock()
+		for _, handler := range handlers {
+			handler(e)
+		}
+	}
+}
+
+// OnEvent registers a handler that is called for every event on this node.
+// Handlers run one at a time on a dedicated goroutine and should return
+// quickly; events that arrive while the queue is full are dropped.
+func (d *DP2P) OnEvent(handler func(Event)) {
+	d.core.events.subscribe(handler)
+}
+
+// linkEvent builds an event about the peer on the other side of l.
+func linkEvent(t EventType, l link) Event {
+	e := Event{Type: t, Peer: l.peerKey(), Host: l.toString()}
+	switch l.(type) {
+	case *client:
+		e.Direction = "outbound"
+	case *ActiveConnection:
+		e.Direction = "inbound"
+	}
+	return e
+}
+
+// messageEvent builds an event about a broadcast.
+func messageEvent(t EventType, meta broadcast) Event {
+	return Event{Type: t, MessageID: meta.MessageID, Origin: meta.Origin, Kind: meta.Kind}
+}
+
+// dropped reports and counts a discarded frame.
+func (c *core) dropped(from link, meta broadcast, reason string) {
+	e := messageEvent(MessageDropped, meta)
+	if from != nil {
+		e.Peer = from.peerKey()
+		e.Host = from.toString()
+	}
+	e.Reason = reason
+	c.events.emit(e)
+
+	switch reason {
+	case "duplicate":
+		atomic.AddUint64(&c.counters.messagesDeduplicated, 1)
+	case errDecrypt.Error():
+		atomic.AddUint64(&c.counters.decryptFailures, 1)
+	default:
+		atomic.AddUint64(&c.counters.messagesDropped, 1)
+	}
+}
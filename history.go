@@ -0,0 +1,288 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"sort"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// storedMessage is a broadcast kept in the message history, with everything
+// needed to check its origin's signature again.
+type storedMessage struct {
+	MessageID string `gorm:"primaryKey"`
+	Origin    string
+	Signature string
+	Timestamp int64 `gorm:"index"`
+	Kind      string
+	Flags     uint8
+	Ref       string
+	Clock     []byte
+	Size      int
+	Data      []byte
+}
+
+func (storedMessage) TableName() string {
+	return "messages"
+}
+
+// history is the persistent log of application messages, and the catch-up
+// sync that fills it from other nodes.
+//
+// Sync runs when we dial a peer that keeps history as well. We send a
+// summary of our log, with the number of messages and a hash of their IDs
+// for each slot of syncBucketWidth. The peer answers with the IDs in every
+// slot where its log differs, we ask for the ones we lack, and deliver them
+// to the application as historical messages.
+type history struct {
+	core *core
+	db   *gorm.DB
+}
+
+func newHistory(core *core) *history {
+	core.db.db.AutoMigrate(&storedMessage{})
+	h := &history{core: core, db: core.db.db}
+	go h.pruneLoop()
+	return h
+}
+
+// store adds a message to the log, and reports whether it was new.
+func (h *history) store(meta broadcast, data []byte) bool {
+	m := storedMessage{
+		MessageID: meta.MessageID,
+		Origin:    meta.Origin,
+		Signature: meta.Signature,
+		Timestamp: meta.Timestamp,
+		Kind:      meta.Kind,
+		Flags:     meta.flags(),
+		Ref:       meta.Ref,
+		Size:      len(data),
+		Data:      data,
+	}
+	if len(meta.Clock) > 0 {
+		m.Clock, _ = msgpack.Marshal(meta.Clock)
+	}
+	result := h.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&m)
+	if result.Error != nil {
+		h.core.log.Error("Could not store message", "messageID", meta.MessageID, "err", result.Error)
+		return true
+	}
+	return result.RowsAffected == 1
+}
+
+// cutoff is the origin timestamp of the oldest message we keep.
+func (h *history) cutoff() int64 {
+	return unixMillis(time.Now().Add(-h.core.config.HistoryMaxAge))
+}
+
+func (h *history) pruneLoop() {
+	for {
+		time.Sleep(historyPruneInterval)
+		h.prune()
+	}
+}
+
+// prune applies the retention policy, dropping the oldest messages first.
+func (h *history) prune() {
+	config := h.core.config
+	h.db.Where("timestamp < ?", h.cutoff()).Delete(&storedMessage{})
+
+	rows := []storedMessage{}
+	h.db.Select("message_id", "size").Order("timestamp desc").Find(&rows)
+	var total int64
+	expired := []string{}
+	for i, m := range rows {
+		total += int64(m.Size)
+		if i >= config.HistoryMaxMessages || total > config.HistoryMaxBytes {
+			expired = append(expired, m.MessageID)
+		}
+	}
+	for len(expired) > 0 {
+		n := len(expired)
+		if n > syncBatchSize {
+			n = syncBatchSize
+		}
+		h.db.Where("message_id IN ?", expired[:n]).Delete(&storedMessage{})
+		expired = expired[n:]
+	}
+}
+
+// buckets summarizes the log in slots of syncBucketWidth, and returns the
+// IDs in each slot.
+func (h *history) buckets() ([]syncBucket, map[int64][]string) {
+	rows := []storedMessage{}
+	h.db.Select("message_id", "timestamp").Where("timestamp >= ?", h.cutoff()).Find(&rows)
+
+	width := int64(syncBucketWidth / time.Millisecond)
+	ids := make(map[int64][]string)
+	for _, m := range rows {
+		start := m.Timestamp - m.Timestamp%width
+		ids[start] = append(ids[start], m.MessageID)
+	}
+	buckets := []syncBucket{}
+	for start, bucket := range ids {
+		sort.Strings(bucket)
+		hash := sha256.New()
+		for _, id := range bucket {
+			hash.Write([]byte(id))
+		}
+		buckets = append(buckets, syncBucket{Start: start, Count: len(bucket), Hash: hash.Sum(nil)})
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Start < buckets[j].Start })
+	return buckets, ids
+}
+
+// sync starts catching up from a peer we dialed.
+func (h *history) sync(l link) {
+	buckets, _ := h.buckets()
+	h.send(l, syncFrame{Stage: "summary", Buckets: buckets})
+}
+
+func (h *history) send(l link, frame syncFrame) {
+	data, err := msgpack.Marshal(frame)
+	if err != nil {
+		h.core.log.Error("Could not encode sync frame", "stage", frame.Stage, "err", err)
+		return
+	}
+	l.cast(data, h.core.newDirect(data, "sync"))
+}
+
+// handle answers a sync frame from a peer.
+func (h *history) handle(from link, data []byte) {
+	frame := syncFrame{}
+	if err := msgpack.Unmarshal(data, &frame); err != nil {
+		h.core.log.Warn("Could not decode sync frame", "peer", from.peerKey(), "err", err)
+		return
+	}
+	switch frame.Stage {
+	case "summary":
+		h.differences(from, frame.Buckets)
+	case "ids":
+		h.fetch(from, frame.IDs)
+	case "fetch":
+		h.serve(from, frame.IDs)
+	case "messages":
+		h.catchUp(from, frame.Messages)
+	default:
+		h.core.log.Warn("Unsupported sync stage", "stage", frame.Stage, "peer", from.peerKey())
+	}
+}
+
+// differences sends a peer the IDs in every slot where its summary does not
+// match our log.
+func (h *history) differences(to link, theirs []syncBucket) {
+	summary := make(map[int64]syncBucket)
+	for _, b := range theirs {
+		summary[b.Start] = b
+	}
+	ours, ids := h.buckets()
+	differing := []string{}
+	for _, b := range ours {
+		if other, ok := summary[b.Start]; ok && other.Count == b.Count && bytes.Equal(other.Hash, b.Hash) {
+			continue
+		}
+		differing = append(differing, ids[b.Start]...)
+	}
+	for len(differing) > 0 {
+		n := len(differing)
+		if n > syncBatchSize {
+			n = syncBatchSize
+		}
+		h.send(to, syncFrame{Stage: "ids", IDs: differing[:n]})
+		differing = differing[n:]
+	}
+}
+
+// fetch asks a peer for the messages among ids that we do not have.
+func (h *history) fetch(from link, ids []string) {
+	known := []string{}
+	h.db.Model(&storedMessage{}).Where("message_id IN ?", ids).Pluck("message_id", &known)
+	have := make(map[string]bool, len(known))
+	for _, id := range known {
+		have[id] = true
+	}
+	missing := []string{}
+	for _, id := range ids {
+		if !have[id] {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		h.core.log.Info("Catching up on missed messages", "peer", from.peerKey(), "count", len(missing))
+		h.send(from, syncFrame{Stage: "fetch", IDs: missing})
+	}
+}
+
+// serve sends a peer the messages it asked for, in frames of at most one
+// chunk.
+func (h *history) serve(to link, ids []string) {
+	if len(ids) > syncBatchSize {
+		ids = ids[:syncBatchSize]
+	}
+	rows := []storedMessage{}
+	h.db.Where("message_id IN ?", ids).Order("timestamp").Find(&rows)
+
+	batch := []syncMessage{}
+	size := 0
+	for _, m := range rows {
+		if len(batch) > 0 && size+m.Size > h.core.config.ChunkSize {
+			h.send(to, syncFrame{Stage: "messages", Messages: batch})
+			batch, size = []syncMessage{}, 0
+		}
+		message := syncMessage{
+			MessageID: m.MessageID,
+			Origin:    m.Origin,
+			Signature: m.Signature,
+			Timestamp: m.Timestamp,
+			Kind:      m.Kind,
+			Flags:     m.Flags,
+			Ref:       m.Ref,
+			Data:      m.Data,
+		}
+		if len(m.Clock) > 0 {
+			msgpack.Unmarshal(m.Clock, &message.Clock)
+		}
+		batch = append(batch, message)
+		size += m.Size
+	}
+	if len(batch) > 0 {
+		h.send(to, syncFrame{Stage: "messages", Messages: batch})
+	}
+}
+
+// catchUp stores and delivers messages fetched from a peer, once their
+// origin signatures check out.
+func (h *history) catchUp(from link, messages []syncMessage) {
+	cutoff := h.cutoff()
+	for _, m := range messages {
+		meta := broadcast{
+			Type:      "broadcast",
+			MessageID: m.MessageID,
+			Timestamp: m.Timestamp,
+			Kind:      m.Kind,
+			Origin:    m.Origin,
+			Signature: m.Signature,
+			Ref:       m.Ref,
+			Clock:     m.Clock,
+		}
+		// the flags are signed, so they must be restored for the signature
+		// to check out
+		meta.setFlags(m.Flags)
+		if m.Timestamp < cutoff || !verifyOrigin(&meta, m.Data) {
+			h.core.dropped(from, meta, "invalid historical message")
+			continue
+		}
+		if !h.store(meta, m.Data) {
+			continue
+		}
+		if h.core.causal != nil {
+			h.core.causal.receive(newMessage(meta, m.Data, true), meta.Clock)
+		} else {
+			h.core.deliver(newMessage(meta, m.Data, true))
+		}
+	}
+}
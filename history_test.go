@@ -0,0 +1,121 @@
+package p2p
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// newTestCore returns a core with fresh keys and its own database, and
+// nothing else set up.
+func newTestCore(t *testing.T) *core {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "p2p.sqlite") + "?_sync=0&_journal=WAL"
+	database, err := gorm.Open(sqlite.Open(path), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := NetworkConfig{}
+	config.setDefaults()
+	c := &core{config: config, log: config.Logger, db: db{db: database, config: config, log: config.Logger}}
+	c.keys.signKeys = c.keys.generateSignKeys()
+	return c
+}
+
+// testLink is a link that keeps what is cast on it.
+type testLink struct {
+	key string
+
+	mu    sync.Mutex
+	casts [][]byte
+}
+
+func (l *testLink) cast(msg []byte, meta broadcast) {
+	l.mu.Lock()
+	l.casts = append(l.casts, msg)
+	l.mu.Unlock()
+}
+
+func (l *testLink) send(msg []byte)                 {}
+func (l *testLink) peerKey() string                 { return l.key }
+func (l *testLink) supports(capability string) bool { return true }
+func (l *testLink) toString() string                { return l.key }
+
+func (l *testLink) frames() [][]byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.casts
+}
+
+func TestHistoryCatchUpKeepsSignedOptions(t *testing.T) {
+	origin := newTestCore(t)
+	origin.history = newHistory(origin)
+	messages := make(chan Message, 8)
+	fresh := newTestCore(t)
+	fresh.inbox = newInbox(messages)
+	fresh.history = newHistory(fresh)
+
+	sent := map[string]broadcast{
+		"plain":    origin.newBroadcast([]byte("plain"), "00000000-0000-4000-8000-000000000001"),
+		"reliable": origin.newBroadcast([]byte("reliable"), "00000000-0000-4000-8000-000000000002", withAck("")),
+		"retry":    origin.newBroadcast([]byte("retry"), "00000000-0000-4000-8000-000000000003", withAck("00000000-0000-4000-8000-000000000009")),
+		"traced":   origin.newBroadcast([]byte("traced"), "00000000-0000-4000-8000-000000000004", WithTrace(true)),
+	}
+	ids := []string{}
+	for data, meta := range sent {
+		if !origin.history.store(meta, []byte(data)) {
+			t.Fatalf("%s was not stored", data)
+		}
+		ids = append(ids, meta.MessageID)
+	}
+
+	// the stored messages go through the sync frames to a node without them
+	to := &testLink{key: fresh.keys.signKeyHex()}
+	origin.history.serve(to, ids)
+	for _, data := range to.frames() {
+		fresh.history.handle(&testLink{key: origin.keys.signKeyHex()}, data)
+	}
+
+	received := map[string]Message{}
+	timeout := time.After(5 * time.Second)
+	for len(received) < len(sent) {
+		select {
+		case m := <-messages:
+			received[string(m.Data)] = m
+		case <-timeout:
+			t.Fatalf("caught up on %d of %d messages", len(received), len(sent))
+		}
+	}
+	for data, meta := range sent {
+		m := received[data]
+		if !m.Historical {
+			t.Errorf("%s was not delivered as historical", data)
+		}
+		want := meta.MessageID
+		if meta.Ref != "" {
+			want = meta.Ref
+		}
+		if m.ID != want {
+			t.Errorf("%s was delivered as %s, want %s", data, m.ID, want)
+		}
+	}
+
+	// a node that caught up serves the messages on with the same options
+	var stored []storedMessage
+	fresh.history.db.Order("message_id").Find(&stored)
+	if len(stored) != len(sent) {
+		t.Fatalf("stored %d messages, want %d", len(stored), len(sent))
+	}
+	for _, m := range stored {
+		meta := broadcast{Type: "broadcast", MessageID: m.MessageID, Timestamp: m.Timestamp, Kind: m.Kind, Origin: m.Origin, Signature: m.Signature, Ref: m.Ref}
+		meta.setFlags(m.Flags)
+		if !verifyOrigin(&meta, m.Data) {
+			t.Errorf("%s does not verify after catching up", m.Data)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package p2p
+
+import (
+	"sync"
+)
+
+// inbox queues messages for the application in the order they were
+// delivered. Delivering never blocks, however slowly the application reads.
+type inbox struct {
+	mu     sync.Mutex
+	queue  []Message
+	signal chan struct{}
+}
+
+func newInbox(out chan Message) *inbox {
+	i := &inbox{signal: make(chan struct{}, 1)}
+	go i.pump(out)
+	return i
+}
+
+func (i *inbox) push(m Message) {
+	i.mu.Lock()
+	i.queue = append(i.queue, m)
+	i.mu.Unlock()
+	select {
+	case i.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (i *inbox) pump(out chan Message) {
+	for range i.signal {
+		for {
+			i.mu.Lock()
+			if len(i.queue) == 0 {
+				i.queue = nil
+				i.mu.Unlock()
+				break
+			}
+			m := i.queue[0]
+			i.queue = i.queue[1:]
+			i.mu.Unlock()
+			out <- m
+		}
+	}
+}
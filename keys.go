@@ -1,6 +1,7 @@
 package p2p
 
 import (
+	"bytes"
 	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/hex"
@@ -15,10 +16,12 @@ type keys struct {
 	signKeys   SignKeys
 	sealKeys   SealKeys
 	config     NetworkConfig
+	log        Logger
 }
 
 func (k *keys) initialize(config NetworkConfig) {
 	k.config = config
+	k.log = config.Logger
 	k.getProgFolder()
 	k.ensureFilesExist()
 	k.loadKeys()
@@ -36,12 +39,12 @@ func (k *keys) getProgFolder() {
 
 func (k *keys) ensureFilesExist() {
 	if !fileExists(k.progFolder) {
-		log.Info(colors.boldWhite+"KEYS"+colors.reset, "Creating program folder.")
+		k.log.Info("Creating program folder.", "component", "keys", "path", k.progFolder)
 		os.Mkdir(k.progFolder, 0700)
 	}
 
 	if !fileExists(k.keyFolder) {
-		log.Info(colors.boldWhite+"KEYS"+colors.reset, "Creating key folder.")
+		k.log.Info("Creating key folder.", "component", "keys", "path", k.keyFolder)
 		os.Mkdir(k.keyFolder, 0700)
 	}
 
@@ -52,7 +55,7 @@ func (k *keys) ensureFilesExist() {
 }
 
 func (k *keys) writeSignKeys() {
-	log.Info(colors.boldWhite+"KEYS"+colors.reset, "Creating keyfiles.")
+	k.log.Info("Creating keyfiles.", "component", "keys")
 	if !fileExists(k.keyFolder + "/signKey.pub") {
 		os.Create(k.keyFolder + "/signKey.pub")
 	}
@@ -70,7 +73,7 @@ func (k *keys) loadKeys() {
 	k.signKeys.Pub = readBytesFromFile(k.keyFolder + "/signKey.pub")
 	k.signKeys.Priv = readBytesFromFile(k.keyFolder + "/signKey.priv")
 
-	log.Info(colors.boldWhite+"KEYS"+colors.reset, "Public signing key: "+hex.EncodeToString(k.signKeys.Pub))
+	k.log.Info("Public signing key", "component", "keys", "key", hex.EncodeToString(k.signKeys.Pub))
 }
 
 func (k *keys) generateSignKeys() SignKeys {
@@ -93,5 +96,14 @@ func (k *keys) generateSealKeys() {
 	k.sealKeys.Pub = *pubKey
 	k.sealKeys.Priv = *privKey
 
-	log.Info(colors.boldWhite+"KEYS"+colors.reset, "Public sealing key: "+hex.EncodeToString(slicePub))
+	k.log.Info("Public sealing key", "component", "keys", "key", hex.EncodeToString(slicePub))
+}
+
+// signKeyHex is our public sign key as it appears on the wire.
+func (k *keys) signKeyHex() string {
+	return hex.EncodeToString(k.signKeys.Pub)
+}
+
+func (k *keys) isSelf(signKey []byte) bool {
+	return bytes.Equal(signKey, k.signKeys.Pub)
 }
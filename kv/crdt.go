@@ -0,0 +1,166 @@
+package kv
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+)
+
+// dot identifies a single write: the node that made it, and how many times
+// that node had written the key.
+type dot struct {
+	Node    string `msgpack:"node"`
+	Counter uint64 `msgpack:"counter"`
+}
+
+// write is a value written to a key.
+type write struct {
+	Dot   dot    `msgpack:"dot"`
+	Time  int64  `msgpack:"time"`
+	Value []byte `msgpack:"value"`
+}
+
+// state is the replicated state of a single key, an observed-remove set of
+// writes. A write removes every write it observed, and a delete removes them
+// without adding one, so concurrent writes are the only ones that live side
+// by side, and the last of them wins. A write that is concurrent with a
+// delete survives it.
+//
+// A node always observes its own writes, so a removed write implies that
+// every earlier write of the same node is removed too, and Removed only
+// needs the highest removed counter for each node. States are kept after a
+// key is deleted so that the delete cannot be undone by an old copy.
+type state struct {
+	Writes  []write           `msgpack:"writes"`
+	Removed map[string]uint64 `msgpack:"removed"`
+}
+
+// value returns the value of the key, which is absent when no write is live.
+func (s state) value() ([]byte, bool) {
+	if len(s.Writes) == 0 {
+		return nil, false
+	}
+	last := s.Writes[0]
+	for _, w := range s.Writes[1:] {
+		if newer(w, last) {
+			last = w
+		}
+	}
+	return last.Value, true
+}
+
+// newer orders concurrent writes by time, and by node to break ties. Writes
+// of the same node at the same time, which a node that lost its state and
+// reused its counters can make, are ordered by counter and then by value.
+func newer(a, b write) bool {
+	if a.Time != b.Time {
+		return a.Time > b.Time
+	}
+	if a.Dot.Node != b.Dot.Node {
+		return a.Dot.Node > b.Dot.Node
+	}
+	if a.Dot.Counter != b.Dot.Counter {
+		return a.Dot.Counter > b.Dot.Counter
+	}
+	return bytes.Compare(a.Value, b.Value) > 0
+}
+
+// observe returns the delta that removes every live write.
+func (s state) observe() state {
+	delta := state{Removed: make(map[string]uint64)}
+	for _, w := range s.Writes {
+		if w.Dot.Counter > delta.Removed[w.Dot.Node] {
+			delta.Removed[w.Dot.Node] = w.Dot.Counter
+		}
+	}
+	return delta
+}
+
+// next returns the dot for the next write node makes to the key.
+func (s state) next(node string) dot {
+	counter := s.Removed[node]
+	for _, w := range s.Writes {
+		if w.Dot.Node == node && w.Dot.Counter > counter {
+			counter = w.Dot.Counter
+		}
+	}
+	return dot{Node: node, Counter: counter + 1}
+}
+
+// latest returns the newest time among the live writes.
+func (s state) latest() int64 {
+	var t int64
+	for _, w := range s.Writes {
+		if w.Time > t {
+			t = w.Time
+		}
+	}
+	return t
+}
+
+// merge joins two states. It is commutative, associative and idempotent, so
+// replicas that merged the same states agree whatever the order.
+func merge(a, b state) state {
+	out := state{Removed: make(map[string]uint64)}
+	for _, s := range []state{a, b} {
+		for node, counter := range s.Removed {
+			if counter > out.Removed[node] {
+				out.Removed[node] = counter
+			}
+		}
+	}
+	// a dot is reused when a node lost its state, so two different writes
+	// can share one, and the newer of them is kept whichever side it is on
+	seen := make(map[dot]int)
+	for _, s := range []state{a, b} {
+		for _, w := range s.Writes {
+			if w.Dot.Counter <= out.Removed[w.Dot.Node] {
+				continue
+			}
+			if i, ok := seen[w.Dot]; ok {
+				if newer(w, out.Writes[i]) {
+					out.Writes[i] = w
+				}
+				continue
+			}
+			seen[w.Dot] = len(out.Writes)
+			out.Writes = append(out.Writes, w)
+		}
+	}
+	sort.Slice(out.Writes, func(i, j int) bool {
+		if out.Writes[i].Dot.Node != out.Writes[j].Dot.Node {
+			return out.Writes[i].Dot.Node < out.Writes[j].Dot.Node
+		}
+		return out.Writes[i].Dot.Counter < out.Writes[j].Dot.Counter
+	})
+	return out
+}
+
+// hash summarizes a state for anti-entropy. Equal states have equal hashes.
+func (s state) hash() []byte {
+	h := sha256.New()
+	number := make([]byte, 8)
+	for _, w := range s.Writes {
+		h.Write([]byte(w.Dot.Node))
+		binary.BigEndian.PutUint64(number, w.Dot.Counter)
+		h.Write(number)
+		binary.BigEndian.PutUint64(number, uint64(w.Time))
+		h.Write(number)
+		binary.BigEndian.PutUint64(number, uint64(len(w.Value)))
+		h.Write(number)
+		h.Write(w.Value)
+	}
+	h.Write([]byte{0})
+	nodes := make([]string, 0, len(s.Removed))
+	for node := range s.Removed {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	for _, node := range nodes {
+		h.Write([]byte(node))
+		binary.BigEndian.PutUint64(number, s.Removed[node])
+		h.Write(number)
+	}
+	return h.Sum(nil)[:16]
+}
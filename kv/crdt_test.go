@@ -0,0 +1,26 @@
+package kv
+
+import "testing"
+
+func TestMergeReusedDot(t *testing.T) {
+	// a node that lost its state starts its counters over, so the same dot
+	// can stand for two different writes
+	a := state{Writes: []write{{Dot: dot{Node: "node0", Counter: 1}, Time: 5, Value: []byte("first")}}}
+	b := state{Writes: []write{{Dot: dot{Node: "node0", Counter: 1}, Time: 5, Value: []byte("second")}}}
+	ab, ba := merge(a, b), merge(b, a)
+	if string(ab.hash()) != string(ba.hash()) {
+		t.Fatalf("merge is not commutative for a reused dot")
+	}
+	if len(ab.Writes) != 1 {
+		t.Fatalf("merge kept %d writes for one dot", len(ab.Writes))
+	}
+
+	c := state{Writes: []write{{Dot: dot{Node: "node0", Counter: 1}, Time: 9, Value: []byte("third")}}}
+	left, right := merge(merge(a, b), c), merge(a, merge(c, b))
+	if string(left.hash()) != string(right.hash()) {
+		t.Fatalf("merge is not associative for a reused dot")
+	}
+	if value, _ := left.value(); string(value) != "third" {
+		t.Errorf("value = %q, want the newest write", value)
+	}
+}
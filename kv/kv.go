@@ -0,0 +1,311 @@
+// Package kv is a key-value map replicated among the nodes of a p2p network.
+//
+// Every key holds a CRDT, so writes never conflict: nodes apply them
+// locally, broadcast them to the network, and merge whatever they receive
+// in any order. When the same key is written on two nodes at once, the
+// write with the later timestamp wins, and a write made at the same time
+// as a delete wins over it. Changes a node missed while it was away are
+// exchanged with each peer it connects to.
+//
+// Usage:
+//
+//	node := p2p.DP2P{}
+//	go node.Initialize(config)
+//	store, err := kv.Open(&node, kv.Config{Path: "kv.sqlite"})
+//	store.Put("greeting", []byte("hello"))
+package kv
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ExtraHash/p2p"
+	uuid "github.com/satori/go.uuid"
+	"github.com/vmihailenco/msgpack"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var errValueSize = errors.New("value is larger than the maximum value size")
+
+// MaxValueSize is the largest value Put accepts, so that a write fits in a
+// single broadcast.
+const MaxValueSize = 32 * 1024
+
+const (
+	defaultChannel = "kv"
+	syncBatchKeys  = 512
+	syncBatchBytes = 48 * 1024
+)
+
+// Config is the configuration of a Store.
+type Config struct {
+	// Path is the sqlite database the map is kept in.
+	Path string
+	// Channel is the p2p channel the map is replicated on. Nodes only share
+	// maps on the same channel. Defaults to "kv".
+	Channel string
+	// Logger defaults to p2p.SlogLogger(nil).
+	Logger p2p.Logger
+}
+
+// Change is a change to the value of a key, local or replicated.
+type Change struct {
+	Key     string
+	Value   []byte
+	Deleted bool
+}
+
+// entry is how a key is stored.
+type entry struct {
+	Key   string `gorm:"primaryKey"`
+	State []byte
+}
+
+func (entry) TableName() string {
+	return "kv_entries"
+}
+
+// channel is the part of a p2p.Channel a Store replicates over.
+type channel interface {
+	Broadcast(data []byte, opts ...p2p.BroadcastOption) (uuid.UUID, error)
+	Send(peer string, data []byte) error
+	Receive() p2p.Message
+}
+
+// Store is a replicated key-value map.
+type Store struct {
+	channel channel
+	self    string
+	db      *gorm.DB
+	log     p2p.Logger
+
+	mu       sync.Mutex
+	states   map[string]state
+	clock    int64
+	watchers map[*watcher]bool
+}
+
+// Open loads the map from disk and starts replicating it over node, which
+// may still be initializing.
+func Open(node *p2p.DP2P, config Config) (*Store, error) {
+	if config.Channel == "" {
+		config.Channel = defaultChannel
+	}
+	s, err := load(node.Channel(config.Channel), config)
+	if err != nil {
+		return nil, err
+	}
+
+	s.self = node.SignKey()
+	node.OnEvent(func(e p2p.Event) {
+		if e.Type == p2p.PeerAuthenticated && e.Direction == "outbound" {
+			go s.sync(e.Peer)
+		}
+	})
+	go s.listen()
+	return s, nil
+}
+
+// load opens the database of a store replicated over ch.
+func load(ch channel, config Config) (*Store, error) {
+	if config.Logger == nil {
+		config.Logger = p2p.SlogLogger(nil)
+	}
+	db, err := gorm.Open(sqlite.Open(config.Path), &gorm.Config{})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.AutoMigrate(&entry{}); err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		channel:  ch,
+		db:       db,
+		log:      config.Logger,
+		states:   make(map[string]state),
+		watchers: make(map[*watcher]bool),
+	}
+	rows := []entry{}
+	if err := db.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		st := state{}
+		if err := msgpack.Unmarshal(row.State, &st); err != nil {
+			s.log.Warn("Could not decode stored key", "key", row.Key, "err", err)
+			continue
+		}
+		s.states[row.Key] = st
+		if t := st.latest(); t > s.clock {
+			s.clock = t
+		}
+	}
+	return s, nil
+}
+
+// Get returns the value of a key, and whether it is set.
+func (s *Store) Get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.states[key].value()
+}
+
+// Keys lists the keys that are set and start with prefix.
+func (s *Store) Keys(prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := []string{}
+	for key, st := range s.states {
+		if _, ok := st.value(); ok && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Put sets the value of a key, here and then on every other node.
+func (s *Store) Put(key string, value []byte) error {
+	if len(value) > MaxValueSize {
+		return errValueSize
+	}
+	s.mu.Lock()
+	current := s.states[key]
+	now := time.Now().UnixNano()
+	if now <= s.clock {
+		now = s.clock + 1
+	}
+	s.clock = now
+	delta := current.observe()
+	delta.Writes = []write{{Dot: current.next(s.self), Time: now, Value: value}}
+	s.apply(key, delta)
+	s.mu.Unlock()
+	return s.publish(key, delta)
+}
+
+// Delete removes a key, here and then on every other node.
+func (s *Store) Delete(key string) error {
+	s.mu.Lock()
+	current, ok := s.states[key]
+	if !ok || len(current.Writes) == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	delta := current.observe()
+	s.apply(key, delta)
+	s.mu.Unlock()
+	return s.publish(key, delta)
+}
+
+// apply merges a delta into a key, persists the result, and tells the
+// watchers if the value changed. It reports whether the state changed.
+func (s *Store) apply(key string, delta state) bool {
+	before, existed := s.states[key]
+	after := merge(before, delta)
+	if existed && string(after.hash()) == string(before.hash()) {
+		return false
+	}
+	s.states[key] = after
+	if t := after.latest(); t > s.clock {
+		s.clock = t
+	}
+
+	data, err := msgpack.Marshal(after)
+	if err != nil {
+		s.log.Error("Could not encode key", "key", key, "err", err)
+	} else {
+		err = s.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&entry{Key: key, State: data}).Error
+		if err != nil {
+			s.log.Error("Could not store key", "key", key, "err", err)
+		}
+	}
+
+	old, had := before.value()
+	value, has := after.value()
+	if had != has || string(old) != string(value) {
+		s.notify(Change{Key: key, Value: value, Deleted: !has})
+	}
+	return true
+}
+
+func (s *Store) publish(key string, delta state) error {
+	data, err := msgpack.Marshal(frame{Type: "delta", States: []keyState{{Key: key, State: delta}}})
+	if err != nil {
+		return err
+	}
+	_, err = s.channel.Broadcast(data)
+	return err
+}
+
+// listen merges what other nodes send on the channel.
+func (s *Store) listen() {
+	for {
+		m := s.channel.Receive()
+		if m.Origin == s.self {
+			continue
+		}
+		f := frame{}
+		if err := msgpack.Unmarshal(m.Data, &f); err != nil {
+			s.log.Warn("Could not decode kv frame", "origin", m.Origin, "err", err)
+			continue
+		}
+		switch f.Type {
+		case "delta":
+			s.mu.Lock()
+			for _, ks := range f.States {
+				if delta, ok := s.authored(m.Origin, ks); ok {
+					s.apply(ks.Key, delta)
+				}
+			}
+			s.mu.Unlock()
+		case "states":
+			s.mu.Lock()
+			for _, ks := range f.States {
+				s.apply(ks.Key, ks.State)
+			}
+			s.mu.Unlock()
+		case "digest":
+			if m.Peer != "" {
+				s.compare(m.Peer, f)
+			}
+		case "want":
+			if m.Peer != "" {
+				s.send(m.Peer, f.Keys)
+			}
+		default:
+			s.log.Warn("Unsupported kv frame", "type", f.Type, "origin", m.Origin)
+		}
+	}
+}
+
+// authored checks a delta that origin broadcast. It may only add writes of
+// its own, and may only remove writes of other nodes that we already know
+// of, so that it cannot remove writes those nodes have yet to make. A
+// removal of writes we have not received yet is cut down to the ones we
+// have, and the rest reaches us again through anti-entropy. Must be called
+// with s.mu held.
+func (s *Store) authored(origin string, ks keyState) (state, bool) {
+	for _, w := range ks.State.Writes {
+		if w.Dot.Node != origin {
+			s.log.Warn("Dropped kv delta with a write of another node", "key", ks.Key, "origin", origin, "node", w.Dot.Node)
+			return state{}, false
+		}
+	}
+	known := s.states[ks.Key]
+	delta := state{Writes: ks.State.Writes, Removed: make(map[string]uint64, len(ks.State.Removed))}
+	for node, counter := range ks.State.Removed {
+		if node != origin {
+			if highest := known.next(node).Counter - 1; counter > highest {
+				counter = highest
+			}
+		}
+		if counter > 0 {
+			delta.Removed[node] = counter
+		}
+	}
+	return delta, true
+}
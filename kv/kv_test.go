@@ -0,0 +1,289 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ExtraHash/p2p"
+	uuid "github.com/satori/go.uuid"
+	"github.com/vmihailenco/msgpack"
+)
+
+// network carries the channels of stores in process. Broadcasts reach every
+// store in the same partition as the sender, and sends fail across
+// partitions, like they do between peers that are not connected.
+type network struct {
+	mu        sync.Mutex
+	idle      *sync.Cond
+	inflight  int
+	stores    []*Store
+	channels  map[string]*testChannel
+	partition map[string]int
+}
+
+// testChannel is a store's channel on the network. A message counts as in
+// flight until the store asks for the next one, which it only does once it
+// has handled it and sent whatever it answers with.
+type testChannel struct {
+	network *network
+	self    string
+	queue   []p2p.Message
+	ready   *sync.Cond
+	busy    bool
+}
+
+func (ch *testChannel) Broadcast(data []byte, opts ...p2p.BroadcastOption) (uuid.UUID, error) {
+	n := ch.network
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for key, to := range n.channels {
+		if n.partition[key] == n.partition[ch.self] {
+			to.deliver(p2p.Message{Origin: ch.self, Data: data})
+		}
+	}
+	return uuid.NewV4(), nil
+}
+
+func (ch *testChannel) Send(peer string, data []byte) error {
+	n := ch.network
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	to, ok := n.channels[peer]
+	if !ok || n.partition[peer] != n.partition[ch.self] {
+		return errors.New("not connected")
+	}
+	to.deliver(p2p.Message{Origin: ch.self, Peer: ch.self, Data: data})
+	return nil
+}
+
+func (ch *testChannel) Receive() p2p.Message {
+	n := ch.network
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if ch.busy {
+		ch.busy = false
+		n.inflight--
+		n.idle.Broadcast()
+	}
+	for len(ch.queue) == 0 {
+		ch.ready.Wait()
+	}
+	m := ch.queue[0]
+	ch.queue = ch.queue[1:]
+	ch.busy = true
+	return m
+}
+
+// deliver queues a message. Must be called with the network locked.
+func (ch *testChannel) deliver(m p2p.Message) {
+	ch.queue = append(ch.queue, m)
+	ch.network.inflight++
+	ch.ready.Signal()
+}
+
+func newNetwork(t *testing.T, size int) *network {
+	n := &network{channels: make(map[string]*testChannel), partition: make(map[string]int)}
+	n.idle = sync.NewCond(&n.mu)
+	logger := p2p.SlogLogger(slog.New(slog.NewTextHandler(testWriter{t}, &slog.HandlerOptions{Level: slog.LevelWarn})))
+	for i := 0; i < size; i++ {
+		ch := &testChannel{network: n, self: fmt.Sprintf("node%d", i), ready: sync.NewCond(&n.mu)}
+		s, err := load(ch, Config{Path: filepath.Join(t.TempDir(), "kv.sqlite"), Logger: logger})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.self = ch.self
+		n.channels[ch.self] = ch
+		n.stores = append(n.stores, s)
+		go s.listen()
+	}
+	return n
+}
+
+type testWriter struct {
+	t *testing.T
+}
+
+func (w testWriter) Write(p []byte) (int, error) {
+	w.t.Log(string(p))
+	return len(p), nil
+}
+
+// settle waits until every message sent so far, and every answer to them,
+// has been handled.
+func (n *network) settle(t *testing.T) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		n.mu.Lock()
+		for n.inflight > 0 {
+			n.idle.Wait()
+		}
+		n.mu.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("stores did not stop talking")
+	}
+}
+
+// split puts each listed store in the given partition.
+func (n *network) split(partition int, stores ...int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, i := range stores {
+		n.partition[n.stores[i].self] = partition
+	}
+}
+
+// heal reconnects every store, and runs anti-entropy over every connection
+// like peers do when they connect.
+func (n *network) heal(t *testing.T) {
+	t.Helper()
+	n.settle(t)
+	n.mu.Lock()
+	n.partition = make(map[string]int)
+	n.mu.Unlock()
+	for i, a := range n.stores {
+		for _, b := range n.stores[i+1:] {
+			a.sync(b.self)
+		}
+	}
+	n.settle(t)
+}
+
+// converged checks that every store holds the same state for every key.
+func (n *network) converged(t *testing.T) {
+	t.Helper()
+	n.settle(t)
+	first := n.stores[0]
+	first.mu.Lock()
+	defer first.mu.Unlock()
+	for _, s := range n.stores[1:] {
+		s.mu.Lock()
+		if len(s.states) != len(first.states) {
+			t.Fatalf("%s has %d keys, %s has %d", s.self, len(s.states), first.self, len(first.states))
+		}
+		for key, st := range first.states {
+			other, ok := s.states[key]
+			if !ok {
+				t.Fatalf("%s is missing key %q", s.self, key)
+			}
+			if string(st.hash()) != string(other.hash()) {
+				t.Fatalf("%s and %s disagree on key %q", first.self, s.self, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (n *network) value(t *testing.T, key string) (string, bool) {
+	t.Helper()
+	n.converged(t)
+	value, ok := n.stores[0].Get(key)
+	return string(value), ok
+}
+
+func TestConvergenceAfterPartition(t *testing.T) {
+	n := newNetwork(t, 5)
+	n.stores[0].Put("a", []byte("before"))
+	n.stores[0].Put("b", []byte("before"))
+	n.stores[0].Put("c", []byte("before"))
+	n.converged(t)
+
+	n.split(1, 3, 4)
+	n.stores[1].Put("a", []byte("left"))
+	n.stores[3].Put("a", []byte("right"))
+	n.stores[2].Delete("b")
+	n.stores[4].Put("b", []byte("right"))
+	n.stores[4].Delete("c")
+	n.stores[2].Put("d", []byte("left"))
+
+	n.heal(t)
+	if value, _ := n.value(t, "a"); value != "right" {
+		t.Errorf("a = %q, want the later write", value)
+	}
+	if value, ok := n.value(t, "b"); !ok || value != "right" {
+		t.Errorf("b = %q, %v, want the write concurrent with the delete", value, ok)
+	}
+	if _, ok := n.value(t, "c"); ok {
+		t.Errorf("c is still set after a delete that observed every write")
+	}
+	if value, _ := n.value(t, "d"); value != "left" {
+		t.Errorf("d = %q, want the write made in the other partition", value)
+	}
+}
+
+func TestConvergenceAcrossRepeatedPartitions(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	n := newNetwork(t, 6)
+	keys := []string{"a", "b", "c", "d"}
+	for round := 0; round < 10; round++ {
+		for i := range n.stores {
+			n.split(rng.Intn(3), i)
+		}
+		for op := 0; op < 30; op++ {
+			s := n.stores[rng.Intn(len(n.stores))]
+			key := keys[rng.Intn(len(keys))]
+			if rng.Intn(4) == 0 {
+				s.Delete(key)
+			} else {
+				s.Put(key, []byte(fmt.Sprintf("%d-%d", round, op)))
+			}
+		}
+		n.heal(t)
+		n.converged(t)
+	}
+}
+
+func TestSyncInBatches(t *testing.T) {
+	n := newNetwork(t, 2)
+	n.split(1, 1)
+	value := make([]byte, 1024)
+	for i := 0; i < 2*syncBatchKeys+10; i++ {
+		n.stores[i%2].Put(fmt.Sprintf("key%04d", i), value)
+	}
+	n.heal(t)
+	n.converged(t)
+	if keys := n.stores[0].Keys(""); len(keys) != 2*syncBatchKeys+10 {
+		t.Fatalf("synced %d keys, want %d", len(keys), 2*syncBatchKeys+10)
+	}
+}
+
+func TestDeltaOnlyWritesForItsOrigin(t *testing.T) {
+	n := newNetwork(t, 3)
+	victim, forger, target := n.stores[0], n.stores[1], n.stores[2]
+	victim.Put("a", []byte("first"))
+	n.settle(t)
+
+	forge := func(delta state) {
+		data, _ := msgpack.Marshal(frame{Type: "delta", States: []keyState{{Key: "a", State: delta}}})
+		forger.channel.Send(target.self, data)
+		n.settle(t)
+	}
+
+	// a write in the name of another node is dropped
+	forge(state{Writes: []write{{Dot: dot{Node: victim.self, Counter: 2}, Time: time.Now().UnixNano(), Value: []byte("forged")}}})
+	if value, _ := target.Get("a"); string(value) != "first" {
+		t.Fatalf("a = %q after a forged write, want %q", value, "first")
+	}
+
+	// a removal of writes the victim has yet to make only removes the ones
+	// it made
+	forge(state{Removed: map[string]uint64{victim.self: 100}})
+	if _, ok := target.Get("a"); ok {
+		t.Fatalf("a is still set after a delete that observed the write")
+	}
+	victim.Put("a", []byte("second"))
+	n.settle(t)
+	if value, _ := target.Get("a"); string(value) != "second" {
+		t.Fatalf("a = %q, want the write made after the delete", value)
+	}
+}
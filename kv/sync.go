@@ -0,0 +1,146 @@
+package kv
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// frame is what stores send each other on their channel.
+type frame struct {
+	Type   string     `msgpack:"type"`
+	States []keyState `msgpack:"states,omitempty"`
+	// From and To bound the keys a digest covers, To excluded. Empty
+	// bounds are open.
+	From   string    `msgpack:"from,omitempty"`
+	To     string    `msgpack:"to,omitempty"`
+	Hashes []keyHash `msgpack:"hashes,omitempty"`
+	Keys   []string  `msgpack:"keys,omitempty"`
+}
+
+type keyState struct {
+	Key   string `msgpack:"key"`
+	State state  `msgpack:"state"`
+}
+
+type keyHash struct {
+	Key  string `msgpack:"key"`
+	Hash []byte `msgpack:"hash"`
+}
+
+// sync starts anti-entropy with a peer we connected to. We send it the hash
+// of every key we hold, in sorted batches. For each batch it sends back the
+// keys we lack or hold a different state of, and asks for the ones it lacks
+// or holds a different state of, so both sides end up with the merge.
+func (s *Store) sync(peer string) {
+	s.mu.Lock()
+	keys := s.sortedKeys()
+	hashes := make([]keyHash, len(keys))
+	for i, key := range keys {
+		hashes[i] = keyHash{Key: key, Hash: s.states[key].hash()}
+	}
+	s.mu.Unlock()
+
+	from := ""
+	for {
+		n := len(hashes)
+		if n > syncBatchKeys {
+			n = syncBatchKeys
+		}
+		f := frame{Type: "digest", From: from, Hashes: hashes[:n]}
+		hashes = hashes[n:]
+		if len(hashes) > 0 {
+			f.To = hashes[0].Key
+		}
+		if err := s.sendFrame(peer, f); err != nil {
+			s.log.Debug("Could not sync kv with peer", "peer", peer, "err", err)
+			return
+		}
+		if len(hashes) == 0 {
+			return
+		}
+		from = f.To
+	}
+}
+
+// compare answers one batch of a peer's digest.
+func (s *Store) compare(peer string, f frame) {
+	theirs := make(map[string][]byte, len(f.Hashes))
+	for _, kh := range f.Hashes {
+		theirs[kh.Key] = kh.Hash
+	}
+
+	s.mu.Lock()
+	send := []string{}
+	for _, key := range s.sortedKeys() {
+		if key < f.From || (f.To != "" && key >= f.To) {
+			continue
+		}
+		if hash, ok := theirs[key]; !ok || !bytes.Equal(hash, s.states[key].hash()) {
+			send = append(send, key)
+		}
+	}
+	want := []string{}
+	for _, kh := range f.Hashes {
+		if st, ok := s.states[kh.Key]; !ok || !bytes.Equal(kh.Hash, st.hash()) {
+			want = append(want, kh.Key)
+		}
+	}
+	s.mu.Unlock()
+
+	if len(want) > 0 {
+		s.sendFrame(peer, frame{Type: "want", Keys: want})
+	}
+	s.send(peer, send)
+}
+
+// send sends a peer the states of the given keys, in frames of bounded
+// size.
+func (s *Store) send(peer string, keys []string) {
+	batch := []keyState{}
+	size := 0
+	s.mu.Lock()
+	states := make([]keyState, 0, len(keys))
+	for _, key := range keys {
+		if st, ok := s.states[key]; ok {
+			states = append(states, keyState{Key: key, State: st})
+		}
+	}
+	s.mu.Unlock()
+
+	for _, ks := range states {
+		n := len(ks.Key)
+		for _, w := range ks.State.Writes {
+			n += len(w.Value) + len(w.Dot.Node) + 32
+		}
+		if len(batch) > 0 && size+n > syncBatchBytes {
+			if err := s.sendFrame(peer, frame{Type: "states", States: batch}); err != nil {
+				return
+			}
+			batch, size = []keyState{}, 0
+		}
+		batch = append(batch, ks)
+		size += n
+	}
+	if len(batch) > 0 {
+		s.sendFrame(peer, frame{Type: "states", States: batch})
+	}
+}
+
+func (s *Store) sendFrame(peer string, f frame) error {
+	data, err := msgpack.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return s.channel.Send(peer, data)
+}
+
+func (s *Store) sortedKeys() []string {
+	keys := make([]string, 0, len(s.states))
+	for key := range s.states {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,85 @@
+package kv
+
+import (
+	"strings"
+	"sync"
+)
+
+// watcher queues the changes to the keys under a prefix, so that a slow
+// reader never holds up the store.
+type watcher struct {
+	prefix string
+	out    chan Change
+
+	mu     sync.Mutex
+	queue  []Change
+	signal chan struct{}
+	done   chan struct{}
+}
+
+// Watch returns the changes to every key that starts with prefix, in the
+// order they were made here, until the returned function is called.
+func (s *Store) Watch(prefix string) (<-chan Change, func()) {
+	w := &watcher{prefix: prefix, out: make(chan Change), signal: make(chan struct{}, 1), done: make(chan struct{})}
+	s.mu.Lock()
+	s.watchers[w] = true
+	s.mu.Unlock()
+	go w.pump()
+
+	var once sync.Once
+	return w.out, func() {
+		once.Do(func() {
+			s.mu.Lock()
+			delete(s.watchers, w)
+			s.mu.Unlock()
+			close(w.done)
+		})
+	}
+}
+
+// notify queues a change for the watchers of its key.
+func (s *Store) notify(c Change) {
+	for w := range s.watchers {
+		if !strings.HasPrefix(c.Key, w.prefix) {
+			continue
+		}
+		w.mu.Lock()
+		w.queue = append(w.queue, c)
+		w.mu.Unlock()
+		w.wake()
+	}
+}
+
+func (w *watcher) wake() {
+	select {
+	case w.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (w *watcher) pump() {
+	defer close(w.out)
+	for {
+		select {
+		case <-w.signal:
+		case <-w.done:
+			return
+		}
+		for {
+			w.mu.Lock()
+			if len(w.queue) == 0 {
+				w.queue = nil
+				w.mu.Unlock()
+				break
+			}
+			c := w.queue[0]
+			w.queue = w.queue[1:]
+			w.mu.Unlock()
+			select {
+			case w.out <- c:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package p2p
+
+import (
+	"sync"
+)
+
+// link is an authenticated connection to a remote peer, regardless of which
+// side dialed it. Both *client and *ActiveConnection are links.
+type link interface {
+	// cast seals msg for the remote peer and sends it as a broadcast frame.
+	cast(msg []byte, meta broadcast)
+	// send writes a raw frame to the connection.
+	send(msg []byte)
+	// peerKey is the hex encoded sign key of the remote peer.
+	peerKey() string
+	// supports reports whether both sides advertised a capability.
+	supports(capability string) bool
+	toString() string
+}
+
+// linkSet holds the authenticated links to other nodes. Connections from a
+// node to itself are never added.
+type linkSet struct {
+	mu    sync.Mutex
+	links []link
+}
+
+func (s *linkSet) add(l link) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.links {
+		if existing == l {
+			return
+		}
+	}
+	s.links = append(s.links, l)
+}
+
+func (s *linkSet) remove(l link) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, existing := range s.links {
+		if existing == l {
+			s.links = append(s.links[:i], s.links[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// all returns a snapshot of the current links.
+func (s *linkSet) all() []link {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]link{}, s.links...)
+}
+
+// byKey returns the links to the peer with the given hex sign key.
+func (s *linkSet) byKey(signKey string) []link {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found := []link{}
+	for _, l := range s.links {
+		if l.peerKey() == signKey {
+			found = append(found, l)
+		}
+	}
+	return found
+}
+
+// linkUp registers a newly authenticated link.
+func (c *core) linkUp(l link) {
+	c.links.add(l)
+	if c.tree != nil {
+		c.tree.join(l)
+	}
+	if c.membership != nil {
+		c.membership.joined(l)
+	}
+	if c.permissions != nil {
+		c.permissions.joined(l)
+	}
+}
+
+// linkDown forgets a link that was closed or failed.
+func (c *core) linkDown(l link) {
+	if !c.links.remove(l) {
+		return
+	}
+	if c.tree != nil {
+		c.tree.leave(l)
+	}
+	if c.membership != nil {
+		c.membership.lostLink(l)
+	}
+}
@@ -0,0 +1,151 @@
+package p2p
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logger receives a node's log output. Fields are alternating keys and
+// values, e.g. log.Warn("dropped broadcast", "peer", key, "messageID", id).
+//
+// A *slog.Logger satisfies Logger as is; see SlogLogger.
+type Logger interface {
+	Debug(msg string, fields ...interface{})
+	Info(msg string, fields ...interface{})
+	Warn(msg string, fields ...interface{})
+	Error(msg string, fields ...interface{})
+}
+
+// SlogLogger adapts a log/slog logger for NetworkConfig.Logger. A nil logger
+// uses slog.Default().
+func SlogLogger(l *slog.Logger) Logger {
+	if l == nil {
+		return slog.Default()
+	}
+	return l
+}
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+func (l logLevel) String() string {
+	switch l {
+	case levelDebug:
+		return "DEBUG"
+	case levelInfo:
+		return "INFO "
+	case levelWarn:
+		return "WARN "
+	default:
+		return "ERROR"
+	}
+}
+
+func (l logLevel) color() string {
+	switch l {
+	case levelDebug:
+		return colors.boldBlack
+	case levelInfo:
+		return colors.boldCyan
+	case levelWarn:
+		return colors.boldYellow
+	default:
+		return colors.boldRed
+	}
+}
+
+// textLogger is the default Logger. It writes one line per record in the
+// form "15:04:05.000 › LEVEL message key=value ...", colored only when the
+// output is a terminal.
+type textLogger struct {
+	mu    sync.Mutex
+	out   io.Writer
+	color bool
+}
+
+// newTextLogger returns the default logger for a config. A LogLevel below 1
+// discards everything.
+func newTextLogger(config NetworkConfig) *textLogger {
+	if config.LogLevel < 1 {
+		return &textLogger{out: ioutil.Discard}
+	}
+	return &textLogger{out: os.Stdout, color: isTerminal(os.Stdout)}
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+func (t *textLogger) Debug(msg string, fields ...interface{}) { t.write(levelDebug, msg, fields) }
+func (t *textLogger) Info(msg string, fields ...interface{})  { t.write(levelInfo, msg, fields) }
+func (t *textLogger) Warn(msg string, fields ...interface{})  { t.write(levelWarn, msg, fields) }
+func (t *textLogger) Error(msg string, fields ...interface{}) { t.write(levelError, msg, fields) }
+
+func (t *textLogger) write(level logLevel, msg string, fields []interface{}) {
+	if t.out == ioutil.Discard {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(time.Now().Format("15:04:05.000"))
+	b.WriteString(" › ")
+	if t.color {
+		b.WriteString(level.color() + level.String() + colors.reset)
+	} else {
+		b.WriteString(level.String())
+	}
+	b.WriteString(" ")
+	b.WriteString(msg)
+	for i := 0; i < len(fields); i += 2 {
+		key, value := fmt.Sprint(fields[i]), interface{}("!MISSING")
+		if i+1 < len(fields) {
+			value = fields[i+1]
+		}
+		b.WriteString(" ")
+		if t.color {
+			b.WriteString(colors.cyan + key + "=" + colors.reset)
+		} else {
+			b.WriteString(key + "=")
+		}
+		b.WriteString(formatValue(value))
+	}
+	b.WriteString("\n")
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	io.WriteString(t.out, b.String())
+}
+
+func formatValue(value interface{}) string {
+	var s string
+	switch v := value.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	case error:
+		s = v.Error()
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") || !strconv.CanBackquote(s) {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -1,6 +1,7 @@
 package p2p
 
 import (
+	"bytes"
 	"time"
 
 	uuid "github.com/satori/go.uuid"
@@ -15,11 +16,36 @@ type DP2P struct {
 }
 
 type core struct {
-	config        NetworkConfig
-	db            db
-	keys          keys
-	messages      *chan []byte
-	clientManager clientManager
+	config       NetworkConfig
+	log          Logger
+	db           db
+	keys         keys
+	messages     *chan Message
+	ordered      *ordered
+	orderedInbox *inbox
+	// orderedMessages is the ordered broadcast counterpart of messages.
+	orderedMessages *chan Message
+	channels        channelSet
+	blobs           *BlobStore
+	membership      *membership
+	permissions     *permissions
+	networkKey      *networkKey
+	upload          *bandwidth
+	download        *bandwidth
+	clientManager   clientManager
+	links           linkSet
+	tree            *plumtree
+	streams         *streamAssembler
+	streamPace      *rateLimiter
+	tracer          *tracer
+	history         *history
+	causal          *causal
+	inbox           *inbox
+	routes          replyRoutes
+	reliable        *reliable
+	compression     CompressionStats
+	events          eventBus
+	counters        counters
 }
 
 // NetworkConfig is the configuration for the p2p network.
@@ -28,24 +54,348 @@ type NetworkConfig struct {
 	NetworkID string
 	LogLevel  int
 	Seeds     []Peer
+
+	// Logger receives the node's log output. Defaults to a text logger on
+	// stdout, colored when it is a terminal, that is silent for a LogLevel
+	// below 1. A LogLevel above 1 additionally logs every frame.
+	Logger Logger
+
+	// ClockSkew is how far a broadcast's origin timestamp may be from the
+	// local clock before the frame is rejected. Defaults to one minute.
+	ClockSkew time.Duration
+
+	// SeenCacheSize bounds the number of message IDs remembered for
+	// deduplication, and SeenCacheTTL is how long each one is kept. The TTL
+	// should comfortably exceed twice the ClockSkew so that a frame cannot
+	// be replayed after its ID is forgotten. SeenCacheBloom switches the
+	// cache to a rotating Bloom filter for very high message rates.
+	SeenCacheSize  int
+	SeenCacheTTL   time.Duration
+	SeenCacheBloom bool
+
+	// DefaultTTL is the number of relays a broadcast may take before it is
+	// no longer forwarded, and MaxTTL caps the value accepted from peers or
+	// given to WithTTL. Each node counts as two relays, one on its server
+	// and one on its client side.
+	DefaultTTL int
+	MaxTTL     int
+
+	// OriginRate limits how many broadcasts per second are relayed for any
+	// single origin, with bursts of up to OriginBurst. A negative rate
+	// disables the limit.
+	OriginRate  float64
+	OriginBurst int
+
+	// BroadcastTree sends broadcasts along a self repairing spanning tree
+	// (Plumtree) instead of flooding every link, and only announces message
+	// IDs on the remaining links. Every node in the network should use the
+	// same setting.
+	BroadcastTree bool
+
+	// MaxFrameSize is the largest websocket frame accepted from a peer.
+	// Payloads larger than ChunkSize are split into chunks and reassembled
+	// by the receiver, which holds at most MaxStreams incomplete streams of
+	// up to MaxStreamSize bytes each, for no longer than StreamTimeout
+	// without progress. At most MaxStreamsPerOrigin of them may come from
+	// the same origin, so that one origin cannot hold up everyone else's.
+	MaxFrameSize        int64
+	ChunkSize           int
+	MaxStreamSize       int64
+	MaxStreams          int
+	MaxStreamsPerOrigin int
+	StreamTimeout       time.Duration
+
+	// Payloads of at least CompressThreshold bytes are compressed before
+	// they are sealed, on connections where both sides support it.
+	// DisableCompression stops us from offering or accepting a codec.
+	CompressThreshold  int
+	DisableCompression bool
+
+	// MinProtocolVersion refuses peers speaking an older wire protocol. It
+	// defaults to the oldest version this release is compatible with. Set
+	// it to 2 to refuse clients whose answer to the challenge could be
+	// relayed to us by another server.
+	MinProtocolVersion int
+
+	// Metrics serves the node's metrics in the Prometheus text format on
+	// /metrics. They are always available through DP2P.Metrics.
+	Metrics bool
+
+	// AdminToken enables the JSON admin API under /admin, and replaces the
+	// home page with the status dashboard. Requests must carry it as a bearer
+	// token in the Authorization header, or as a basic auth password.
+	AdminToken string
+
+	// History keeps the application messages this node receives in the
+	// database next to the peer table, limited to the newest
+	// HistoryMaxMessages messages, HistoryMaxBytes bytes of payload and
+	// HistoryMaxAge of age. When we dial a peer that keeps history too, we
+	// catch up on the messages we missed from it, and deliver them with
+	// Message.Historical set.
+	History            bool
+	HistoryMaxMessages int
+	HistoryMaxBytes    int64
+	HistoryMaxAge      time.Duration
+
+	// CausalOrder delivers application messages in causal order: a message
+	// is only delivered after every message its origin had delivered when
+	// sending it, and each origin's messages arrive in the order they were
+	// sent. Messages still missing their predecessors after CausalTimeout
+	// are delivered anyway. Every node in the network should use the same
+	// setting. Streams are not ordered.
+	CausalOrder   bool
+	CausalTimeout time.Duration
+
+	// Voters are the hex sign keys of the nodes that agree on the order of
+	// ordered broadcasts, which every node delivers in that order through
+	// DP2P.ReceiveOrdered. The voters keep connections to each other and
+	// run Consensus among themselves, Raft unless another module is given,
+	// and a majority of them must be up for ordered broadcasts to go
+	// through. Every node in the network should use the same voters.
+	Voters    []string
+	Consensus Consensus
+
+	// BlobMaxBytes is how large the blob store may grow before unpinned
+	// blobs are removed, and the largest blob it accepts.
+	BlobMaxBytes int64
+
+	// Membership runs a SWIM failure detector among the nodes that set it,
+	// which keeps the list returned by DP2P.Members and fires MemberJoined,
+	// MemberLeft and MemberFailed events. Every MembershipProbeInterval a
+	// node pings one of its neighbors, and when no answer arrives within
+	// MembershipProbeTimeout it asks MembershipIndirectProbes other
+	// neighbors to ping it too. A member none of them reaches is suspected,
+	// and declared failed unless it refutes the suspicion within
+	// MembershipSuspicionMult probe intervals, scaled up by the log of the
+	// network size. Longer timeouts, more indirect probes and a larger
+	// multiplier make false positives rarer, at the cost of slower
+	// detection.
+	Membership               bool
+	MembershipProbeInterval  time.Duration
+	MembershipProbeTimeout   time.Duration
+	MembershipIndirectProbes int
+	MembershipSuspicionMult  int
+
+	// Allowlist and Authority make the network permissioned: only nodes
+	// whose hex sign keys are in Allowlist, or that present a Certificate
+	// signed by the Authority's hex sign key, can connect to us or be
+	// connected to. The authority and the nodes in the Allowlist can admit
+	// and revoke nodes at runtime with DP2P.Admit and DP2P.Revoke, which
+	// reaches every node. The authority's decisions override those of the
+	// Allowlist, and decisions dated more than ClockSkew ahead are ignored.
+	// Every node in the network should use the same Allowlist and
+	// Authority.
+	Allowlist   []string
+	Authority   string
+	Certificate Certificate
+
+	// NetworkKey is a secret shared by every node in the network, which
+	// keeps nodes that do not know it from finding out that a node is part
+	// of the network. Every frame, the handshake included, is sealed with
+	// it, as are the answers to /info and /peers, and requests to the API
+	// that were not signed with it get a 404, unless they carry the
+	// AdminToken. Scrapers of /metrics must send the AdminToken then, and
+	// the dashboard does not prompt for it. Use at least 32 random bytes.
+	NetworkKey []byte
+
+	// MaxInbound caps the number of inbound connections, authenticated or
+	// not, and ConnectionRate limits how many connections per second each
+	// IP address may open, with bursts of up to ConnectionBurst. Refused
+	// connections get an HTTP error instead of a websocket. A negative
+	// MaxInbound or ConnectionRate disables the limit. A connection that
+	// does not authenticate within AuthTimeout is closed.
+	MaxInbound      int
+	ConnectionRate  float64
+	ConnectionBurst int
+	AuthTimeout     time.Duration
+
+	// PuzzleDifficulty makes clients solve a hashcash puzzle before they
+	// can authenticate, which costs them about 2^PuzzleDifficulty hashes.
+	// The difficulty grows with the number of inbound connections, up to
+	// PuzzleMaxDifficulty at MaxInbound. Every bit doubles the work, and
+	// clients refuse puzzles harder than 24 bits; the hardest puzzle should
+	// be solved well within the AuthTimeout of the slowest client.
+	PuzzleDifficulty    int
+	PuzzleMaxDifficulty int
+
+	// UploadRate and DownloadRate limit the bytes per second sent to and
+	// received from each peer, and TotalUploadRate and TotalDownloadRate
+	// the bytes per second over all connections. Zero means no limit.
+	// Frames wait in a queue per connection, which holds up to
+	// SendQueueSize bytes and drops the frames that do not fit, and each
+	// connection takes its turn under the total limit, so that a slow or
+	// greedy peer cannot hold up the others.
+	UploadRate        int64
+	DownloadRate      int64
+	TotalUploadRate   int64
+	TotalDownloadRate int64
+	SendQueueSize     int64
+}
+
+func (config *NetworkConfig) setDefaults() {
+	if config.ClockSkew == 0 {
+		config.ClockSkew = defaultClockSkew
+	}
+	if config.SeenCacheSize == 0 {
+		config.SeenCacheSize = defaultSeenCacheSize
+	}
+	if config.SeenCacheTTL == 0 {
+		config.SeenCacheTTL = defaultSeenCacheTTL
+	}
+	if config.DefaultTTL == 0 {
+		config.DefaultTTL = defaultTTL
+	}
+	if config.MaxTTL == 0 {
+		config.MaxTTL = defaultMaxTTL
+	}
+	if config.OriginRate == 0 {
+		config.OriginRate = defaultOriginRate
+	}
+	if config.OriginBurst == 0 {
+		config.OriginBurst = defaultOriginBurst
+	}
+	if config.MaxFrameSize == 0 {
+		config.MaxFrameSize = defaultMaxFrameSize
+	}
+	if config.ChunkSize == 0 {
+		config.ChunkSize = defaultChunkSize
+	}
+	// sealed chunks are hex encoded on the wire, which doubles their size
+	if maxChunk := int(config.MaxFrameSize/2) - 1024; config.ChunkSize > maxChunk {
+		config.ChunkSize = maxChunk
+	}
+	if config.MaxStreamSize == 0 {
+		config.MaxStreamSize = defaultMaxStreamSize
+	}
+	if config.MaxStreams == 0 {
+		config.MaxStreams = defaultMaxStreams
+	}
+	if config.MaxStreamsPerOrigin == 0 {
+		config.MaxStreamsPerOrigin = defaultMaxStreamsPerOrigin
+	}
+	if config.MaxStreamsPerOrigin > config.MaxStreams {
+		config.MaxStreamsPerOrigin = config.MaxStreams
+	}
+	if config.StreamTimeout == 0 {
+		config.StreamTimeout = defaultStreamTimeout
+	}
+	if config.MinProtocolVersion < minProtocolVersion {
+		config.MinProtocolVersion = minProtocolVersion
+	}
+	if config.MinProtocolVersion > protocolVersion {
+		config.MinProtocolVersion = protocolVersion
+	}
+	if config.CompressThreshold == 0 {
+		config.CompressThreshold = defaultCompressThreshold
+	}
+	if config.HistoryMaxMessages == 0 {
+		config.HistoryMaxMessages = defaultHistoryMaxMessages
+	}
+	if config.HistoryMaxBytes == 0 {
+		config.HistoryMaxBytes = defaultHistoryMaxBytes
+	}
+	if config.HistoryMaxAge == 0 {
+		config.HistoryMaxAge = defaultHistoryMaxAge
+	}
+	if config.CausalTimeout == 0 {
+		config.CausalTimeout = defaultCausalTimeout
+	}
+	if config.BlobMaxBytes == 0 {
+		config.BlobMaxBytes = defaultBlobMaxBytes
+	}
+	if config.MembershipProbeInterval == 0 {
+		config.MembershipProbeInterval = defaultProbeInterval
+	}
+	if config.MembershipProbeTimeout == 0 {
+		config.MembershipProbeTimeout = defaultProbeTimeout
+	}
+	if config.MembershipProbeTimeout >= config.MembershipProbeInterval {
+		config.MembershipProbeTimeout = config.MembershipProbeInterval / 2
+	}
+	if config.MembershipIndirectProbes == 0 {
+		config.MembershipIndirectProbes = defaultIndirectProbes
+	}
+	if config.MembershipSuspicionMult == 0 {
+		config.MembershipSuspicionMult = defaultSuspicionMult
+	}
+	if config.MaxInbound == 0 {
+		config.MaxInbound = defaultMaxInbound
+	}
+	if config.ConnectionRate == 0 {
+		config.ConnectionRate = defaultConnectionRate
+	}
+	if config.ConnectionBurst == 0 {
+		config.ConnectionBurst = defaultConnectionBurst
+	}
+	if config.AuthTimeout == 0 {
+		config.AuthTimeout = defaultAuthTimeout
+	}
+	if config.PuzzleDifficulty > maxPuzzleDifficulty {
+		config.PuzzleDifficulty = maxPuzzleDifficulty
+	}
+	if config.PuzzleMaxDifficulty < config.PuzzleDifficulty {
+		config.PuzzleMaxDifficulty = config.PuzzleDifficulty + defaultPuzzleSpread
+	}
+	if config.PuzzleMaxDifficulty > maxPuzzleDifficulty {
+		config.PuzzleMaxDifficulty = maxPuzzleDifficulty
+	}
+	if config.SendQueueSize == 0 {
+		config.SendQueueSize = defaultSendQueueSize
+	}
+	if config.Logger == nil {
+		config.Logger = newTextLogger(*config)
+	}
 }
 
 // Initialize the peer to peer network connection.
 func (d *DP2P) Initialize(config NetworkConfig) {
-	messages := make(chan []byte)
+	messages := make(chan Message)
 	d.core.messages = &messages
+	d.core.inbox = newInbox(messages)
+	orderedMessages := make(chan Message)
+	d.core.orderedMessages = &orderedMessages
+	d.core.orderedInbox = newInbox(orderedMessages)
 
+	config.setDefaults()
 	d.core.config = config
+	d.core.log = config.Logger
 
 	_, err := uuid.FromString(config.NetworkID)
 	if err != nil {
-		log.Error("Error parsing network ID. Network ID must be a valid UUID string.")
-		log.Fatal(err)
+		d.core.log.Error("Error parsing network ID. Network ID must be a valid UUID string.", "networkID", config.NetworkID, "err", err)
+		panic(err)
 	}
 
-	LoggerConfig(config)
+	if len(config.NetworkKey) > 0 {
+		d.core.networkKey = newNetworkKey(config.NetworkKey)
+	}
+	d.core.upload = newBandwidth(config.TotalUploadRate)
+	d.core.download = newBandwidth(config.TotalDownloadRate)
 	d.core.keys.initialize(config)
 	d.core.db.initialize(config)
+	d.core.streams = newStreamAssembler(&d.core)
+	d.core.streamPace = newRateLimiter(config.OriginRate, config.OriginBurst)
+	d.core.tracer = newTracer(&d.core)
+	d.core.reliable = newReliable(&d.core)
+	d.core.blobs = newBlobStore(&d.core)
+	if len(config.Allowlist) > 0 || config.Authority != "" {
+		d.core.permissions = newPermissions(&d.core)
+	}
+	if config.History {
+		d.core.history = newHistory(&d.core)
+	}
+	if config.CausalOrder {
+		d.core.causal = newCausal(&d.core)
+	}
+	if len(config.Voters) > 0 {
+		d.core.ordered = newOrdered(&d.core)
+	}
+	if config.BroadcastTree {
+		d.core.tree = newPlumtree(&d.core)
+	}
+	if config.Membership {
+		d.core.membership = newMembership(&d.core)
+	}
 
 	d.api.initialize(&d.core)
 
@@ -54,21 +404,180 @@ func (d *DP2P) Initialize(config NetworkConfig) {
 }
 
 // Broadcast a message on the network. Returns the created message's ID.
-func (d *DP2P) Broadcast(message []byte) uuid.UUID {
+// Messages larger than the configured ChunkSize are sent as a stream, in
+// which case the ID is the stream's ID.
+func (d *DP2P) Broadcast(message []byte, opts ...BroadcastOption) uuid.UUID {
+	if len(message) > d.core.config.ChunkSize {
+		streamID, err := d.BroadcastReader(bytes.NewReader(message), opts...)
+		if err != nil {
+			d.core.log.Error("Could not broadcast stream", "err", err)
+		}
+		return streamID
+	}
+	return d.core.broadcast(message, opts...)
+}
+
+func (c *core) broadcast(message []byte, opts ...BroadcastOption) uuid.UUID {
 	mID := uuid.NewV4()
-	d.core.clientManager.propagate(message, mID.String())
+	c.broadcastAs(mID, message, opts...)
 	return mID
 }
 
+// broadcastAs broadcasts a message under an ID chosen by the caller.
+func (c *core) broadcastAs(mID uuid.UUID, message []byte, opts ...BroadcastOption) broadcast {
+	meta := c.newBroadcast(message, mID.String(), opts...)
+	if meta.Trace {
+		c.tracer.start(meta)
+	}
+	if c.tree != nil {
+		c.tree.broadcast(message, meta)
+	} else {
+		c.clientManager.propagate(message, meta)
+	}
+	return meta
+}
+
+// Message is a message delivered to the application, with where it came
+// from.
+type Message struct {
+	// ID is the message ID returned to the sender, or the stream ID for
+	// messages sent as a stream.
+	ID     string
+	Origin string
+	// Time is when the origin sent the message.
+	Time time.Time
+	Data []byte
+	// Historical is set on messages this node missed while they were being
+	// broadcast, and fetched later from another node's history.
+	Historical bool
+	// Seq is the position of an ordered broadcast in the total order. It
+	// grows with every message, though not always by one.
+	Seq uint64
+	// Peer is set on channel messages sent to this node alone, to the
+	// sender's hex sign key.
+	Peer string
+}
+
+func newMessage(meta broadcast, data []byte, historical bool) Message {
+	id := meta.MessageID
+	if meta.Ref != "" {
+		id = meta.Ref
+	}
+	return Message{
+		ID:         id,
+		Origin:     meta.Origin,
+		Time:       time.Unix(0, meta.Timestamp*int64(time.Millisecond)),
+		Data:       data,
+		Historical: historical,
+	}
+}
+
 // ReadMessage will get the next broadcasted message on the network. It blocks
 // until the message is ready to be read.
 func (d *DP2P) ReadMessage() []byte {
+	return d.Receive().Data
+}
+
+// Receive is ReadMessage with the message's metadata.
+func (d *DP2P) Receive() Message {
 	for d.core.messages == nil {
 		time.Sleep(100 * time.Millisecond)
 	}
 	return <-*d.core.messages
 }
 
+// accept handles a broadcast that reached this node, according to its kind.
+func (c *core) accept(data []byte, meta broadcast) {
+	c.events.emit(messageEvent(MessageReceived, meta))
+	switch meta.Kind {
+	case "":
+		if meta.Ack && !c.reliable.receive(meta) {
+			return
+		}
+		if c.history != nil && !c.history.store(meta, data) {
+			return
+		}
+		if c.causal != nil {
+			c.causal.receive(newMessage(meta, data, false), meta.Clock)
+			return
+		}
+		c.deliver(newMessage(meta, data, false))
+	case "chunk":
+		c.streams.add(meta.Origin, data)
+	case "channel":
+		c.channel(meta, data, "")
+	case "have":
+		c.blobs.announced(meta, data)
+	case "propose", "channelPropose":
+		if c.ordered != nil {
+			c.ordered.propose(meta, data)
+		}
+	case "ordered":
+		if c.ordered != nil {
+			c.ordered.sequenced(meta, data)
+		}
+	case "member":
+		if c.membership != nil {
+			c.membership.broadcasted(meta, data)
+		}
+	case "admission":
+		if c.permissions != nil {
+			c.permissions.received(data, meta.Origin)
+		}
+	default:
+		c.log.Warn("Unsupported broadcast kind", "kind", meta.Kind, "messageID", meta.MessageID, "origin", meta.Origin)
+	}
+}
+
+// direct handles a frame sent to this node alone by the peer on from.
+func (c *core) direct(from link, data []byte, meta broadcast) {
+	if meta.Origin != from.peerKey() {
+		c.log.Warn("Direct frame has a foreign origin", "peer", from.peerKey(), "host", from.toString(), "origin", meta.Origin)
+		return
+	}
+	switch meta.Kind {
+	case "chunk":
+		c.streams.add(meta.Origin, data)
+	case "trace":
+		c.tracer.receive(data)
+	case "ack":
+		c.reliable.acked(data)
+	case "sync":
+		if c.history != nil {
+			c.history.handle(from, data)
+		}
+	case "order":
+		if c.ordered != nil {
+			c.ordered.receive(from, data)
+		}
+	case "channel":
+		c.channel(meta, data, from.peerKey())
+	case "blob":
+		c.blobs.handle(from, data)
+	case "swim":
+		if c.membership != nil {
+			c.membership.handle(from, data)
+		}
+	case "admission":
+		if c.permissions != nil {
+			c.permissions.received(data, from.peerKey())
+		}
+	default:
+		c.log.Warn("Unsupported direct kind", "kind", meta.Kind, "peer", from.peerKey())
+	}
+}
+
+// deliver hands a message to the application, after every message that
+// was delivered before it.
+func (c *core) deliver(m Message) {
+	c.inbox.push(m)
+}
+
+// deliverOrdered hands an ordered broadcast to the application.
+func (c *core) deliverOrdered(m Message) {
+	c.orderedInbox.push(m)
+}
+
 func (d *DP2P) postAPISetup() {
 	time.Sleep(2 * time.Second)
 	d.core.clientManager.initialize(&d.core)
@@ -0,0 +1,599 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// MemberState is what the membership protocol believes about a member.
+type MemberState int
+
+// The states of a member.
+const (
+	// MemberAlive members answer probes.
+	MemberAlive MemberState = iota
+	// MemberSuspect members missed a probe, and are declared failed
+	// unless they refute it in time.
+	MemberSuspect
+	// MemberDead members were suspected for too long.
+	MemberDead
+	// MemberDeparted members announced that they left.
+	MemberDeparted
+)
+
+func (s MemberState) String() string {
+	switch s {
+	case MemberAlive:
+		return "alive"
+	case MemberSuspect:
+		return "suspect"
+	case MemberDead:
+		return "dead"
+	case MemberDeparted:
+		return "left"
+	default:
+		return "unknown"
+	}
+}
+
+// Member is a node in the membership list.
+type Member struct {
+	SignKey string
+	State   MemberState
+	// Incarnation is raised by the member itself whenever it refutes a
+	// suspicion, and orders what is said about it.
+	Incarnation uint64
+	// Since is when the member entered its state, as seen here.
+	Since time.Time
+}
+
+// Members returns the members that are alive or suspected, ourselves
+// included, sorted by sign key. It is empty unless Membership is set.
+func (d *DP2P) Members() []Member {
+	if d.core.membership == nil {
+		return nil
+	}
+	return d.core.membership.list()
+}
+
+// Leave tells the other members that this node is leaving, and stops
+// probing them. It does nothing unless Membership is set.
+func (d *DP2P) Leave() {
+	if d.core.membership != nil {
+		d.core.membership.leave()
+	}
+}
+
+// member is our view of one member. alive is the member's own signed
+// announcement, which is passed on to nodes that join.
+type member struct {
+	state        MemberState
+	incarnation  uint64
+	since        time.Time
+	alive        memberUpdate
+	suspectUntil time.Time
+}
+
+// gossip is an update waiting to be piggybacked on probes.
+type gossip struct {
+	update memberUpdate
+	sent   int
+}
+
+// membership is a SWIM failure detector. Every probe interval we ping one
+// member, picked at random among the ones we are connected to and the ones
+// we recently lost the connection to. If it does not answer in time, we ask
+// a few other neighbors to ping it for us, and suspect it if none of them
+// gets an answer either. A suspected member that does not refute the
+// suspicion within the suspicion timeout is declared failed.
+//
+// Updates about members travel piggybacked on the probe frames, so they
+// spread from neighbor to neighbor through the whole network. Members sign
+// what they say about themselves, and announce joining, refuting and
+// leaving with a broadcast as well. A node sends everything it knows to each
+// peer it connects to.
+type membership struct {
+	core *core
+	key  string
+	seq  uint64
+
+	mu      sync.Mutex
+	members map[string]*member
+	lost    map[string]time.Time
+	queue   map[string]*gossip
+	pending map[uint64]func()
+	left    bool
+}
+
+func newMembership(core *core) *membership {
+	m := &membership{
+		core:    core,
+		key:     hex.EncodeToString(core.keys.signKeys.Pub),
+		members: make(map[string]*member),
+		lost:    make(map[string]time.Time),
+		queue:   make(map[string]*gossip),
+		pending: make(map[uint64]func()),
+	}
+	// starting from the clock outranks whatever was said about an earlier
+	// run of this node
+	self := m.signed(MemberAlive, uint64(time.Now().Unix()))
+	m.members[self.Node] = &member{state: MemberAlive, incarnation: self.Incarnation, since: time.Now(), alive: self}
+	go m.probeLoop()
+	go m.reapLoop()
+	return m
+}
+
+func (m *membership) self() string {
+	return m.key
+}
+
+func (m *membership) list() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	members := []Member{}
+	for key, mb := range m.members {
+		if mb.state == MemberAlive || mb.state == MemberSuspect {
+			members = append(members, Member{SignKey: key, State: mb.state, Incarnation: mb.incarnation, Since: mb.since})
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].SignKey < members[j].SignKey })
+	return members
+}
+
+// signed creates an update about ourselves.
+func (m *membership) signed(state MemberState, incarnation uint64) memberUpdate {
+	u := memberUpdate{Node: m.self(), State: state, Incarnation: incarnation}
+	u.Signature = hex.EncodeToString(ed25519.Sign(m.core.keys.signKeys.Priv, memberDigest(u)))
+	return u
+}
+
+// memberDigest is what a member signs about itself.
+func memberDigest(u memberUpdate) []byte {
+	digest := []byte("member\x00" + u.State.String() + "\x00")
+	digest = append(digest, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(digest[len(digest)-8:], u.Incarnation)
+	return digest
+}
+
+func verifyMember(u memberUpdate) bool {
+	node, err := hex.DecodeString(u.Node)
+	signature, sigErr := hex.DecodeString(u.Signature)
+	return err == nil && sigErr == nil && len(node) == ed25519.PublicKeySize && ed25519.Verify(node, memberDigest(u), signature)
+}
+
+// announce floods an update about ourselves, and piggybacks it too.
+func (m *membership) announce(u memberUpdate) {
+	m.mu.Lock()
+	m.enqueue(u)
+	m.mu.Unlock()
+	data, err := msgpack.Marshal(u)
+	if err != nil {
+		m.core.log.Error("Could not encode member update", "err", err)
+		return
+	}
+	m.core.broadcast(data, withKind("member"))
+}
+
+func (m *membership) leave() {
+	m.mu.Lock()
+	if m.left {
+		m.mu.Unlock()
+		return
+	}
+	m.left = true
+	self := m.members[m.self()]
+	if self.incarnation < math.MaxUint64 {
+		self.incarnation++
+	}
+	self.state = MemberDeparted
+	self.since = time.Now()
+	u := m.signed(MemberDeparted, self.incarnation)
+	self.alive = u
+	m.mu.Unlock()
+	m.core.log.Info("Leaving the membership")
+	m.announce(u)
+}
+
+// joined is called when a link to a peer comes up. We send it the signed
+// announcements of every live member we know.
+func (m *membership) joined(l link) {
+	if !l.supports(capMembership) {
+		return
+	}
+	m.mu.Lock()
+	delete(m.lost, l.peerKey())
+	updates := []memberUpdate{}
+	for _, mb := range m.members {
+		if mb.state == MemberAlive || mb.state == MemberSuspect || mb.state == MemberDeparted {
+			updates = append(updates, mb.alive)
+		}
+	}
+	m.mu.Unlock()
+	m.send(l, swimFrame{Type: "state", Updates: updates})
+}
+
+// lostLink is called when a link to a peer goes down. We keep probing the
+// peer through our other neighbors for a while.
+func (m *membership) lostLink(l link) {
+	if !l.supports(capMembership) {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if mb, ok := m.members[l.peerKey()]; ok && mb.state == MemberAlive && len(m.core.links.byKey(l.peerKey())) == 0 {
+		m.lost[l.peerKey()] = time.Now()
+	}
+}
+
+// broadcasted handles an update a member flooded about itself.
+func (m *membership) broadcasted(meta broadcast, data []byte) {
+	u := memberUpdate{}
+	if err := msgpack.Unmarshal(data, &u); err != nil || u.Node != meta.Origin {
+		m.core.log.Warn("Dropped invalid member update", "origin", meta.Origin, "messageID", meta.MessageID)
+		return
+	}
+	m.received(u)
+}
+
+// received handles an update about a member, from a broadcast or
+// piggybacked on a probe.
+func (m *membership) received(u memberUpdate) {
+	if (u.State == MemberAlive || u.State == MemberDeparted) && !verifyMember(u) {
+		m.core.log.Warn("Dropped member update with a bad signature", "node", u.Node, "state", u.State)
+		return
+	}
+	m.mu.Lock()
+	events := m.apply(u)
+	m.mu.Unlock()
+	for _, e := range events {
+		m.core.events.emit(e)
+	}
+}
+
+// apply merges an update into the member list, following the SWIM rules:
+// a higher incarnation wins, and at the same incarnation failed and left
+// beat suspect, which beats alive.
+func (m *membership) apply(u memberUpdate) []Event {
+	mb, known := m.members[u.Node]
+	// suspicions and failures are not signed, so one far ahead of the
+	// incarnation we know is made up to run the incarnation up. The gap
+	// allows for a day of clock difference between runs of a node, since
+	// incarnations start from the clock.
+	if (u.State == MemberSuspect || u.State == MemberDead) && known && u.Incarnation > mb.incarnation && u.Incarnation-mb.incarnation > memberIncarnationGap {
+		m.core.log.Warn("Dropped member update with an incarnation too far ahead", "node", u.Node, "state", u.State, "incarnation", u.Incarnation, "known", mb.incarnation)
+		return nil
+	}
+	if u.Node == m.self() {
+		m.refute(u)
+		return nil
+	}
+	now := time.Now()
+	switch u.State {
+	case MemberAlive:
+		if known && u.Incarnation <= mb.incarnation {
+			return nil
+		}
+		rejoined := !known || mb.state == MemberDead || mb.state == MemberDeparted
+		m.members[u.Node] = &member{state: MemberAlive, incarnation: u.Incarnation, since: now, alive: u}
+		if known && !rejoined {
+			m.members[u.Node].since = mb.since
+		}
+		m.enqueue(u)
+		if rejoined {
+			m.core.log.Info("Member joined", "peer", u.Node)
+			return []Event{{Type: MemberJoined, Peer: u.Node}}
+		}
+	case MemberSuspect:
+		if !known || mb.state != MemberAlive || u.Incarnation < mb.incarnation {
+			return nil
+		}
+		mb.state = MemberSuspect
+		mb.incarnation = u.Incarnation
+		mb.since = now
+		mb.suspectUntil = now.Add(m.suspicionTimeout())
+		m.enqueue(u)
+		m.core.log.Debug("Member suspected", "peer", u.Node, "incarnation", u.Incarnation)
+	case MemberDead, MemberDeparted:
+		if !known || mb.state == MemberDead || mb.state == MemberDeparted || u.Incarnation < mb.incarnation {
+			return nil
+		}
+		mb.state = u.State
+		mb.incarnation = u.Incarnation
+		mb.since = now
+		if u.State == MemberDeparted {
+			mb.alive = u
+		}
+		delete(m.lost, u.Node)
+		m.enqueue(u)
+		if u.State == MemberDeparted {
+			m.core.log.Info("Member left", "peer", u.Node)
+			return []Event{{Type: MemberLeft, Peer: u.Node}}
+		}
+		m.core.log.Info("Member failed", "peer", u.Node)
+		return []Event{{Type: MemberFailed, Peer: u.Node}}
+	}
+	return nil
+}
+
+// refute answers a suspicion or failure about ourselves with a higher
+// incarnation.
+func (m *membership) refute(u memberUpdate) {
+	self := m.members[m.self()]
+	if m.left || u.State == MemberAlive || u.Incarnation < self.incarnation {
+		return
+	}
+	// the incarnation sticks at the maximum rather than wrapping around
+	self.incarnation = u.Incarnation
+	if self.incarnation < math.MaxUint64 {
+		self.incarnation++
+	}
+	self.alive = m.signed(MemberAlive, self.incarnation)
+	m.core.log.Debug("Refuting suspicion", "state", u.State, "incarnation", self.incarnation)
+	alive := self.alive
+	go m.announce(alive)
+}
+
+// suspect starts suspecting a member that missed a probe.
+func (m *membership) suspect(node string) {
+	m.mu.Lock()
+	delete(m.lost, node)
+	mb, ok := m.members[node]
+	if !ok || mb.state != MemberAlive {
+		m.mu.Unlock()
+		return
+	}
+	events := m.apply(memberUpdate{Node: node, State: MemberSuspect, Incarnation: mb.incarnation})
+	m.mu.Unlock()
+	for _, e := range events {
+		m.core.events.emit(e)
+	}
+}
+
+// suspicionTimeout grows with the log of the network size, since updates
+// take longer to reach everyone in a larger network.
+func (m *membership) suspicionTimeout() time.Duration {
+	scale := math.Max(1, math.Log10(float64(len(m.members))))
+	return time.Duration(float64(m.core.config.MembershipSuspicionMult) * scale * float64(m.core.config.MembershipProbeInterval))
+}
+
+// enqueue queues an update for piggybacking, replacing older ones about the
+// same member.
+func (m *membership) enqueue(u memberUpdate) {
+	m.queue[u.Node] = &gossip{update: u}
+}
+
+// piggyback takes the updates sent the fewest times for a frame. Each update
+// is sent a number of times that grows with the log of the network size.
+func (m *membership) piggyback() []memberUpdate {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	queued := make([]*gossip, 0, len(m.queue))
+	for _, g := range m.queue {
+		queued = append(queued, g)
+	}
+	sort.Slice(queued, func(i, j int) bool { return queued[i].sent < queued[j].sent })
+	limit := memberRetransmitMult * int(math.Ceil(math.Log10(float64(len(m.members)+1))))
+	updates := []memberUpdate{}
+	for _, g := range queued {
+		if len(updates) == memberPiggyback {
+			break
+		}
+		updates = append(updates, g.update)
+		g.sent++
+		if g.sent >= limit {
+			delete(m.queue, g.update.Node)
+		}
+	}
+	return updates
+}
+
+func (m *membership) send(l link, f swimFrame) {
+	if f.Type != "state" {
+		f.Updates = m.piggyback()
+	}
+	data, err := msgpack.Marshal(f)
+	if err != nil {
+		m.core.log.Error("Could not encode membership frame", "type", f.Type, "err", err)
+		return
+	}
+	l.cast(data, m.core.newDirect(data, capMembership))
+}
+
+// handle answers a membership frame from a neighbor.
+func (m *membership) handle(from link, data []byte) {
+	f := swimFrame{}
+	if err := msgpack.Unmarshal(data, &f); err != nil {
+		m.core.log.Warn("Could not decode membership frame", "peer", from.peerKey(), "err", err)
+		return
+	}
+	for _, u := range f.Updates {
+		m.received(u)
+	}
+	switch f.Type {
+	case "ping":
+		m.send(from, swimFrame{Type: "ack", Seq: f.Seq})
+	case "ack":
+		m.mu.Lock()
+		done, ok := m.pending[f.Seq]
+		delete(m.pending, f.Seq)
+		m.mu.Unlock()
+		if ok {
+			done()
+		}
+	case "pingReq":
+		m.probeFor(from, f)
+	case "state":
+	default:
+		m.core.log.Warn("Unsupported membership frame", "type", f.Type, "peer", from.peerKey())
+	}
+}
+
+// probeFor pings a member on behalf of a neighbor, and passes its answer
+// on.
+func (m *membership) probeFor(requester link, f swimFrame) {
+	target := m.linkTo(f.Target)
+	if target == nil {
+		return
+	}
+	m.ping(target, m.core.config.MembershipProbeTimeout, func() {
+		m.send(requester, swimFrame{Type: "ack", Seq: f.Seq})
+	})
+}
+
+// ping sends a ping, and calls done if the answer arrives within timeout.
+func (m *membership) ping(l link, timeout time.Duration, done func()) uint64 {
+	seq := atomic.AddUint64(&m.seq, 1)
+	m.mu.Lock()
+	m.pending[seq] = done
+	m.mu.Unlock()
+	time.AfterFunc(timeout, func() {
+		m.mu.Lock()
+		delete(m.pending, seq)
+		m.mu.Unlock()
+	})
+	m.send(l, swimFrame{Type: "ping", Seq: seq})
+	return seq
+}
+
+// linkTo returns a link to a member that speaks the protocol.
+func (m *membership) linkTo(node string) link {
+	for _, l := range m.core.links.byKey(node) {
+		if l.supports(capMembership) {
+			return l
+		}
+	}
+	return nil
+}
+
+func (m *membership) probeLoop() {
+	for range time.Tick(m.core.config.MembershipProbeInterval) {
+		m.mu.Lock()
+		left := m.left
+		m.mu.Unlock()
+		if left {
+			return
+		}
+		if target := m.pickTarget(); target != "" {
+			m.probe(target)
+		}
+	}
+}
+
+// pickTarget picks a random member we are connected to, or recently lost
+// the connection to.
+func (m *membership) pickTarget() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	candidates := []string{}
+	for key, mb := range m.members {
+		if key == m.self() || (mb.state != MemberAlive && mb.state != MemberSuspect) {
+			continue
+		}
+		if _, lost := m.lost[key]; lost || m.linkTo(key) != nil {
+			candidates = append(candidates, key)
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// probe pings a member directly, then through other neighbors, and
+// suspects it if no answer arrives within the probe interval.
+func (m *membership) probe(target string) {
+	config := m.core.config
+	acked := make(chan struct{})
+	var once sync.Once
+	done := func() { once.Do(func() { close(acked) }) }
+
+	if l := m.linkTo(target); l != nil {
+		m.ping(l, config.MembershipProbeInterval, done)
+		select {
+		case <-acked:
+			m.reached(target)
+			return
+		case <-time.After(config.MembershipProbeTimeout):
+		}
+	}
+
+	seq := atomic.AddUint64(&m.seq, 1)
+	m.mu.Lock()
+	m.pending[seq] = done
+	m.mu.Unlock()
+	helpers := m.helpers(target)
+	for _, l := range helpers {
+		m.send(l, swimFrame{Type: "pingReq", Seq: seq, Target: target})
+	}
+
+	select {
+	case <-acked:
+		m.reached(target)
+	case <-time.After(config.MembershipProbeInterval - config.MembershipProbeTimeout):
+		m.mu.Lock()
+		delete(m.pending, seq)
+		m.mu.Unlock()
+		m.core.log.Debug("Member did not answer probe", "peer", target, "helpers", len(helpers))
+		m.suspect(target)
+	}
+}
+
+// reached is called when a probe was answered.
+func (m *membership) reached(node string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.lost[node]; ok && m.linkTo(node) == nil {
+		delete(m.lost, node)
+	}
+}
+
+// helpers picks the neighbors that ping a member for us.
+func (m *membership) helpers(target string) []link {
+	helpers := []link{}
+	for _, l := range m.core.links.all() {
+		if l.peerKey() != target && l.supports(capMembership) {
+			helpers = append(helpers, l)
+		}
+	}
+	rand.Shuffle(len(helpers), func(i, j int) { helpers[i], helpers[j] = helpers[j], helpers[i] })
+	if len(helpers) > m.core.config.MembershipIndirectProbes {
+		helpers = helpers[:m.core.config.MembershipIndirectProbes]
+	}
+	return helpers
+}
+
+// reapLoop declares suspects failed once their suspicion times out, and
+// forgets failed and departed members after a while.
+func (m *membership) reapLoop() {
+	for range time.Tick(m.core.config.MembershipProbeInterval) {
+		now := time.Now()
+		events := []Event{}
+		m.mu.Lock()
+		for key, mb := range m.members {
+			switch {
+			case mb.state == MemberSuspect && now.After(mb.suspectUntil):
+				events = append(events, m.apply(memberUpdate{Node: key, State: MemberDead, Incarnation: mb.incarnation})...)
+			case (mb.state == MemberDead || mb.state == MemberDeparted) && now.Sub(mb.since) > memberTombstoneTTL:
+				delete(m.members, key)
+			}
+		}
+		for key, since := range m.lost {
+			if now.Sub(since) > m.suspicionTimeout() {
+				delete(m.lost, key)
+			}
+		}
+		m.mu.Unlock()
+		for _, e := range events {
+			m.core.events.emit(e)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package p2p
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// counters are the running totals behind Metrics. They are only touched
+// through sync/atomic.
+type counters struct {
+	handshakes           uint64
+	handshakeFailures    uint64
+	messagesSent         uint64
+	bytesSent            uint64
+	messagesReceived     uint64
+	bytesReceived        uint64
+	messagesRelayed      uint64
+	messagesDeduplicated uint64
+	messagesDropped      uint64
+	decryptFailures      uint64
+	connectionsRefused   uint64
+	sendQueueDrops       uint64
+	// time spent waiting for the bandwidth limits, in nanoseconds
+	uploadWait   uint64
+	downloadWait uint64
+}
+
+// Metrics is a snapshot of a node's counters and gauges. Message and byte
+// counts cover sealed frames, both broadcast and direct, and bytes are
+// counted after compression and encryption.
+type Metrics struct {
+	InboundConnections  int
+	OutboundConnections int
+
+	HandshakeSuccesses uint64
+	HandshakeFailures  uint64
+
+	MessagesSent         uint64
+	BytesSent            uint64
+	MessagesReceived     uint64
+	BytesReceived        uint64
+	MessagesRelayed      uint64
+	MessagesDeduplicated uint64
+	MessagesDropped      uint64
+	DecryptFailures      uint64
+	// ConnectionsRefused counts inbound connections turned away by the
+	// MaxInbound and ConnectionRate limits.
+	ConnectionsRefused uint64
+
+	// QueuedBytes is the number of bytes waiting in the send queues, and
+	// PeerQueuedBytes the same for each peer, keyed by its hex sign key.
+	// SendQueueDrops counts the frames dropped because a queue was full,
+	// and UploadThrottled and DownloadThrottled add up the time spent
+	// waiting for the bandwidth limits.
+	QueuedBytes       int64
+	PeerQueuedBytes   map[string]int64
+	SendQueueDrops    uint64
+	UploadThrottled   time.Duration
+	DownloadThrottled time.Duration
+
+	Compression CompressionStats
+
+	// PeerRTT is the round trip time to each outbound peer, keyed by its
+	// hex sign key.
+	PeerRTT       map[string]time.Duration
+	PeerTableSize int
+	SeenCacheSize int
+}
+
+// handshake counts a finished handshake with a peer.
+func (c *core) handshake(ok bool) {
+	if ok {
+		atomic.AddUint64(&c.counters.handshakes, 1)
+	} else {
+		atomic.AddUint64(&c.counters.handshakeFailures, 1)
+	}
+}
+
+// relayed counts a broadcast that was forwarded and reports it.
+func (c *core) relayed(meta broadcast) {
+	atomic.AddUint64(&c.counters.messagesRelayed, 1)
+	c.events.emit(messageEvent(MessageRelayed, meta))
+}
+
+// Metrics returns a snapshot of this node's metrics, for programs that feed
+// another metrics system.
+func (d *DP2P) Metrics() Metrics {
+	return d.api.metrics()
+}
+
+func (a *api) metrics() Metrics {
+	c := a.core
+	m := Metrics{
+		HandshakeSuccesses:   atomic.LoadUint64(&c.counters.handshakes),
+		HandshakeFailures:    atomic.LoadUint64(&c.counters.handshakeFailures),
+		MessagesSent:         atomic.LoadUint64(&c.counters.messagesSent),
+		BytesSent:            atomic.LoadUint64(&c.counters.bytesSent),
+		MessagesReceived:     atomic.LoadUint64(&c.counters.messagesReceived),
+		BytesReceived:        atomic.LoadUint64(&c.counters.bytesReceived),
+		MessagesRelayed:      atomic.LoadUint64(&c.counters.messagesRelayed),
+		MessagesDeduplicated: atomic.LoadUint64(&c.counters.messagesDeduplicated),
+		MessagesDropped:      atomic.LoadUint64(&c.counters.messagesDropped),
+		DecryptFailures:      atomic.LoadUint64(&c.counters.decryptFailures),
+		ConnectionsRefused:   atomic.LoadUint64(&c.counters.connectionsRefused),
+		SendQueueDrops:       atomic.LoadUint64(&c.counters.sendQueueDrops),
+		UploadThrottled:      time.Duration(atomic.LoadUint64(&c.counters.uploadWait)),
+		DownloadThrottled:    time.Duration(atomic.LoadUint64(&c.counters.downloadWait)),
+		Compression: CompressionStats{
+			Uncompressed: atomic.LoadUint64(&c.compression.Uncompressed),
+			Compressed:   atomic.LoadUint64(&c.compression.Compressed),
+		},
+		PeerRTT:         map[string]time.Duration{},
+		PeerQueuedBytes: map[string]int64{},
+	}
+
+	a.acMu.Lock()
+	for _, ac := range a.ac {
+		queued := ac.queue.len()
+		m.QueuedBytes += queued
+		if ac.authed && !c.keys.isSelf(ac.signkey) {
+			m.InboundConnections++
+			m.PeerQueuedBytes[ac.peerKey()] += queued
+		}
+	}
+	a.acMu.Unlock()
+
+	c.clientManager.clientMu.Lock()
+	for _, client := range c.clientManager.clients {
+		if client.queue != nil {
+			m.QueuedBytes += client.queue.len()
+		}
+		if client.authorized && !client.failed {
+			m.OutboundConnections++
+			m.PeerRTT[client.peer.SignKey] = client.pingTime
+			m.PeerQueuedBytes[client.peer.SignKey] += client.queue.len()
+		}
+	}
+	c.clientManager.clientMu.Unlock()
+
+	if c.db.db != nil {
+		var count int64
+		c.db.db.Model(&Peer{}).Count(&count)
+		m.PeerTableSize = int(count)
+	}
+
+	if a.serverReceived != nil {
+		m.SeenCacheSize += a.serverReceived.len()
+	}
+	if c.clientManager.clientReceived != nil {
+		m.SeenCacheSize += c.clientManager.clientReceived.len()
+	}
+	if c.tree != nil {
+		m.SeenCacheSize += c.tree.seen.len()
+	}
+
+	return m
+}
+
+// MetricsHandler serves the node's metrics in the Prometheus text format.
+func (a *api) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		m := a.metrics()
+
+		res.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		res.WriteHeader(http.StatusOK)
+
+		metric := func(name string, kind string, help string, value interface{}) {
+			fmt.Fprintf(res, "# HELP %s_%s %s\n# TYPE %s_%s %s\n%s_%s %v\n", metricsPrefix, name, help, metricsPrefix, name, kind, metricsPrefix, name, value)
+		}
+
+		metric("inbound_connections", "gauge", "Authenticated inbound connections.", m.InboundConnections)
+		metric("outbound_connections", "gauge", "Authenticated outbound connections.", m.OutboundConnections)
+		metric("handshakes_total", "counter", "Successful handshakes.", m.HandshakeSuccesses)
+		metric("handshake_failures_total", "counter", "Failed or refused handshakes.", m.HandshakeFailures)
+		metric("messages_sent_total", "counter", "Sealed frames sent.", m.MessagesSent)
+		metric("bytes_sent_total", "counter", "Sealed bytes sent.", m.BytesSent)
+		metric("messages_received_total", "counter", "Sealed frames received and opened.", m.MessagesReceived)
+		metric("bytes_received_total", "counter", "Sealed bytes received and opened.", m.BytesReceived)
+		metric("messages_relayed_total", "counter", "Broadcasts forwarded to other peers.", m.MessagesRelayed)
+		metric("messages_deduplicated_total", "counter", "Broadcasts dropped as duplicates.", m.MessagesDeduplicated)
+		metric("messages_dropped_total", "counter", "Frames dropped for any other reason.", m.MessagesDropped)
+		metric("decrypt_failures_total", "counter", "Frames that failed to decrypt.", m.DecryptFailures)
+		metric("connections_refused_total", "counter", "Inbound connections refused by the connection limits.", m.ConnectionsRefused)
+		metric("queued_bytes", "gauge", "Bytes waiting in the send queues.", m.QueuedBytes)
+		metric("send_queue_drops_total", "counter", "Frames dropped because a send queue was full.", m.SendQueueDrops)
+		metric("upload_throttled_seconds_total", "counter", "Time spent waiting for the upload limits.", m.UploadThrottled.Seconds())
+		metric("download_throttled_seconds_total", "counter", "Time spent waiting for the download limits.", m.DownloadThrottled.Seconds())
+		metric("compression_uncompressed_bytes_total", "counter", "Payload bytes before compression.", m.Compression.Uncompressed)
+		metric("compression_compressed_bytes_total", "counter", "Payload bytes after compression.", m.Compression.Compressed)
+		metric("peer_table_size", "gauge", "Known peers.", m.PeerTableSize)
+		metric("seen_cache_size", "gauge", "Message IDs remembered for deduplication.", m.SeenCacheSize)
+
+		peers := make([]string, 0, len(m.PeerRTT))
+		for peer := range m.PeerRTT {
+			peers = append(peers, peer)
+		}
+		sort.Strings(peers)
+		fmt.Fprintf(res, "# HELP %s_peer_rtt_seconds Round trip time to outbound peers.\n# TYPE %s_peer_rtt_seconds gauge\n", metricsPrefix, metricsPrefix)
+		for _, peer := range peers {
+			fmt.Fprintf(res, "%s_peer_rtt_seconds{peer=%q} %v\n", metricsPrefix, peer, m.PeerRTT[peer].Seconds())
+		}
+
+		peers = make([]string, 0, len(m.PeerQueuedBytes))
+		for peer := range m.PeerQueuedBytes {
+			peers = append(peers, peer)
+		}
+		sort.Strings(peers)
+		fmt.Fprintf(res, "# HELP %s_peer_queued_bytes Bytes waiting in the send queues to each peer.\n# TYPE %s_peer_queued_bytes gauge\n", metricsPrefix, metricsPrefix)
+		for _, peer := range peers {
+			fmt.Fprintf(res, "%s_peer_queued_bytes{peer=%q} %v\n", metricsPrefix, peer, m.PeerQueuedBytes[peer])
+		}
+	})
+}
@@ -0,0 +1,168 @@
+package p2p
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+var errNetworkKey = errors.New("frame is not sealed with the network key")
+
+// networkKeyOverhead is how much sealing with the network key adds to a
+// frame: a nonce and the secretbox tag.
+const networkKeyOverhead = 24 + secretbox.Overhead
+
+// networkKey keeps a network's traffic private to the nodes that share its
+// pre-shared key. Every websocket frame, the handshake included, and the
+// bodies of /info and /peers are sealed with it, and the server answers
+// requests that are not signed with it as if it did not exist. Separate
+// keys are derived for sealing and for signing requests.
+type networkKey struct {
+	seal [32]byte
+	auth []byte
+}
+
+func newNetworkKey(secret []byte) *networkKey {
+	k := &networkKey{}
+	k.seal = sha256.Sum256(append([]byte("extrap2p network key seal\x00"), secret...))
+	auth := sha256.Sum256(append([]byte("extrap2p network key auth\x00"), secret...))
+	k.auth = auth[:]
+	return k
+}
+
+// sealFrame seals data with the network key, behind a random nonce. It
+// returns data as is when the network has no key.
+func (c *core) sealFrame(data []byte) []byte {
+	if c.networkKey == nil {
+		return data
+	}
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		panic(err)
+	}
+	return secretbox.Seal(nonce[:], data, &nonce, &c.networkKey.seal)
+}
+
+// openFrame opens a frame sealed with sealFrame.
+func (c *core) openFrame(data []byte) ([]byte, error) {
+	if c.networkKey == nil {
+		return data, nil
+	}
+	if len(data) < networkKeyOverhead {
+		return nil, errNetworkKey
+	}
+	var nonce [24]byte
+	copy(nonce[:], data[:24])
+	opened, ok := secretbox.Open(nil, data[24:], &nonce, &c.networkKey.seal)
+	if !ok {
+		return nil, errNetworkKey
+	}
+	return opened, nil
+}
+
+// frameLimit is the largest websocket frame we read.
+func (c *core) frameLimit() int64 {
+	if c.networkKey == nil {
+		return c.config.MaxFrameSize
+	}
+	return c.config.MaxFrameSize + networkKeyOverhead
+}
+
+// authorize signs a request for the given method, host and path with the
+// network key, for the networkKeyHeader. The host is signed so that a header
+// seen on the way to one node cannot be replayed against another. It returns
+// an empty header when the network has no key.
+func (c *core) authorize(method, host, path string) http.Header {
+	header := http.Header{}
+	if c.networkKey != nil {
+		now := strconv.FormatInt(time.Now().Unix(), 10)
+		header.Set(networkKeyHeader, now+"."+hex.EncodeToString(c.networkKey.mac(method, host, path, now)))
+	}
+	return header
+}
+
+// get requests a path of a peer's API, signed with the network key, and
+// returns the opened body.
+func (c *core) get(host, path string, timeout time.Duration) ([]byte, error) {
+	req, err := http.NewRequest("GET", "http://"+host+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = c.authorize("GET", req.URL.Host, path)
+	httpClient := http.Client{Timeout: timeout}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New(res.Status)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	return c.openFrame(body)
+}
+
+func (k *networkKey) mac(method, host, path, timestamp string) []byte {
+	h := hmac.New(sha256.New, k.auth)
+	h.Write([]byte(method + "\x00" + host + "\x00" + path + "\x00" + timestamp))
+	return h.Sum(nil)
+}
+
+// authorized checks that a request was signed with the network key for the
+// host it was sent to, within the ClockSkew.
+func (c *core) authorized(req *http.Request) bool {
+	parts := strings.SplitN(req.Header.Get(networkKeyHeader), ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	signed, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return false
+	}
+	if skew := time.Since(time.Unix(signed, 0)); skew > c.config.ClockSkew || skew < -c.config.ClockSkew {
+		return false
+	}
+	mac, err := hex.DecodeString(parts[1])
+	return err == nil && hmac.Equal(mac, c.networkKey.mac(req.Method, req.Host, req.URL.Path, parts[0]))
+}
+
+// respond writes a JSON body, sealed with the network key if there is one.
+func (a *api) respond(res http.ResponseWriter, body []byte) {
+	if a.core.networkKey != nil {
+		res.Header().Set("Content-Type", "application/octet-stream")
+	} else {
+		res.Header().Set("Content-Type", "application/json")
+	}
+	res.WriteHeader(http.StatusOK)
+	res.Write(a.core.sealFrame(body))
+}
+
+// guard hides the node from requests that were not signed with the network
+// key, by answering them as if nothing was there. Requests carrying the
+// AdminToken are let through too, so that the operator can reach the metrics
+// and admin endpoints without the network key.
+func (a *api) guard(next http.Handler) http.Handler {
+	if a.core.networkKey == nil {
+		return next
+	}
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if a.core.authorized(req) || a.admin(req) {
+			next.ServeHTTP(res, req)
+			return
+		}
+		a.core.log.Debug("Hid from a request not signed with the network key", "url", req.URL, "remote", GetIP(req))
+		http.NotFound(res, req)
+	})
+}
@@ -0,0 +1,448 @@
+package p2p
+
+import (
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/vmihailenco/msgpack"
+)
+
+var (
+	errNoVoters    = errors.New("ordered broadcasts need Voters in the network configuration")
+	errOrderedSize = errors.New("message is larger than the chunk size, which ordered broadcasts cannot exceed")
+)
+
+// Consensus agrees on a single order of entries among the voters. Every
+// voter runs one, and they talk to each other through the transport the
+// node provides. The default is Raft.
+type Consensus interface {
+	// Start is called once, before any other method. Committed entries
+	// must be passed to commit one at a time, in the same order on every
+	// voter, and with an index that grows with every entry. An entry is
+	// committed at most once across restarts, so one that was being
+	// committed when the node stopped may never be.
+	Start(t ConsensusTransport, commit func(index uint64, entry []byte))
+	// Propose asks for an entry to be ordered, and reports whether this
+	// voter took it. Voters that cannot order entries themselves, such as
+	// Raft followers, refuse it, and the entry is proposed again wherever
+	// the next leader is.
+	Propose(entry []byte) bool
+	// Receive handles a message another voter sent through the transport.
+	Receive(from string, data []byte)
+	// Leader returns the hex sign key of the voter that currently orders
+	// entries, or an empty string if there is none.
+	Leader() string
+}
+
+// ConsensusTransport carries a Consensus module's messages between voters,
+// over the node's authenticated connections.
+type ConsensusTransport interface {
+	// Self is our hex sign key.
+	Self() string
+	// Voters lists the hex sign keys of all voters, us included.
+	Voters() []string
+	// Send sends data to a voter, and reports whether we were connected to
+	// it. Messages may be lost.
+	Send(to string, data []byte) bool
+}
+
+// OrderedBroadcast broadcasts a message that every node delivers through
+// ReceiveOrdered, in the same order as all other ordered broadcasts. The
+// message floods the network like any other broadcast, until one of the
+// voters reaches the leader, which orders it and broadcasts it with its
+// position.
+//
+// Delivery stops while no majority of the voters is up. A message that is
+// not ordered within half a minute is dropped.
+func (d *DP2P) OrderedBroadcast(message []byte) (uuid.UUID, error) {
+	if d.core.ordered == nil {
+		return uuid.UUID{}, errNoVoters
+	}
+	if len(message) > d.core.config.ChunkSize {
+		return uuid.UUID{}, errOrderedSize
+	}
+	return d.core.broadcast(message, withKind("propose")), nil
+}
+
+// Voters returns the hex sign keys of the voters in the network
+// configuration, sorted. It blocks until Initialize has loaded the
+// configuration.
+func (d *DP2P) Voters() []string {
+	d.SignKey()
+	voters := []string{}
+	for _, key := range d.core.config.Voters {
+		if hexSignKey(key) {
+			voters = append(voters, key)
+		}
+	}
+	sort.Strings(voters)
+	return voters
+}
+
+// ReceiveOrdered returns the next ordered broadcast, with Message.Seq set
+// to its position. It blocks until one is ready.
+func (d *DP2P) ReceiveOrdered() Message {
+	for d.core.orderedMessages == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+	return <-*d.core.orderedMessages
+}
+
+// orderedPending is a proposal a voter holds until it is committed, so that
+// it can be proposed again if the leader changes.
+type orderedPending struct {
+	entry    []byte
+	since    time.Time
+	proposed time.Time
+}
+
+// orderedWaiting is an ordered entry waiting for the one before it.
+type orderedWaiting struct {
+	entry    orderedEntry
+	proposal orderedProposal
+	since    time.Time
+}
+
+// ordered is the total order layer. Voters run the Consensus module, and
+// deliver what it commits. The leader also broadcasts each entry with the
+// position of the entry it delivered before, which is how the other nodes
+// deliver them in the same order. A new leader broadcasts its last few
+// entries again, in case the old one failed before broadcasting them.
+//
+// Nodes that are not voters start with the first entry they see, and give
+// up on a missing entry after orderedGapTimeout.
+type ordered struct {
+	core      *core
+	consensus Consensus
+	voters    map[string]bool
+	delivered *seenCache
+
+	mu      sync.Mutex
+	pending map[string]*orderedPending
+	last    uint64
+	waiting map[uint64]orderedWaiting
+	replay  []orderedEntry
+	leading bool
+}
+
+func newOrdered(core *core) *ordered {
+	o := &ordered{
+		core:      core,
+		voters:    make(map[string]bool),
+		delivered: core.newSeenCache(),
+		pending:   make(map[string]*orderedPending),
+		waiting:   make(map[uint64]orderedWaiting),
+	}
+	for _, key := range core.config.Voters {
+		if !hexSignKey(key) {
+			core.log.Warn("Ignoring voter that is not a hex sign key", "voter", key)
+			continue
+		}
+		o.voters[key] = true
+	}
+	if o.voters[core.keys.signKeyHex()] {
+		o.consensus = core.config.Consensus
+		if o.consensus == nil {
+			o.consensus = newRaft(core)
+		}
+		o.consensus.Start(o, o.commit)
+		go o.connectLoop()
+	}
+	go o.retryLoop()
+	return o
+}
+
+// Self implements ConsensusTransport.
+func (o *ordered) Self() string {
+	return o.core.keys.signKeyHex()
+}
+
+// Voters implements ConsensusTransport.
+func (o *ordered) Voters() []string {
+	keys := []string{}
+	for key := range o.voters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Send implements ConsensusTransport.
+func (o *ordered) Send(to string, data []byte) bool {
+	for _, l := range o.core.links.byKey(to) {
+		if l.supports(capOrder) {
+			l.cast(data, o.core.newDirect(data, capOrder))
+			return true
+		}
+	}
+	return false
+}
+
+// receive hands a consensus message from a voter to our module.
+func (o *ordered) receive(from link, data []byte) {
+	if o.consensus == nil || !o.voters[from.peerKey()] {
+		o.core.log.Warn("Dropped consensus message from a node that is not a voter", "peer", from.peerKey())
+		return
+	}
+	o.consensus.Receive(from.peerKey(), data)
+}
+
+// propose holds a proposal on a voter until it is committed, and proposes
+// it if we lead.
+func (o *ordered) propose(meta broadcast, data []byte) {
+	if o.consensus == nil {
+		return
+	}
+	kind := ""
+	if meta.Kind != "propose" {
+		kind = meta.Kind
+	}
+	entry, err := msgpack.Marshal(orderedProposal{
+		Kind:      kind,
+		MessageID: meta.MessageID,
+		Origin:    meta.Origin,
+		Timestamp: meta.Timestamp,
+		Signature: meta.Signature,
+		Data:      data,
+	})
+	if err != nil {
+		o.core.log.Error("Could not encode ordered proposal", "messageID", meta.MessageID, "err", err)
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, ok := o.pending[meta.MessageID]; ok {
+		return
+	}
+	p := &orderedPending{entry: entry, since: time.Now()}
+	o.pending[meta.MessageID] = p
+	if o.consensus.Propose(entry) {
+		p.proposed = time.Now()
+	}
+}
+
+// commit delivers an entry the voters agreed on, and broadcasts it if we
+// lead.
+func (o *ordered) commit(index uint64, entry []byte) {
+	p := orderedProposal{}
+	if err := msgpack.Unmarshal(entry, &p); err != nil {
+		o.core.log.Warn("Could not decode ordered entry", "index", index, "err", err)
+		return
+	}
+
+	o.mu.Lock()
+	delete(o.pending, p.MessageID)
+	// a proposal can be committed twice when the leader changes
+	if !o.delivered.add(p.MessageID) {
+		o.mu.Unlock()
+		return
+	}
+	e := orderedEntry{Index: index, Prev: o.last, Proposal: entry}
+	o.last = index
+	o.replay = append(o.replay, e)
+	if len(o.replay) > orderedReplaySize {
+		o.replay = o.replay[1:]
+	}
+	o.deliver(index, p)
+	o.mu.Unlock()
+
+	if o.consensus.Leader() == o.Self() {
+		o.announce(e)
+	}
+}
+
+func (o *ordered) announce(e orderedEntry) {
+	data, err := msgpack.Marshal(e)
+	if err != nil {
+		o.core.log.Error("Could not encode ordered entry", "index", e.Index, "err", err)
+		return
+	}
+	o.core.broadcast(data, withKind("ordered"))
+}
+
+// sequenced handles an ordered entry broadcast by the leader, on nodes that
+// are not voters.
+func (o *ordered) sequenced(meta broadcast, data []byte) {
+	if o.consensus != nil {
+		return
+	}
+	if !o.voters[meta.Origin] {
+		o.core.log.Warn("Dropped ordered entry from a node that is not a voter", "origin", meta.Origin, "messageID", meta.MessageID)
+		return
+	}
+	e := orderedEntry{}
+	p := orderedProposal{}
+	if err := msgpack.Unmarshal(data, &e); err != nil {
+		o.core.log.Warn("Could not decode ordered entry", "origin", meta.Origin, "err", err)
+		return
+	}
+	if err := msgpack.Unmarshal(e.Proposal, &p); err != nil {
+		o.core.log.Warn("Could not decode ordered proposal", "origin", meta.Origin, "index", e.Index, "err", err)
+		return
+	}
+	proposal := broadcast{
+		Type:      "broadcast",
+		Kind:      p.Kind,
+		MessageID: p.MessageID,
+		Timestamp: p.Timestamp,
+		Origin:    p.Origin,
+		Signature: p.Signature,
+	}
+	if proposal.Kind == "" {
+		proposal.Kind = "propose"
+	}
+	if !verifyOrigin(&proposal, p.Data) {
+		o.core.log.Warn("Dropped ordered entry with a bad signature", "index", e.Index, "messageID", p.MessageID, "origin", p.Origin)
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if e.Index <= o.last {
+		return
+	}
+	if _, ok := o.waiting[e.Index]; !ok {
+		o.waiting[e.Index] = orderedWaiting{entry: e, proposal: p, since: time.Now()}
+	}
+	o.drain()
+}
+
+// drain delivers waiting entries for as long as the next one follows the
+// last one delivered.
+func (o *ordered) drain() {
+	indexes := []uint64{}
+	for index := range o.waiting {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+
+	for _, index := range indexes {
+		w := o.waiting[index]
+		if index > o.last && o.last != 0 && w.entry.Prev > o.last {
+			return
+		}
+		delete(o.waiting, index)
+		if index <= o.last {
+			continue
+		}
+		o.last = index
+		if o.delivered.add(w.proposal.MessageID) {
+			o.deliver(index, w.proposal)
+		}
+	}
+}
+
+// deliver hands an ordered entry to ReceiveOrdered, or to the channel it was
+// broadcast on.
+func (o *ordered) deliver(index uint64, p orderedProposal) {
+	m := orderedMessage(index, p)
+	if p.Kind != "channelPropose" {
+		o.core.deliverOrdered(m)
+		return
+	}
+	frame := channelFrame{}
+	if err := msgpack.Unmarshal(p.Data, &frame); err != nil {
+		o.core.log.Warn("Could not decode ordered channel frame", "index", index, "origin", p.Origin, "err", err)
+		return
+	}
+	m.Data = frame.Data
+	o.core.channels.deliverOrdered(frame.Channel, m)
+}
+
+func orderedMessage(index uint64, p orderedProposal) Message {
+	return Message{
+		ID:     p.MessageID,
+		Origin: p.Origin,
+		Time:   time.Unix(0, p.Timestamp*int64(time.Millisecond)),
+		Data:   p.Data,
+		Seq:    index,
+	}
+}
+
+// retryLoop proposes held proposals again while we lead, drops the ones
+// that were not ordered in time, and skips entries that never arrive.
+func (o *ordered) retryLoop() {
+	for range time.Tick(time.Second) {
+		leading := o.consensus != nil && o.consensus.Leader() == o.Self()
+
+		o.mu.Lock()
+		replay := []orderedEntry{}
+		if leading && !o.leading {
+			replay = append(replay, o.replay...)
+		}
+		o.leading = leading
+		for id, p := range o.pending {
+			switch {
+			case time.Since(p.since) > orderedPendingTTL:
+				o.core.log.Warn("Dropped ordered broadcast that was not ordered in time", "messageID", id)
+				delete(o.pending, id)
+			case leading && time.Since(p.proposed) > orderedRetryInterval:
+				if o.consensus.Propose(p.entry) {
+					p.proposed = time.Now()
+				}
+			}
+		}
+		o.skipGap()
+		o.mu.Unlock()
+
+		for _, e := range replay {
+			o.announce(e)
+		}
+	}
+}
+
+// skipGap stops waiting for an entry that did not arrive in time.
+func (o *ordered) skipGap() {
+	var first *orderedWaiting
+	for _, w := range o.waiting {
+		if first == nil || w.entry.Index < first.entry.Index {
+			w := w
+			first = &w
+		}
+	}
+	if first == nil || time.Since(first.since) < orderedGapTimeout {
+		return
+	}
+	if first.entry.Prev > o.last {
+		o.core.log.Warn("Skipped missing ordered entries", "after", o.last, "upTo", first.entry.Prev)
+		o.last = first.entry.Prev
+	}
+	o.drain()
+}
+
+// connectLoop keeps a voter connected to the other voters, and looks for
+// the ones missing from the peer table.
+func (o *ordered) connectLoop() {
+	for {
+		time.Sleep(orderedLinkInterval)
+		unknown := false
+		for _, key := range o.Voters() {
+			if key == o.Self() || len(o.core.links.byKey(key)) > 0 {
+				continue
+			}
+			peer := Peer{}
+			o.core.db.db.Where("sign_key = ?", key).Find(&peer)
+			if peer.SignKey == "" {
+				unknown = true
+				continue
+			}
+			if peer.Score > banScore && !o.core.clientManager.inClientList(peer) {
+				o.core.clientManager.connect(peer)
+			}
+		}
+		if unknown {
+			o.core.clientManager.discover()
+		}
+	}
+}
+
+// hexSignKey checks that a key is a hex encoded sign key.
+func hexSignKey(key string) bool {
+	b, err := hex.DecodeString(key)
+	return err == nil && len(b) == 32
+}
@@ -18,6 +18,7 @@ type Peer struct {
 	Port       int       `json:"port"`
 	SignKey    string    `json:"signKey" gorm:"unique"`
 	LastSeen   time.Time `json:"lastSeen"`
+	Score      int       `json:"-"`
 	SealKey    string    `json:"-" gorm:"-"`
 	Connected  bool      `json:"-" gorm:"-"`
 	Connecting bool      `json:"-" gorm:"-"`
@@ -25,10 +26,8 @@ type Peer struct {
 }
 
 func (p *Peer) verify(vID uuid.UUID) verifyRes {
-	log.Notice("OUT", "GET", "/verify/"+vID.String(), p.toString(false))
 	vRes, err := http.Get(p.toString(true) + "/verify/" + vID.String())
 	if err != nil {
-		log.Error(err)
 		panic(err)
 	}
 	verBody, err := ioutil.ReadAll(vRes.Body)
@@ -39,10 +38,8 @@ func (p *Peer) verify(vID uuid.UUID) verifyRes {
 }
 
 func (p *Peer) info() infoRes {
-	log.Notice("OUT", "GET", "/info", p.toString(false))
 	iRes, err := http.Get(p.toString(true) + "/info")
 	if err != nil {
-		log.Error(err)
 		panic(err)
 	}
 
@@ -54,10 +51,8 @@ func (p *Peer) info() infoRes {
 }
 
 func (p *Peer) peerList() []Peer {
-	log.Notice("OUT", "GET", "/peers", p.toString(false))
 	iRes, err := http.Get(p.toString(true) + "/peers")
 	if err != nil {
-		log.Error(err)
 		panic(err)
 	}
 
@@ -0,0 +1,372 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	errNotPermissioned = errors.New("the network has no Allowlist or Authority")
+	errNotAdmin        = errors.New("only the authority and the nodes in the allowlist can admit or revoke nodes")
+	errNotAuthority    = errors.New("this node's sign key is not the network's Authority")
+	errSignKey         = errors.New("not a hex sign key")
+)
+
+// Certificate admits a node to a permissioned network. It is signed by the
+// network's Authority.
+type Certificate struct {
+	SignKey string `msgpack:"signKey" json:"signKey"`
+	// Expires is a unix time in seconds, or zero if the certificate does
+	// not expire.
+	Expires   int64  `msgpack:"expires,omitempty" json:"expires,omitempty"`
+	Signature string `msgpack:"signature" json:"signature"`
+}
+
+// NewCertificate signs a certificate that admits the node with the given
+// hex sign key to a network, until expires. A zero expires never expires.
+// authority is the private key matching the network's Authority.
+func NewCertificate(authority ed25519.PrivateKey, networkID string, signKey string, expires time.Time) Certificate {
+	cert := Certificate{SignKey: signKey}
+	if !expires.IsZero() {
+		cert.Expires = expires.Unix()
+	}
+	cert.Signature = hex.EncodeToString(ed25519.Sign(authority, certificateDigest(networkID, cert)))
+	return cert
+}
+
+// IssueCertificate signs a certificate for the node with the given hex sign
+// key, when this node is the network's Authority.
+func (d *DP2P) IssueCertificate(signKey string, expires time.Time) (Certificate, error) {
+	if d.core.config.Authority != d.core.keys.signKeyHex() {
+		return Certificate{}, errNotAuthority
+	}
+	if !hexSignKey(signKey) {
+		return Certificate{}, errSignKey
+	}
+	return NewCertificate(d.core.keys.signKeys.Priv, d.core.config.NetworkID, signKey, expires), nil
+}
+
+// Admit lets the node with the given hex sign key into a permissioned
+// network, on every node. Only the authority and the nodes in the
+// Allowlist can admit nodes.
+func (d *DP2P) Admit(signKey string) error {
+	if d.core.permissions == nil {
+		return errNotPermissioned
+	}
+	return d.core.permissions.change(signKey, false)
+}
+
+// Revoke shuts the node with the given hex sign key out of a permissioned
+// network, on every node, even if it holds a certificate or is in the
+// Allowlist. Its connections are closed. Only the authority and the nodes
+// in the Allowlist can revoke nodes.
+func (d *DP2P) Revoke(signKey string) error {
+	if d.core.permissions == nil {
+		return errNotPermissioned
+	}
+	return d.core.permissions.change(signKey, true)
+}
+
+// admission is an admin's decision to admit or revoke a node. The
+// authority's decisions win over those of the nodes in the Allowlist, and
+// otherwise the latest one for each node wins.
+type admission struct {
+	SignKey   string `gorm:"primaryKey" msgpack:"signKey"`
+	Revoked   bool   `msgpack:"revoked,omitempty"`
+	Time      int64  `msgpack:"time"`
+	Issuer    string `msgpack:"issuer"`
+	Signature string `msgpack:"signature"`
+}
+
+func (admission) TableName() string {
+	return "admissions"
+}
+
+// permissions decides which nodes may connect in a permissioned network.
+// A node is admitted if it is the authority, is in the Allowlist, was
+// admitted at runtime, or holds a valid certificate, unless it was revoked
+// since.
+//
+// Admissions and revocations are flooded to the network, and every node
+// sends the ones it knows to each peer it connects to, so that nodes that
+// were away learn about them too.
+type permissions struct {
+	core      *core
+	allow     map[string]bool
+	authority ed25519.PublicKey
+
+	mu      sync.Mutex
+	records map[string]admission
+}
+
+func newPermissions(core *core) *permissions {
+	p := &permissions{
+		core:    core,
+		allow:   make(map[string]bool),
+		records: make(map[string]admission),
+	}
+	for _, key := range core.config.Allowlist {
+		if !hexSignKey(key) {
+			core.log.Warn("Ignoring allowlist entry that is not a hex sign key", "key", key)
+			continue
+		}
+		p.allow[key] = true
+	}
+	if core.config.Authority != "" {
+		authority, err := hex.DecodeString(core.config.Authority)
+		if err != nil || len(authority) != ed25519.PublicKeySize {
+			core.log.Error("Authority is not a hex sign key, no certificate will be accepted", "authority", core.config.Authority)
+		} else {
+			p.authority = authority
+		}
+	}
+
+	core.db.db.AutoMigrate(&admission{})
+	records := []admission{}
+	core.db.db.Find(&records)
+	for _, r := range records {
+		if p.future(r) {
+			core.log.Warn("Dropped stored admission dated in the future", "peer", r.SignKey, "issuer", r.Issuer)
+			continue
+		}
+		p.records[r.SignKey] = r
+	}
+	return p
+}
+
+// future reports whether an admission is dated further ahead than the
+// ClockSkew, which would keep it from being overridden for that long.
+func (p *permissions) future(r admission) bool {
+	return r.Time > time.Now().Add(p.core.config.ClockSkew).UnixNano()
+}
+
+// authoritative reports whether an admission was issued by the authority.
+func (p *permissions) authoritative(r admission) bool {
+	return p.authority != nil && r.Issuer == hex.EncodeToString(p.authority)
+}
+
+// supersedes reports whether an admission overrides the one we have for
+// the same node. The caller holds the lock.
+func (p *permissions) supersedes(r, existing admission) bool {
+	if p.authoritative(r) != p.authoritative(existing) {
+		return p.authoritative(r)
+	}
+	return r.Time > existing.Time
+}
+
+// admitted reports whether a node may connect, given the certificate it
+// presented, if any.
+func (c *core) admitted(signKey string, cert *Certificate) bool {
+	p := c.permissions
+	if p == nil || signKey == c.keys.signKeyHex() {
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if r, ok := p.records[signKey]; ok {
+		return !r.Revoked
+	}
+	return p.admin(signKey) || (cert != nil && p.valid(*cert, signKey))
+}
+
+// valid checks a certificate presented by the node with the given key.
+func (p *permissions) valid(cert Certificate, signKey string) bool {
+	if p.authority == nil || cert.SignKey != signKey || (cert.Expires != 0 && time.Now().Unix() > cert.Expires) {
+		return false
+	}
+	signature, err := hex.DecodeString(cert.Signature)
+	return err == nil && ed25519.Verify(p.authority, certificateDigest(p.core.config.NetworkID, cert), signature)
+}
+
+// admin reports whether a node may admit and revoke nodes. The caller holds
+// the lock.
+func (p *permissions) admin(signKey string) bool {
+	if p.authority != nil && signKey == hex.EncodeToString(p.authority) {
+		return true
+	}
+	if r, ok := p.records[signKey]; ok && r.Revoked {
+		return false
+	}
+	return p.allow[signKey]
+}
+
+func (p *permissions) change(signKey string, revoked bool) error {
+	if !hexSignKey(signKey) {
+		return errSignKey
+	}
+	self := p.core.keys.signKeyHex()
+	p.mu.Lock()
+	admin := p.admin(self)
+	p.mu.Unlock()
+	if !admin {
+		return errNotAdmin
+	}
+	r := admission{SignKey: signKey, Revoked: revoked, Time: time.Now().UnixNano(), Issuer: self}
+	r.Signature = hex.EncodeToString(ed25519.Sign(p.core.keys.signKeys.Priv, admissionDigest(p.core.config.NetworkID, r)))
+	p.apply(r)
+
+	data, err := msgpack.Marshal([]admission{r})
+	if err != nil {
+		return err
+	}
+	p.core.broadcast(data, withKind("admission"))
+	return nil
+}
+
+// apply records an admission or revocation signed by an admin, if it
+// supersedes the one we have, and closes the connections of a revoked
+// node.
+func (p *permissions) apply(r admission) {
+	signature, err := hex.DecodeString(r.Signature)
+	issuer, keyErr := hex.DecodeString(r.Issuer)
+	if err != nil || keyErr != nil || len(issuer) != ed25519.PublicKeySize || !ed25519.Verify(issuer, admissionDigest(p.core.config.NetworkID, r), signature) {
+		p.core.log.Warn("Dropped admission with a bad signature", "peer", r.SignKey, "issuer", r.Issuer)
+		return
+	}
+	if p.future(r) {
+		p.core.log.Warn("Dropped admission dated in the future", "peer", r.SignKey, "issuer", r.Issuer, "time", r.Time)
+		return
+	}
+
+	p.mu.Lock()
+	if !p.admin(r.Issuer) {
+		p.mu.Unlock()
+		p.core.log.Warn("Dropped admission from a node that is not an admin", "peer", r.SignKey, "issuer", r.Issuer)
+		return
+	}
+	if existing, ok := p.records[r.SignKey]; ok && !p.supersedes(r, existing) {
+		p.mu.Unlock()
+		return
+	}
+	p.records[r.SignKey] = r
+	p.mu.Unlock()
+
+	if err := p.core.db.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&r).Error; err != nil {
+		p.core.log.Error("Could not store admission", "peer", r.SignKey, "err", err)
+	}
+	if !r.Revoked {
+		p.core.log.Info("Node admitted", "peer", r.SignKey, "issuer", r.Issuer)
+		return
+	}
+	p.core.log.Warn("Node revoked", "peer", r.SignKey, "issuer", r.Issuer)
+	p.core.clientManager.disconnect(r.SignKey, CloseNotAdmitted, "revoked")
+	for _, l := range p.core.links.byKey(r.SignKey) {
+		if ac, ok := l.(*ActiveConnection); ok {
+			ac.reject(CloseNotAdmitted, "revoked")
+		}
+	}
+}
+
+// received handles admissions flooded to the network or sent by a peer.
+func (p *permissions) received(data []byte, from string) {
+	records := []admission{}
+	if err := msgpack.Unmarshal(data, &records); err != nil {
+		p.core.log.Warn("Could not decode admissions", "peer", from, "err", err)
+		return
+	}
+	for _, r := range records {
+		p.apply(r)
+	}
+}
+
+// joined sends a peer that just connected every admission we know.
+func (p *permissions) joined(l link) {
+	if !l.supports(capAdmission) {
+		return
+	}
+	p.mu.Lock()
+	records := make([]admission, 0, len(p.records))
+	for _, r := range p.records {
+		records = append(records, r)
+	}
+	p.mu.Unlock()
+	if len(records) == 0 {
+		return
+	}
+	data, err := msgpack.Marshal(records)
+	if err != nil {
+		p.core.log.Error("Could not encode admissions", "err", err)
+		return
+	}
+	l.cast(data, p.core.newDirect(data, capAdmission))
+}
+
+// prove adds our identity to the challenge we send a client: our keys, a
+// signature over the challenge and our seal key, and our certificate, so
+// that it can check who it connected to.
+func (c *core) prove(ch *challenge) {
+	ch.SignKey = c.keys.signKeyHex()
+	ch.SealKey = hex.EncodeToString(c.keys.sealKeys.Pub[:])
+	ch.Proof = hex.EncodeToString(ed25519.Sign(c.keys.signKeys.Priv, proofDigest(ch.Challenge, ch.SealKey)))
+	if c.config.Certificate.Signature != "" {
+		ch.Certificate = &c.config.Certificate
+	}
+}
+
+// verifyServer checks that the server a client connected to proved its
+// identity, and is admitted.
+func (c *core) verifyServer(client *client, ch challenge) (bool, string) {
+	if ch.SignKey != client.peer.SignKey {
+		return false, "server sign key does not match"
+	}
+	if ch.SealKey != client.serverInfo.PubSealKey {
+		return false, "server seal key does not match"
+	}
+	key, err := hex.DecodeString(ch.SignKey)
+	proof, proofErr := hex.DecodeString(ch.Proof)
+	if err != nil || proofErr != nil || len(key) != ed25519.PublicKeySize || !ed25519.Verify(key, proofDigest(ch.Challenge, ch.SealKey), proof) {
+		return false, "bad server proof"
+	}
+	if !c.admitted(ch.SignKey, ch.Certificate) {
+		return false, "not admitted to the network"
+	}
+	return true, ""
+}
+
+func certificateDigest(networkID string, cert Certificate) []byte {
+	digest := []byte("certificate\x00" + networkID + "\x00" + cert.SignKey + "\x00")
+	digest = append(digest, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(digest[len(digest)-8:], uint64(cert.Expires))
+	return digest
+}
+
+func admissionDigest(networkID string, r admission) []byte {
+	digest := []byte("admission\x00" + networkID + "\x00" + r.SignKey + "\x00")
+	if r.Revoked {
+		digest = append(digest, 1)
+	} else {
+		digest = append(digest, 0)
+	}
+	digest = append(digest, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(digest[len(digest)-8:], uint64(r.Time))
+	return digest
+}
+
+func proofDigest(challenge, sealKey string) []byte {
+	return []byte("server\x00" + challenge + "\x00" + sealKey)
+}
+
+// responseDigest is what a client signs to answer a challenge. It covers the
+// client's seal key and the sign key of the server it meant to reach, so that
+// the answer cannot be relayed to another server or paired with another seal
+// key.
+func responseDigest(challenge, sealKey, serverKey string) []byte {
+	return []byte("client\x00" + challenge + "\x00" + sealKey + "\x00" + serverKey)
+}
+
+// verifyResponse checks a client's signature over the challenge we sent it.
+// Clients older than protocol version 2 only sign the challenge, which
+// MinProtocolVersion can refuse.
+func (c *core) verifyResponse(r response, challenge string, signKey, signed []byte) bool {
+	if r.Version < 2 {
+		return ed25519.Verify(signKey, []byte(challenge), signed)
+	}
+	return ed25519.Verify(signKey, responseDigest(challenge, r.SealKey, c.keys.signKeyHex()), signed)
+}
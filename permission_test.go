@@ -0,0 +1,57 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+// signedAdmission is an admission of signKey issued by the node with the
+// given private key.
+func signedAdmission(networkID string, issuer ed25519.PrivateKey, signKey string, revoked bool, at time.Time) admission {
+	r := admission{
+		SignKey: signKey,
+		Revoked: revoked,
+		Time:    at.UnixNano(),
+		Issuer:  hex.EncodeToString(issuer.Public().(ed25519.PublicKey)),
+	}
+	r.Signature = hex.EncodeToString(ed25519.Sign(issuer, admissionDigest(networkID, r)))
+	return r
+}
+
+func TestAdmissionPrecedence(t *testing.T) {
+	_, authority, _ := ed25519.GenerateKey(nil)
+	_, admin, _ := ed25519.GenerateKey(nil)
+	_, node, _ := ed25519.GenerateKey(nil)
+	adminKey := hex.EncodeToString(admin.Public().(ed25519.PublicKey))
+	nodeKey := hex.EncodeToString(node.Public().(ed25519.PublicKey))
+
+	c := newTestCore(t)
+	c.config.Authority = hex.EncodeToString(authority.Public().(ed25519.PublicKey))
+	c.config.Allowlist = []string{adminKey}
+	c.permissions = newPermissions(c)
+	p := c.permissions
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		issuer  ed25519.PrivateKey
+		revoked bool
+		at      time.Time
+		want    bool
+	}{
+		{"admin admits", admin, false, now, true},
+		{"authority revokes", authority, true, now.Add(-time.Minute), false},
+		{"later admin admission does not override the authority", admin, false, now.Add(time.Second), false},
+		{"admission dated in the future is dropped", authority, false, now.Add(time.Hour), false},
+		{"later authority admission overrides", authority, false, now.Add(time.Second), true},
+		{"older authority revocation does not", authority, true, now, true},
+	}
+	for _, test := range tests {
+		p.apply(signedAdmission(c.config.NetworkID, test.issuer, nodeKey, test.revoked, test.at))
+		if got := c.admitted(nodeKey, nil); got != test.want {
+			t.Errorf("%s: admitted = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package p2p
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// plumtree implements epidemic broadcast trees. Messages are pushed eagerly
+// along a spanning tree of links and announced lazily to every other link
+// with ihave frames. A node that hears about a message it never received
+// grafts the announcing link into the tree, which is also how the tree
+// repairs itself after a link fails. A node that receives a message twice
+// prunes the second link out of the tree.
+type plumtree struct {
+	core *core
+
+	mu          sync.Mutex
+	lazy        map[link]bool
+	pending     map[link][]string
+	missing     map[string]*missingMessage
+	seen        *seenCache
+	cache       *messageCache
+	originLimit *rateLimiter
+}
+
+type missingMessage struct {
+	announcers []link
+	timer      *time.Timer
+}
+
+func newPlumtree(core *core) *plumtree {
+	t := &plumtree{
+		core:        core,
+		lazy:        make(map[link]bool),
+		pending:     make(map[link][]string),
+		missing:     make(map[string]*missingMessage),
+		seen:        core.newSeenCache(),
+		cache:       newMessageCache(treeCacheSize, core.config.ClockSkew),
+		originLimit: newRateLimiter(core.config.OriginRate, core.config.OriginBurst),
+	}
+	go t.flushLoop()
+	return t
+}
+
+// join adds a new link to the tree. Links start out eager.
+func (t *plumtree) join(l link) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.lazy, l)
+}
+
+// leave forgets a link that went down. Messages it was eagerly pushing to us
+// will now be grafted from the links that announce them.
+func (t *plumtree) leave(l link) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.lazy, l)
+	delete(t.pending, l)
+	for _, m := range t.missing {
+		for i, announcer := range m.announcers {
+			if announcer == l {
+				m.announcers = append(m.announcers[:i], m.announcers[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// broadcast sends a message originating from this node.
+func (t *plumtree) broadcast(msg []byte, meta broadcast) {
+	t.seen.add(meta.MessageID)
+	t.cache.store(msg, meta)
+	t.core.accept(msg, meta)
+	t.push(nil, msg, meta)
+}
+
+// receive handles a broadcast that arrived on from.
+func (t *plumtree) receive(from link, msg []byte, meta broadcast) {
+	t.core.arrived(from, &meta)
+	if !t.seen.add(meta.MessageID) {
+		if from.supports(capTree) {
+			t.mu.Lock()
+			t.lazy[from] = true
+			t.mu.Unlock()
+
+			byteMessage, _ := msgpack.Marshal(message{Type: "prune"})
+			from.send(byteMessage)
+		}
+		t.core.dropped(from, meta, "duplicate")
+		return
+	}
+
+	t.mu.Lock()
+	if m, ok := t.missing[meta.MessageID]; ok {
+		m.timer.Stop()
+		delete(t.missing, meta.MessageID)
+	}
+	t.mu.Unlock()
+
+	if !t.originLimit.allow(meta.Origin) {
+		t.core.log.Warn("Origin exceeded its rate limit", "origin", meta.Origin, "messageID", meta.MessageID)
+		t.core.dropped(from, meta, "rate limited")
+		return
+	}
+
+	t.core.log.Info("CAST", "messageID", meta.MessageID, "origin", meta.Origin, "peer", from.peerKey())
+	t.core.accept(msg, meta)
+
+	relay, ok := t.core.relay(meta)
+	if !ok {
+		return
+	}
+	t.cache.store(msg, relay)
+	t.push(from, msg, relay)
+	t.core.relayed(relay)
+}
+
+// push sends msg to every eager link and queues an announcement for every
+// lazy one, skipping the link it came from.
+func (t *plumtree) push(from link, msg []byte, meta broadcast) {
+	eager := []link{}
+
+	t.mu.Lock()
+	for _, l := range t.core.links.all() {
+		if l == from {
+			continue
+		}
+		// links without the tree capability flood, so they stay eager, and
+		// retries of reliable broadcasts flood to route around the tree
+		if t.lazy[l] && l.supports(capTree) && meta.Ref == "" {
+			// announcements are only a repair path, so a link that falls
+			// this far behind misses some rather than holding them all
+			if len(t.pending[l]) < treeAnnounceSize {
+				t.pending[l] = append(t.pending[l], meta.MessageID)
+			}
+		} else {
+			eager = append(eager, l)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, l := range eager {
+		l.cast(msg, meta)
+	}
+}
+
+// handle processes the tree control frames.
+func (t *plumtree) handle(from link, msgType string, data []byte) {
+	switch msgType {
+	case "ihave":
+		ihave := ihave{}
+		if err := msgpack.Unmarshal(data, &ihave); err != nil {
+			t.core.log.Error("Could not decode ihave", "peer", from.peerKey(), "err", err)
+			return
+		}
+		t.ihave(from, ihave.MessageIDs)
+	case "graft":
+		graft := graft{}
+		if err := msgpack.Unmarshal(data, &graft); err != nil {
+			t.core.log.Error("Could not decode graft", "peer", from.peerKey(), "err", err)
+			return
+		}
+		t.graft(from, graft.MessageID)
+	case "prune":
+		t.mu.Lock()
+		t.lazy[from] = true
+		t.mu.Unlock()
+	}
+}
+
+// ihave waits for the announced messages we have not received. Only the first
+// treeAnnounceSize IDs of a frame are read, and announcements of new messages
+// are dropped while treeMissingSize messages are already missing, so a peer
+// cannot make us keep an unbounded number of timers.
+func (t *plumtree) ihave(from link, messageIDs []string) {
+	if len(messageIDs) > treeAnnounceSize {
+		t.core.log.Debug("Truncated ihave", "peer", from.peerKey(), "count", len(messageIDs))
+		messageIDs = messageIDs[:treeAnnounceSize]
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, messageID := range messageIDs {
+		if t.seen.contains(messageID) {
+			continue
+		}
+		m, ok := t.missing[messageID]
+		if ok && announced(m, from) {
+			continue
+		}
+		if !ok {
+			if len(t.missing) >= treeMissingSize {
+				continue
+			}
+			id := messageID
+			m = &missingMessage{}
+			m.timer = time.AfterFunc(treeGraftTimeout, func() { t.timeout(id) })
+			t.missing[messageID] = m
+		}
+		m.announcers = append(m.announcers, from)
+	}
+}
+
+// announced reports whether l already announced a missing message.
+func announced(m *missingMessage, l link) bool {
+	for _, announcer := range m.announcers {
+		if announcer == l {
+			return true
+		}
+	}
+	return false
+}
+
+// timeout grafts the next link that announced a message we still have not
+// received, and waits for it a little less long than for the first one.
+func (t *plumtree) timeout(messageID string) {
+	t.mu.Lock()
+	m, ok := t.missing[messageID]
+	if !ok {
+		t.mu.Unlock()
+		return
+	}
+	if t.seen.contains(messageID) || len(m.announcers) == 0 {
+		delete(t.missing, messageID)
+		t.mu.Unlock()
+		return
+	}
+	l := m.announcers[0]
+	m.announcers = m.announcers[1:]
+	delete(t.lazy, l)
+	m.timer = time.AfterFunc(treeGraftTimeout/2, func() { t.timeout(messageID) })
+	t.mu.Unlock()
+
+	t.core.log.Debug("Grafting", "peer", l.peerKey(), "host", l.toString(), "messageID", messageID)
+	byteMessage, _ := msgpack.Marshal(graft{Type: "graft", MessageID: messageID})
+	l.send(byteMessage)
+}
+
+func (t *plumtree) graft(from link, messageID string) {
+	t.mu.Lock()
+	delete(t.lazy, from)
+	t.mu.Unlock()
+
+	if msg, meta, ok := t.cache.get(messageID); ok {
+		from.cast(msg, meta)
+	}
+}
+
+func (t *plumtree) flushLoop() {
+	for {
+		time.Sleep(treeLazyInterval)
+
+		t.mu.Lock()
+		pending := t.pending
+		t.pending = make(map[link][]string)
+		t.mu.Unlock()
+
+		for l, messageIDs := range pending {
+			byteMessage, err := msgpack.Marshal(ihave{Type: "ihave", MessageIDs: messageIDs})
+			if err != nil {
+				t.core.log.Error("Could not encode ihave", "err", err)
+				continue
+			}
+			l.send(byteMessage)
+		}
+	}
+}
+
+// messageCache keeps recently relayed messages so they can be sent to links
+// that graft them.
+type messageCache struct {
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	order    *list.List
+	capacity int
+	ttl      time.Duration
+}
+
+type cachedMessage struct {
+	msg    []byte
+	meta   broadcast
+	stored time.Time
+}
+
+func newMessageCache(capacity int, ttl time.Duration) *messageCache {
+	return &messageCache{
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		capacity: capacity,
+		ttl:      ttl,
+	}
+}
+
+func (c *messageCache) store(msg []byte, meta broadcast) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[meta.MessageID]; ok {
+		return
+	}
+	c.entries[meta.MessageID] = c.order.PushBack(cachedMessage{msg: msg, meta: meta, stored: time.Now()})
+	for c.order.Len() > c.capacity {
+		c.evict(c.order.Front())
+	}
+}
+
+func (c *messageCache) get(messageID string) ([]byte, broadcast, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for e := c.order.Front(); e != nil && time.Since(e.Value.(cachedMessage).stored) > c.ttl; e = c.order.Front() {
+		c.evict(e)
+	}
+	e, ok := c.entries[messageID]
+	if !ok {
+		return nil, broadcast{}, false
+	}
+	cached := e.Value.(cachedMessage)
+	return cached.msg, cached.meta, true
+}
+
+func (c *messageCache) evict(e *list.Element) {
+	delete(c.entries, e.Value.(cachedMessage).meta.MessageID)
+	c.order.Remove(e)
+}
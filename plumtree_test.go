@@ -0,0 +1,42 @@
+package p2p
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestPlumtreeBoundsMissingMessages(t *testing.T) {
+	tree := newPlumtree(newTestCore(t))
+	announcer := &testLink{key: "announcer"}
+	missing := func() int {
+		tree.mu.Lock()
+		defer tree.mu.Unlock()
+		return len(tree.missing)
+	}
+
+	for frame := 0; missing() < treeMissingSize; frame++ {
+		ids := []string{}
+		for i := 0; i < 2*treeAnnounceSize; i++ {
+			ids = append(ids, strconv.Itoa(frame)+"-"+strconv.Itoa(i))
+		}
+		before := missing()
+		tree.ihave(announcer, ids)
+		if read := missing() - before; read > treeAnnounceSize {
+			t.Fatalf("read %d IDs from one ihave, want at most %d", read, treeAnnounceSize)
+		}
+	}
+
+	tree.ihave(announcer, []string{"one more"})
+	if n := missing(); n != treeMissingSize {
+		t.Fatalf("%d messages are missing, want at most %d", n, treeMissingSize)
+	}
+
+	// announcing the same message again does not grow its announcers
+	tree.ihave(announcer, []string{"0-0"})
+	tree.mu.Lock()
+	n := len(tree.missing["0-0"].announcers)
+	tree.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("0-0 has %d announcers, want 1", n)
+	}
+}
@@ -0,0 +1,172 @@
+package p2p
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// protocolVersion is the version of the wire protocol spoken by this node.
+// It is bumped whenever a frame changes in a way older nodes cannot handle.
+// Features that older nodes can simply ignore are advertised as
+// capabilities instead, and only used on links where both sides have them.
+//
+// Version 2 clients sign their seal key and the server's sign key along with
+// the challenge.
+const protocolVersion = 2
+
+// minProtocolVersion is the oldest protocol version we still talk to, unless
+// the configuration raises it.
+const minProtocolVersion = 1
+
+const (
+	// capStream is support for chunked streams, both broadcast and direct.
+	capStream = "stream"
+	// capTree is support for the Plumtree control frames.
+	capTree = "tree"
+	// capTrace is support for trace reports sent back to a broadcast's
+	// origin.
+	capTrace = "trace"
+	// capAck is support for acknowledging reliable broadcasts.
+	capAck = "ack"
+	// capSync is support for catching up from the message history.
+	capSync = "sync"
+	// capOrder is support for the consensus frames voters exchange to
+	// order ordered broadcasts.
+	capOrder = "order"
+	// capChannel is support for channel messages sent to a single peer.
+	capChannel = "channel"
+	// capBlob is support for fetching blobs.
+	capBlob = "blob"
+	// capMembership is support for the SWIM membership probes.
+	capMembership = "swim"
+	// capAdmission is support for syncing admissions in permissioned
+	// networks.
+	capAdmission = "admission"
+)
+
+// capabilities lists the optional features this node supports.
+func (c *core) capabilities() []string {
+	caps := []string{capStream, capTrace, capAck, capChannel, capBlob}
+	if c.config.BroadcastTree {
+		caps = append(caps, capTree)
+	}
+	if c.config.History {
+		caps = append(caps, capSync)
+	}
+	if len(c.config.Voters) > 0 {
+		caps = append(caps, capOrder)
+	}
+	if c.config.Membership {
+		caps = append(caps, capMembership)
+	}
+	if c.permissions != nil {
+		caps = append(caps, capAdmission)
+	}
+	return caps
+}
+
+// capabilitySet holds the features both sides of a link advertised.
+type capabilitySet map[string]bool
+
+// negotiate intersects our capabilities with the ones a peer advertised.
+func (c *core) negotiate(theirs []string) capabilitySet {
+	set := capabilitySet{}
+	for _, ours := range c.capabilities() {
+		for _, cap := range theirs {
+			if cap == ours {
+				set[ours] = true
+			}
+		}
+	}
+	return set
+}
+
+func (s capabilitySet) list() []string {
+	caps := []string{}
+	for cap := range s {
+		caps = append(caps, cap)
+	}
+	sort.Strings(caps)
+	return caps
+}
+
+// compatible checks a peer's protocol version against our policy, and
+// returns the reason for refusing it if it is too old.
+func (c *core) compatible(version int) (bool, string) {
+	if version < c.config.MinProtocolVersion {
+		return false, "protocol version " + strconv.Itoa(version) + " is older than the minimum of " + strconv.Itoa(c.config.MinProtocolVersion)
+	}
+	return true, ""
+}
+
+// CloseCode is the machine readable reason sent in a close frame before a
+// connection is dropped.
+type CloseCode int
+
+// The reasons a connection can be closed for.
+const (
+	CloseNormal CloseCode = iota
+	CloseWrongNetwork
+	CloseIncompatible
+	CloseBadSignature
+	CloseUnauthenticated
+	CloseAuthTimeout
+	CloseProtocolError
+	CloseBanned
+	// CloseNotAdmitted refuses a node that is not admitted to a
+	// permissioned network, or was revoked.
+	CloseNotAdmitted
+	// CloseBadPuzzle refuses a client that did not solve the puzzle in the
+	// challenge.
+	CloseBadPuzzle
+)
+
+func (code CloseCode) String() string {
+	switch code {
+	case CloseNormal:
+		return "normal"
+	case CloseWrongNetwork:
+		return "wrong network"
+	case CloseIncompatible:
+		return "incompatible protocol"
+	case CloseBadSignature:
+		return "bad signature"
+	case CloseUnauthenticated:
+		return "unauthenticated"
+	case CloseAuthTimeout:
+		return "authentication timeout"
+	case CloseProtocolError:
+		return "protocol error"
+	case CloseBanned:
+		return "banned"
+	case CloseNotAdmitted:
+		return "not admitted"
+	case CloseBadPuzzle:
+		return "bad puzzle solution"
+	default:
+		return "unknown (" + strconv.Itoa(int(code)) + ")"
+	}
+}
+
+// penalty is how much being refused for this reason lowers the score of the
+// peer that refused us. Most reasons name something wrong on our side, such
+// as a bad signature, a network ID that differs from theirs or a ban they
+// put on us, and those do not count against the peer. A peer that speaks a
+// protocol we do not is of no use to us, so it quickly drops below banScore
+// and is no longer dialed.
+func (code CloseCode) penalty() int {
+	switch code {
+	case CloseIncompatible:
+		return banScore / 2
+	default:
+		return 0
+	}
+}
+
+// closeWith tells the other side of a connection why it is being closed.
+func closeWith(l interface{ sendNow([]byte) }, code CloseCode, reason string) {
+	byteMessage, _ := msgpack.Marshal(closeFrame{Type: "close", Code: code, Reason: reason})
+	l.sendNow(byteMessage)
+}
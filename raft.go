@@ -0,0 +1,575 @@
+package p2p
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+	"gorm.io/gorm"
+)
+
+// raftState is what a voter must not forget across restarts. Entries up to
+// SnapshotIndex were applied and dropped from the log.
+type raftState struct {
+	ID            uint `gorm:"primaryKey"`
+	Term          uint64
+	VotedFor      string
+	Applied       uint64
+	SnapshotIndex uint64
+	SnapshotTerm  uint64
+}
+
+func (raftState) TableName() string {
+	return "raft_state"
+}
+
+// raftEntry is an entry of the replicated log. Entries without data are
+// appended by new leaders and are not passed on.
+type raftEntry struct {
+	Index uint64 `gorm:"primaryKey;autoIncrement:false;column:log_index" msgpack:"index"`
+	Term  uint64 `msgpack:"term"`
+	Data  []byte `msgpack:"data"`
+}
+
+func (raftEntry) TableName() string {
+	return "raft_entries"
+}
+
+type raftRole int
+
+const (
+	raftFollower raftRole = iota
+	raftCandidate
+	raftLeader
+)
+
+// raft is the default Consensus, a Raft log replicated among the voters and
+// kept in the database next to the peer table.
+//
+// The log only needs to hold entries until they are applied, so it is cut
+// down to the newest raftLogRetain applied entries as it grows, but never
+// past the entries every voter has, which the leader tells the others. A
+// voter that is down holds the log back until it returns. Only a voter
+// that lost its log falls behind the start of the leader's, and it skips
+// the entries it missed and starts over from the leader's log.
+type raft struct {
+	core      *core
+	db        *gorm.DB
+	transport ConsensusTransport
+	commit    func(index uint64, entry []byte)
+
+	mu          sync.Mutex
+	state       raftState
+	log         []raftEntry
+	role        raftRole
+	leader      string
+	commitIndex uint64
+	// held is the highest index every voter has, as far as the log may be
+	// cut. Followers learn it from the leader.
+	held        uint64
+	deadline    time.Time
+	heartbeat   time.Time
+	votes       map[string]bool
+	next        map[string]uint64
+	match       map[string]uint64
+	outbox      []raftOutbound
+	applySignal chan struct{}
+}
+
+type raftOutbound struct {
+	to  string
+	msg raftMessage
+}
+
+func newRaft(core *core) *raft {
+	core.db.db.AutoMigrate(&raftState{}, &raftEntry{})
+	return &raft{core: core, db: core.db.db, applySignal: make(chan struct{}, 1)}
+}
+
+// Start loads the persisted state and starts following.
+func (r *raft) Start(t ConsensusTransport, commit func(index uint64, entry []byte)) {
+	r.mu.Lock()
+	r.transport = t
+	r.commit = commit
+	r.db.FirstOrCreate(&r.state, raftState{ID: 1})
+	r.db.Where("log_index > ?", r.state.SnapshotIndex).Order("log_index").Find(&r.log)
+	r.commitIndex = r.state.Applied
+	r.resetDeadline()
+	r.mu.Unlock()
+
+	go r.run()
+	go r.applyLoop()
+}
+
+// Propose appends an entry to the log if we lead.
+func (r *raft) Propose(entry []byte) bool {
+	r.mu.Lock()
+	if r.role != raftLeader {
+		r.mu.Unlock()
+		return false
+	}
+	r.append([]raftEntry{{Index: r.lastIndex() + 1, Term: r.state.Term, Data: entry}})
+	r.replicate()
+	r.advanceCommit()
+	out := r.flush()
+	r.mu.Unlock()
+	r.send(out)
+	return true
+}
+
+// Leader returns the sign key of the voter we last heard from as leader.
+func (r *raft) Leader() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.leader
+}
+
+// Receive handles a Raft message from another voter.
+func (r *raft) Receive(from string, data []byte) {
+	m := raftMessage{}
+	if err := msgpack.Unmarshal(data, &m); err != nil {
+		r.core.log.Warn("Could not decode consensus message", "peer", from, "err", err)
+		return
+	}
+
+	r.mu.Lock()
+	if m.Term > r.state.Term {
+		r.stepDown(m.Term)
+	}
+	switch m.Type {
+	case "vote":
+		r.vote(from, m)
+	case "voteReply":
+		if r.role == raftCandidate && m.Term == r.state.Term && m.Granted {
+			r.votes[from] = true
+			if r.won() {
+				r.lead()
+			}
+		}
+	case "append":
+		r.appendFrom(from, m)
+	case "install":
+		r.install(from, m)
+	case "appendReply":
+		r.replied(from, m)
+	default:
+		r.core.log.Warn("Unsupported consensus message", "type", m.Type, "peer", from)
+	}
+	out := r.flush()
+	r.mu.Unlock()
+	r.send(out)
+}
+
+func (r *raft) run() {
+	for range time.Tick(raftTick) {
+		r.mu.Lock()
+		if r.role == raftLeader {
+			if time.Since(r.heartbeat) >= raftHeartbeat {
+				r.replicate()
+			}
+		} else if time.Now().After(r.deadline) {
+			r.campaign()
+		}
+		out := r.flush()
+		r.mu.Unlock()
+		r.send(out)
+	}
+}
+
+// applyLoop passes committed entries on in order, outside of the lock.
+func (r *raft) applyLoop() {
+	for range r.applySignal {
+		for {
+			r.mu.Lock()
+			if r.state.Applied >= r.commitIndex {
+				r.mu.Unlock()
+				break
+			}
+			index := r.state.Applied + 1
+			entry := r.entry(index)
+			// the entry is saved as applied before it is committed, so that
+			// a crash in between loses it rather than committing it twice
+			r.state.Applied = index
+			r.compact()
+			r.persist()
+			r.mu.Unlock()
+
+			if len(entry.Data) > 0 {
+				r.commit(index, entry.Data)
+			}
+		}
+	}
+}
+
+func (r *raft) signalApply() {
+	select {
+	case r.applySignal <- struct{}{}:
+	default:
+	}
+}
+
+func (r *raft) self() string {
+	return r.transport.Self()
+}
+
+func (r *raft) others() []string {
+	others := []string{}
+	for _, key := range r.transport.Voters() {
+		if key != r.self() {
+			others = append(others, key)
+		}
+	}
+	return others
+}
+
+func (r *raft) quorum() int {
+	return len(r.transport.Voters())/2 + 1
+}
+
+func (r *raft) lastIndex() uint64 {
+	return r.state.SnapshotIndex + uint64(len(r.log))
+}
+
+func (r *raft) lastTerm() uint64 {
+	return r.termAt(r.lastIndex())
+}
+
+// termAt returns the term of the entry at index, or 0 if it is not in the
+// log.
+func (r *raft) termAt(index uint64) uint64 {
+	if index == r.state.SnapshotIndex {
+		return r.state.SnapshotTerm
+	}
+	if index < r.state.SnapshotIndex || index > r.lastIndex() {
+		return 0
+	}
+	return r.entry(index).Term
+}
+
+func (r *raft) entry(index uint64) raftEntry {
+	return r.log[index-r.state.SnapshotIndex-1]
+}
+
+func (r *raft) persist() {
+	r.db.Save(&r.state)
+}
+
+func (r *raft) append(entries []raftEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	r.db.Create(&entries)
+	r.log = append(r.log, entries...)
+}
+
+// truncate drops the entries from index on, which conflict with the
+// leader's log.
+func (r *raft) truncate(index uint64) {
+	r.db.Where("log_index >= ?", index).Delete(&raftEntry{})
+	r.log = r.log[:index-r.state.SnapshotIndex-1]
+}
+
+// compact drops applied entries once the log holds twice as many as it
+// retains, down to the entries every voter has.
+func (r *raft) compact() {
+	if r.state.Applied-r.state.SnapshotIndex <= 2*raftLogRetain {
+		return
+	}
+	cut := r.state.Applied - raftLogRetain
+	if held := r.heldByAll(); cut > held {
+		cut = held
+	}
+	// a voter that lags behind would otherwise have the log cut an entry
+	// at a time as it catches up
+	if cut < r.state.SnapshotIndex+raftLogRetain {
+		return
+	}
+	r.state.SnapshotTerm = r.termAt(cut)
+	r.log = append([]raftEntry{}, r.log[cut-r.state.SnapshotIndex:]...)
+	r.state.SnapshotIndex = cut
+	r.db.Where("log_index <= ?", cut).Delete(&raftEntry{})
+}
+
+// heldByAll returns the highest index every voter has. The leader knows it
+// from the voters' matches.
+func (r *raft) heldByAll() uint64 {
+	if r.role != raftLeader {
+		return r.held
+	}
+	held := r.lastIndex()
+	for _, key := range r.others() {
+		if r.match[key] < held {
+			held = r.match[key]
+		}
+	}
+	return held
+}
+
+func (r *raft) resetDeadline() {
+	r.deadline = time.Now().Add(raftElectionTimeout + time.Duration(rand.Int63n(int64(raftElectionTimeout))))
+}
+
+func (r *raft) queue(to string, m raftMessage) {
+	r.outbox = append(r.outbox, raftOutbound{to: to, msg: m})
+}
+
+func (r *raft) flush() []raftOutbound {
+	out := r.outbox
+	r.outbox = nil
+	return out
+}
+
+// send writes queued messages once the lock is released.
+func (r *raft) send(out []raftOutbound) {
+	for _, o := range out {
+		data, err := msgpack.Marshal(o.msg)
+		if err != nil {
+			r.core.log.Error("Could not encode consensus message", "type", o.msg.Type, "err", err)
+			continue
+		}
+		r.transport.Send(o.to, data)
+	}
+}
+
+// stepDown moves to a newer term as a follower.
+func (r *raft) stepDown(term uint64) {
+	if r.role == raftLeader {
+		r.core.log.Info("Stepped down as leader", "term", term)
+	}
+	r.state.Term = term
+	r.state.VotedFor = ""
+	r.persist()
+	r.role = raftFollower
+	r.leader = ""
+}
+
+// follow accepts a peer as leader of the current term.
+func (r *raft) follow(leader string) {
+	r.role = raftFollower
+	if r.leader != leader {
+		r.leader = leader
+		r.core.log.Info("Following leader", "peer", leader, "term", r.state.Term)
+	}
+	r.resetDeadline()
+}
+
+func (r *raft) campaign() {
+	r.state.Term++
+	r.state.VotedFor = r.self()
+	r.persist()
+	r.role = raftCandidate
+	r.leader = ""
+	r.votes = map[string]bool{r.self(): true}
+	r.resetDeadline()
+	r.core.log.Debug("Starting election", "term", r.state.Term)
+
+	if r.won() {
+		r.lead()
+		return
+	}
+	for _, key := range r.others() {
+		r.queue(key, raftMessage{Type: "vote", Term: r.state.Term, LastIndex: r.lastIndex(), LastTerm: r.lastTerm()})
+	}
+}
+
+func (r *raft) won() bool {
+	return len(r.votes) >= r.quorum()
+}
+
+// lead takes over as leader, and appends an empty entry to commit the
+// entries left by earlier terms.
+func (r *raft) lead() {
+	r.role = raftLeader
+	r.leader = r.self()
+	r.next = make(map[string]uint64)
+	r.match = make(map[string]uint64)
+	for _, key := range r.others() {
+		r.next[key] = r.lastIndex() + 1
+	}
+	r.core.log.Info("Elected leader", "term", r.state.Term)
+
+	r.append([]raftEntry{{Index: r.lastIndex() + 1, Term: r.state.Term}})
+	r.replicate()
+	r.advanceCommit()
+}
+
+func (r *raft) vote(from string, m raftMessage) {
+	upToDate := m.LastTerm > r.lastTerm() || (m.LastTerm == r.lastTerm() && m.LastIndex >= r.lastIndex())
+	granted := m.Term == r.state.Term && (r.state.VotedFor == "" || r.state.VotedFor == from) && upToDate
+	if granted {
+		r.state.VotedFor = from
+		r.persist()
+		r.resetDeadline()
+	}
+	r.queue(from, raftMessage{Type: "voteReply", Term: r.state.Term, Granted: granted})
+}
+
+// replicate sends every other voter the entries it is missing, or a
+// heartbeat if it has them all.
+func (r *raft) replicate() {
+	r.heartbeat = time.Now()
+	for _, key := range r.others() {
+		r.sendAppend(key)
+	}
+}
+
+func (r *raft) sendAppend(to string) {
+	next := r.next[to]
+	if next <= r.state.SnapshotIndex {
+		r.queue(to, raftMessage{Type: "install", Term: r.state.Term, PrevIndex: r.state.SnapshotIndex, PrevTerm: r.state.SnapshotTerm})
+		return
+	}
+	entries := []raftEntry{}
+	size := 0
+	for i := next; i <= r.lastIndex() && len(entries) < raftBatchSize; i++ {
+		e := r.entry(i)
+		if len(entries) > 0 && size+len(e.Data) > r.core.config.ChunkSize {
+			break
+		}
+		entries = append(entries, e)
+		size += len(e.Data)
+	}
+	r.queue(to, raftMessage{
+		Type:      "append",
+		Term:      r.state.Term,
+		PrevIndex: next - 1,
+		PrevTerm:  r.termAt(next - 1),
+		Entries:   entries,
+		Commit:    r.commitIndex,
+		Held:      r.heldByAll(),
+	})
+}
+
+func (r *raft) appendFrom(from string, m raftMessage) {
+	if m.Term < r.state.Term {
+		r.queue(from, raftMessage{Type: "appendReply", Term: r.state.Term, Match: r.lastIndex()})
+		return
+	}
+	r.follow(from)
+
+	// entries we already applied and dropped match the leader's
+	entries := m.Entries
+	prevIndex, prevTerm := m.PrevIndex, m.PrevTerm
+	for len(entries) > 0 && entries[0].Index <= r.state.SnapshotIndex {
+		prevIndex, prevTerm = entries[0].Index, entries[0].Term
+		entries = entries[1:]
+	}
+	if prevIndex < r.state.SnapshotIndex {
+		r.queue(from, raftMessage{Type: "appendReply", Term: r.state.Term, Success: true, Match: r.state.SnapshotIndex})
+		return
+	}
+	if prevIndex > r.lastIndex() || r.termAt(prevIndex) != prevTerm {
+		hint := r.lastIndex()
+		if prevIndex <= hint {
+			hint = prevIndex - 1
+		}
+		r.queue(from, raftMessage{Type: "appendReply", Term: r.state.Term, Match: hint})
+		return
+	}
+
+	match := prevIndex + uint64(len(entries))
+	for len(entries) > 0 && entries[0].Index <= r.lastIndex() {
+		if r.termAt(entries[0].Index) != entries[0].Term {
+			r.truncate(entries[0].Index)
+			break
+		}
+		entries = entries[1:]
+	}
+	r.append(entries)
+
+	if m.Held > r.held {
+		r.held = m.Held
+	}
+	// the leader's commit index only covers the entries it sent us, and
+	// ours never moves back
+	commit := m.Commit
+	if commit > match {
+		commit = match
+	}
+	if commit > r.commitIndex {
+		r.commitIndex = commit
+		r.signalApply()
+	}
+	r.queue(from, raftMessage{Type: "appendReply", Term: r.state.Term, Success: true, Match: match})
+}
+
+// install moves a voter that fell behind the start of the leader's log up to
+// it, which only happens to a voter that lost its log. The entries in
+// between are skipped.
+func (r *raft) install(from string, m raftMessage) {
+	if m.Term < r.state.Term {
+		r.queue(from, raftMessage{Type: "appendReply", Term: r.state.Term, Match: r.lastIndex()})
+		return
+	}
+	r.follow(from)
+
+	if m.PrevIndex > r.state.SnapshotIndex {
+		if r.termAt(m.PrevIndex) == m.PrevTerm {
+			r.log = append([]raftEntry{}, r.log[m.PrevIndex-r.state.SnapshotIndex:]...)
+			r.db.Where("log_index <= ?", m.PrevIndex).Delete(&raftEntry{})
+		} else {
+			r.log = nil
+			r.db.Where("log_index > ?", 0).Delete(&raftEntry{})
+		}
+		r.state.SnapshotIndex, r.state.SnapshotTerm = m.PrevIndex, m.PrevTerm
+		if r.state.Applied < m.PrevIndex {
+			r.core.log.Warn("Skipped ordered entries that were dropped from the leader's log", "from", r.state.Applied+1, "to", m.PrevIndex)
+			r.state.Applied = m.PrevIndex
+		}
+		if r.commitIndex < m.PrevIndex {
+			r.commitIndex = m.PrevIndex
+		}
+		r.persist()
+	}
+	r.queue(from, raftMessage{Type: "appendReply", Term: r.state.Term, Success: true, Match: m.PrevIndex})
+}
+
+func (r *raft) replied(from string, m raftMessage) {
+	if r.role != raftLeader || m.Term != r.state.Term {
+		return
+	}
+	if !m.Success {
+		next := r.next[from] - 1
+		if m.Match+1 < next {
+			next = m.Match + 1
+		}
+		if next < 1 {
+			next = 1
+		}
+		r.next[from] = next
+		r.sendAppend(from)
+		return
+	}
+	if m.Match > r.match[from] {
+		r.match[from] = m.Match
+	}
+	if r.next[from] <= m.Match {
+		r.next[from] = m.Match + 1
+	}
+	r.advanceCommit()
+	if r.next[from] <= r.lastIndex() {
+		r.sendAppend(from)
+	}
+}
+
+// advanceCommit commits the newest entry of the current term that a
+// majority of the voters have.
+func (r *raft) advanceCommit() {
+	for n := r.lastIndex(); n > r.commitIndex && n > r.state.SnapshotIndex; n-- {
+		if r.termAt(n) != r.state.Term {
+			return
+		}
+		count := 1
+		for _, key := range r.others() {
+			if r.match[key] >= n {
+				count++
+			}
+		}
+		if count >= r.quorum() {
+			r.commitIndex = n
+			r.signalApply()
+			return
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package p2p
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// raftNetwork connects Raft voters in process. Each link delivers messages
+// in order from its own queue, and drops them when the queue is full, like a
+// connection's send queue. Voters can be cut off from the others.
+type raftNetwork struct {
+	mu      sync.Mutex
+	voters  []string
+	nodes   map[string]*raft
+	links   map[string]chan []byte
+	down    map[string]bool
+	commits map[string][]string
+}
+
+// raftLinkQueue is how many messages a link holds before it drops them.
+const raftLinkQueue = 256
+
+// raftTransport is a voter's view of the raftNetwork.
+type raftTransport struct {
+	network *raftNetwork
+	self    string
+}
+
+func (t raftTransport) Self() string {
+	return t.self
+}
+
+func (t raftTransport) Voters() []string {
+	return t.network.voters
+}
+
+func (t raftTransport) Send(to string, data []byte) bool {
+	n := t.network
+	n.mu.Lock()
+	link, ok := n.links[t.self+"/"+to]
+	connected := ok && !n.down[t.self] && !n.down[to]
+	n.mu.Unlock()
+	if !connected {
+		return false
+	}
+	select {
+	case link <- data:
+	default:
+	}
+	return true
+}
+
+func newRaftNetwork(t *testing.T, size int) *raftNetwork {
+	n := &raftNetwork{
+		nodes:   make(map[string]*raft),
+		links:   make(map[string]chan []byte),
+		down:    make(map[string]bool),
+		commits: make(map[string][]string),
+	}
+	for i := 0; i < size; i++ {
+		n.voters = append(n.voters, fmt.Sprintf("voter%d", i))
+	}
+	for _, key := range n.voters {
+		path := filepath.Join(t.TempDir(), "p2p.sqlite") + "?_sync=0&_journal=WAL"
+		database, err := gorm.Open(sqlite.Open(path), &gorm.Config{Logger: logger.Discard})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &core{
+			config: NetworkConfig{ChunkSize: defaultChunkSize},
+			log:    newTextLogger(NetworkConfig{}),
+			db:     db{db: database},
+		}
+		n.nodes[key] = newRaft(c)
+	}
+	for _, from := range n.voters {
+		for _, to := range n.voters {
+			link := make(chan []byte, raftLinkQueue)
+			n.links[from+"/"+to] = link
+			go func(from, to string) {
+				for data := range link {
+					n.mu.Lock()
+					connected := !n.down[from] && !n.down[to]
+					n.mu.Unlock()
+					if connected {
+						n.nodes[to].Receive(from, data)
+					}
+				}
+			}(from, to)
+		}
+	}
+	for _, key := range n.voters {
+		key := key
+		n.nodes[key].Start(raftTransport{network: n, self: key}, func(index uint64, entry []byte) {
+			n.mu.Lock()
+			n.commits[key] = append(n.commits[key], string(entry))
+			n.mu.Unlock()
+		})
+	}
+	return n
+}
+
+// cut disconnects a voter from the others, or reconnects it.
+func (n *raftNetwork) cut(key string, down bool) {
+	n.mu.Lock()
+	n.down[key] = down
+	n.mu.Unlock()
+}
+
+// leader waits until a single voter that is not cut off leads, and the
+// other connected voters follow it.
+func (n *raftNetwork) leader(t *testing.T) string {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		n.mu.Lock()
+		down := make(map[string]bool)
+		for key, d := range n.down {
+			down[key] = d
+		}
+		n.mu.Unlock()
+
+		leaders := []string{}
+		agreed := true
+		var leader string
+		for _, key := range n.voters {
+			if down[key] {
+				continue
+			}
+			r := n.nodes[key]
+			r.mu.Lock()
+			if r.role == raftLeader {
+				leaders = append(leaders, key)
+			}
+			if leader == "" {
+				leader = r.leader
+			} else if r.leader != leader {
+				agreed = false
+			}
+			r.mu.Unlock()
+		}
+		if len(leaders) == 1 && agreed && leader == leaders[0] {
+			return leader
+		}
+		time.Sleep(raftTick)
+	}
+	t.Fatal("no leader was elected")
+	return ""
+}
+
+func (n *raftNetwork) propose(t *testing.T, key string, entries ...string) {
+	t.Helper()
+	for _, entry := range entries {
+		if !n.nodes[key].Propose([]byte(entry)) {
+			t.Fatalf("%s refused a proposal as leader", key)
+		}
+	}
+}
+
+// committed waits until each of the given voters committed exactly the
+// given entries, in order.
+func (n *raftNetwork) committed(t *testing.T, keys []string, want []string) {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		n.mu.Lock()
+		done := true
+		for _, key := range keys {
+			got := n.commits[key]
+			if len(got) > len(want) {
+				n.mu.Unlock()
+				t.Fatalf("%s committed %d entries, want %d", key, len(got), len(want))
+			}
+			for i := range got {
+				if got[i] != want[i] {
+					n.mu.Unlock()
+					t.Fatalf("%s committed %q at position %d, want %q", key, got[i], i, want[i])
+				}
+			}
+			if len(got) < len(want) {
+				done = false
+			}
+		}
+		n.mu.Unlock()
+		if done {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("voters did not commit all %d entries", len(want))
+		}
+		time.Sleep(raftTick)
+	}
+}
+
+func (n *raftNetwork) except(key string) []string {
+	others := []string{}
+	for _, voter := range n.voters {
+		if voter != key {
+			others = append(others, voter)
+		}
+	}
+	return others
+}
+
+func TestRaftLeaderFailover(t *testing.T) {
+	n := newRaftNetwork(t, 3)
+	first := n.leader(t)
+	n.propose(t, first, "a", "b")
+	n.committed(t, n.voters, []string{"a", "b"})
+
+	// the old leader keeps leading its own minority, and what it is given
+	// there never commits
+	n.cut(first, true)
+	second := n.leader(t)
+	if second == first {
+		t.Fatalf("%s is still leading after it was cut off", first)
+	}
+	n.propose(t, first, "lost")
+	n.propose(t, second, "c")
+	n.committed(t, n.except(first), []string{"a", "b", "c"})
+
+	n.cut(first, false)
+	leader := n.leader(t)
+	if leader == first {
+		t.Fatalf("%s took over again with an outdated log", first)
+	}
+	n.propose(t, leader, "d")
+	n.committed(t, n.voters, []string{"a", "b", "c", "d"})
+}
+
+func TestRaftFailoverAfterLeaderCommits(t *testing.T) {
+	n := newRaftNetwork(t, 5)
+	want := []string{}
+	for round := 0; round < 3; round++ {
+		leader := n.leader(t)
+		entry := fmt.Sprintf("round%d", round)
+		n.propose(t, leader, entry)
+		want = append(want, entry)
+		n.committed(t, n.voters, want)
+
+		n.cut(leader, true)
+		next := n.leader(t)
+		if next == leader {
+			t.Fatalf("%s is still leading after it was cut off", leader)
+		}
+		n.cut(leader, false)
+	}
+}
+
+func TestRaftCompactionKeepsEntriesForLaggingVoter(t *testing.T) {
+	n := newRaftNetwork(t, 3)
+	leader := n.leader(t)
+	lagging := n.except(leader)[0]
+
+	n.cut(lagging, true)
+	want := []string{}
+	for len(want) < 2*raftLogRetain+raftBatchSize {
+		batch := []string{}
+		for i := 0; i < raftBatchSize; i++ {
+			batch = append(batch, fmt.Sprintf("entry%d", len(want)+i))
+		}
+		n.propose(t, leader, batch...)
+		want = append(want, batch...)
+		// bursts of proposals make the leader resend what is in flight, so
+		// they are kept to a batch at a time
+		n.committed(t, []string{leader}, want)
+	}
+	n.committed(t, n.except(lagging), want)
+
+	r := n.nodes[leader]
+	r.mu.Lock()
+	cut := r.state.SnapshotIndex
+	r.mu.Unlock()
+	if cut != 0 {
+		t.Fatalf("leader cut its log to %d while a voter was missing every entry", cut)
+	}
+
+	// the lagging voter gets every entry, none are skipped
+	n.cut(lagging, false)
+	n.committed(t, n.voters, want)
+
+	// once every voter has the entries, the log is cut again
+	n.propose(t, leader, "last")
+	want = append(want, "last")
+	n.committed(t, n.voters, want)
+	r.mu.Lock()
+	cut = r.state.SnapshotIndex
+	r.mu.Unlock()
+	if cut == 0 {
+		t.Fatal("leader did not cut its log after every voter caught up")
+	}
+}
+
+func TestRaftCommitIndexNeverMovesBack(t *testing.T) {
+	n := newRaftNetwork(t, 3)
+	leader := n.leader(t)
+	n.propose(t, leader, "a", "b", "c")
+	n.committed(t, n.voters, []string{"a", "b", "c"})
+
+	// a late append that only covers the first entry does not take back
+	// what the follower already committed
+	r := n.nodes[n.except(leader)[0]]
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	before := r.commitIndex
+	r.appendFrom(leader, raftMessage{Type: "append", Term: r.state.Term, PrevIndex: 1, PrevTerm: r.termAt(1), Commit: before + 1})
+	if r.commitIndex != before {
+		t.Fatalf("commit index moved from %d to %d", before, r.commitIndex)
+	}
+}
@@ -0,0 +1,115 @@
+package p2p
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket refills at rate tokens per second up to burst.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// allow takes n tokens if they are available.
+func (b *tokenBucket) allow(now time.Time, n float64) bool {
+	b.refill(now)
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// reserve takes n tokens, going into debt if there are not enough, and
+// returns how long to wait until the debt is paid off. Callers that wait
+// out their reservation are served in the order they reserved.
+func (b *tokenBucket) reserve(now time.Time, n float64) time.Duration {
+	b.refill(now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// rateLimiter keeps a token bucket per key. A limiter with a rate of zero or
+// less allows everything.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   int
+	buckets map[string]*tokenBucket
+	calls   int
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow reports whether key may spend one more token.
+func (r *rateLimiter) allow(key string) bool {
+	if r.rate <= 0 {
+		return true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.calls++
+	if r.calls%1024 == 0 {
+		r.sweep(now)
+	}
+
+	bucket, ok := r.buckets[key]
+	if !ok {
+		bucket = newTokenBucket(r.rate, r.burst)
+		r.buckets[key] = bucket
+	}
+	return bucket.allow(now, 1)
+}
+
+// sweep forgets buckets that have refilled completely, since a fresh bucket
+// behaves the same.
+func (r *rateLimiter) sweep(now time.Time) {
+	for key, bucket := range r.buckets {
+		bucket.refill(now)
+		if bucket.tokens >= bucket.burst {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+// wait blocks until key may spend one more token.
+func (r *rateLimiter) wait(key string) {
+	for !r.allow(key) {
+		time.Sleep(time.Duration(float64(time.Second) / r.rate))
+	}
+}
@@ -0,0 +1,289 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/vmihailenco/msgpack"
+)
+
+var (
+	errReliableSize     = errors.New("message is larger than the chunk size, which reliable broadcasts cannot exceed")
+	errReliableDeadline = errors.New("the deadline of a reliable broadcast must be positive")
+)
+
+// DeliveryReport tells the origin of a reliable broadcast which recipients
+// acknowledged it.
+type DeliveryReport struct {
+	MessageID uuid.UUID
+	// Acked holds when each recipient's acknowledgement arrived, keyed by
+	// its hex sign key.
+	Acked map[string]time.Time
+	// Missing lists the expected recipients that did not acknowledge the
+	// message before the deadline.
+	Missing []string
+	// Attempts is how many times the message was sent, the first included.
+	Attempts int
+}
+
+// Delivered reports whether every expected recipient acknowledged the
+// message.
+func (r DeliveryReport) Delivered() bool {
+	return len(r.Missing) == 0
+}
+
+// WithRecipients sets the sign keys a reliable broadcast expects
+// acknowledgements from, instead of every peer in the peer table.
+func WithRecipients(signKeys ...string) BroadcastOption {
+	return func(o *broadcastOptions) {
+		o.recipients = signKeys
+	}
+}
+
+// withAck asks every recipient to acknowledge a broadcast. A retry refers to
+// the ID of the first attempt with ref.
+func withAck(ref string) BroadcastOption {
+	return func(o *broadcastOptions) {
+		o.ack = true
+		o.ref = ref
+	}
+}
+
+// delivery is a reliable broadcast waiting for acknowledgements.
+type delivery struct {
+	messageID string
+	message   []byte
+	opts      []BroadcastOption
+	expected  map[string]bool
+	acked     map[string]time.Time
+	attempts  int
+	done      chan struct{}
+	report    chan DeliveryReport
+}
+
+// missing lists the expected recipients that have not acknowledged yet.
+func (dl *delivery) missing() []string {
+	keys := []string{}
+	for key := range dl.expected {
+		if _, ok := dl.acked[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// reliable tracks our reliable broadcasts, and which reliable broadcasts
+// from others were already delivered here, so that retries are only
+// delivered to nodes that missed the first attempt.
+type reliable struct {
+	core      *core
+	delivered *seenCache
+
+	mu      sync.Mutex
+	pending map[string]*delivery
+}
+
+func newReliable(core *core) *reliable {
+	return &reliable{
+		core:      core,
+		delivered: core.newSeenCache(),
+		pending:   make(map[string]*delivery),
+	}
+}
+
+// BroadcastReliable broadcasts a message and has every recipient send a
+// signed acknowledgement back. Recipients that have not acknowledged it are
+// retried a few times before the deadline, which covers copies lost on the
+// way. Retries flood every link like the first attempt, so they only take
+// other paths when BroadcastTree is set, where the first attempt follows
+// the tree. The report is sent on the returned channel once everyone
+// acknowledged the message or the deadline passed.
+//
+// Recipients are the peers in the peer table unless WithRecipients is given.
+// A retry can reach a recipient twice, so delivery is at least once.
+func (d *DP2P) BroadcastReliable(message []byte, deadline time.Duration, opts ...BroadcastOption) (uuid.UUID, <-chan DeliveryReport, error) {
+	if len(message) > d.core.config.ChunkSize {
+		return uuid.UUID{}, nil, errReliableSize
+	}
+	if deadline <= 0 {
+		return uuid.UUID{}, nil, errReliableDeadline
+	}
+	return d.core.reliable.send(message, deadline, opts)
+}
+
+func (r *reliable) send(message []byte, deadline time.Duration, opts []BroadcastOption) (uuid.UUID, <-chan DeliveryReport, error) {
+	options := broadcastOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	recipients := options.recipients
+	if recipients == nil {
+		recipients = r.recipients()
+	}
+
+	mID := uuid.NewV4()
+	dl := &delivery{
+		messageID: mID.String(),
+		message:   message,
+		opts:      opts,
+		expected:  make(map[string]bool),
+		acked:     make(map[string]time.Time),
+		attempts:  1,
+		done:      make(chan struct{}),
+		report:    make(chan DeliveryReport, 1),
+	}
+	for _, key := range recipients {
+		if key != r.core.keys.signKeyHex() {
+			dl.expected[key] = true
+		}
+	}
+
+	r.mu.Lock()
+	r.pending[dl.messageID] = dl
+	r.mu.Unlock()
+
+	if len(dl.expected) == 0 {
+		close(dl.done)
+	}
+	go r.run(dl, deadline)
+	meta := r.core.broadcastAs(mID, message, append(opts, withAck(""))...)
+	if meta.Clock != nil {
+		r.mu.Lock()
+		dl.opts = append(dl.opts, withClock(meta.Clock))
+		r.mu.Unlock()
+	}
+	return mID, dl.report, nil
+}
+
+// recipients lists the peers a reliable broadcast expects by default.
+func (r *reliable) recipients() []string {
+	keys := []string{}
+	for _, peer := range r.core.db.getPeerList() {
+		if peer.SignKey != "" && peer.Score > banScore {
+			keys = append(keys, peer.SignKey)
+		}
+	}
+	return keys
+}
+
+func (r *reliable) run(dl *delivery, deadline time.Duration) {
+	interval := deadline / (reliableRetries + 1)
+	if interval <= 0 {
+		interval = deadline
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	timeout := time.NewTimer(deadline)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case <-dl.done:
+			r.finish(dl)
+			return
+		case <-timeout.C:
+			r.finish(dl)
+			return
+		case <-ticker.C:
+			r.mu.Lock()
+			retry := dl.attempts <= reliableRetries && len(dl.missing()) > 0
+			if retry {
+				dl.attempts++
+			}
+			attempt := dl.attempts
+			r.mu.Unlock()
+			if retry {
+				r.core.log.Debug("Retrying reliable broadcast", "messageID", dl.messageID, "attempt", attempt)
+				r.core.broadcast(dl.message, append(dl.opts, withAck(dl.messageID))...)
+			}
+		}
+	}
+}
+
+func (r *reliable) finish(dl *delivery) {
+	r.mu.Lock()
+	delete(r.pending, dl.messageID)
+	report := DeliveryReport{
+		MessageID: uuid.FromStringOrNil(dl.messageID),
+		Acked:     make(map[string]time.Time),
+		Attempts:  dl.attempts,
+	}
+	for key, at := range dl.acked {
+		report.Acked[key] = at
+	}
+	report.Missing = dl.missing()
+	r.mu.Unlock()
+
+	sort.Strings(report.Missing)
+	dl.report <- report
+	close(dl.report)
+}
+
+// receive acknowledges a broadcast that asked for it and reports whether it
+// should be delivered, which is only the case the first time it arrives.
+func (r *reliable) receive(meta broadcast) bool {
+	ref := meta.Ref
+	if ref == "" {
+		ref = meta.MessageID
+	}
+	first := r.delivered.add(ref)
+	if meta.Origin == r.core.keys.signKeyHex() {
+		return first
+	}
+
+	a := ack{
+		MessageID: meta.MessageID,
+		Origin:    meta.Origin,
+		Ref:       ref,
+		Node:      r.core.keys.signKeyHex(),
+	}
+	a.Signature = hex.EncodeToString(ed25519.Sign(r.core.keys.signKeys.Priv, ackDigest(a)))
+	data, _ := msgpack.Marshal(a)
+	r.core.reply(capAck, data, a.MessageID, a.Origin)
+	return first
+}
+
+// ackDigest is what a recipient signs to acknowledge a broadcast.
+func ackDigest(a ack) []byte {
+	return []byte("ack\x00" + a.Origin + "\x00" + a.Ref)
+}
+
+// acked handles an acknowledgement sent to us by a peer, which is either for
+// one of our broadcasts or passing through on its way back to the origin.
+func (r *reliable) acked(data []byte) {
+	a := ack{}
+	if err := msgpack.Unmarshal(data, &a); err != nil {
+		r.core.log.Warn("Could not decode acknowledgement", "err", err)
+		return
+	}
+	if a.Origin != r.core.keys.signKeyHex() {
+		r.core.reply(capAck, data, a.MessageID, a.Origin)
+		return
+	}
+
+	node, err := hex.DecodeString(a.Node)
+	signature, sigErr := hex.DecodeString(a.Signature)
+	if err != nil || sigErr != nil || len(node) != ed25519.PublicKeySize || !ed25519.Verify(node, ackDigest(a), signature) {
+		r.core.log.Warn("Dropped acknowledgement with a bad signature", "messageID", a.Ref, "node", a.Node)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	dl, ok := r.pending[a.Ref]
+	if !ok {
+		return
+	}
+	if _, ok := dl.acked[a.Node]; ok {
+		return
+	}
+	dl.acked[a.Node] = time.Now()
+	if dl.expected[a.Node] && len(dl.missing()) == 0 {
+		close(dl.done)
+	}
+}
@@ -0,0 +1,69 @@
+package p2p
+
+import (
+	"sync"
+)
+
+// replyRoutes remembers which peer each broadcast that asks for replies
+// first reached us from, so that replies can travel back to its origin
+// along the same path when we have no link to the origin. The zero value is
+// ready to use.
+type replyRoutes struct {
+	mu    sync.Mutex
+	peers map[string]string
+	order []string
+}
+
+// record remembers the first peer a message arrived from.
+func (r *replyRoutes) record(messageID, peer string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.peers == nil {
+		r.peers = make(map[string]string)
+	}
+	if _, ok := r.peers[messageID]; ok {
+		return
+	}
+	r.peers[messageID] = peer
+	r.order = append(r.order, messageID)
+	if len(r.order) > replyRouteSize {
+		delete(r.peers, r.order[0])
+		r.order = r.order[1:]
+	}
+}
+
+func (r *replyRoutes) next(messageID string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.peers[messageID]
+}
+
+// arrived is called for every broadcast that arrives from another node,
+// before it is deduplicated or relayed.
+func (c *core) arrived(from link, meta *broadcast) {
+	if from.peerKey() == c.keys.signKeyHex() {
+		return
+	}
+	if meta.Trace || meta.Ack {
+		c.routes.record(meta.MessageID, from.peerKey())
+	}
+	c.traceHop(from, meta)
+}
+
+// reply sends data as a direct frame of the given kind towards the origin
+// of a broadcast, directly if we are linked to it and otherwise through the
+// peer the broadcast came from, which passes it on the same way. The kind is
+// also the capability a link needs to carry the frame.
+func (c *core) reply(kind string, data []byte, messageID, origin string) {
+	next := origin
+	if len(c.links.byKey(next)) == 0 {
+		next = c.routes.next(messageID)
+	}
+	for _, l := range c.links.byKey(next) {
+		if l.supports(kind) {
+			l.cast(data, c.newDirect(data, kind))
+			return
+		}
+	}
+	c.log.Debug("No route for reply", "kind", kind, "messageID", messageID, "origin", origin)
+}
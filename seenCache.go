@@ -0,0 +1,209 @@
+package p2p
+
+import (
+	"container/list"
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+)
+
+// seenCache remembers message IDs for deduplication. Lookups are hash map
+// based, the number of entries is bounded by capacity, and entries expire
+// after ttl. When created with bloom set, IDs are kept in a rotating Bloom
+// filter instead, which trades a small false positive rate for fixed memory
+// at very high message rates.
+type seenCache struct {
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	order    *list.List
+	capacity int
+	ttl      time.Duration
+	bloom    *rotatingBloom
+}
+
+type seenEntry struct {
+	id   string
+	seen time.Time
+}
+
+func newSeenCache(capacity int, ttl time.Duration, bloom bool) *seenCache {
+	s := &seenCache{
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		capacity: capacity,
+		ttl:      ttl,
+	}
+	if bloom {
+		s.bloom = newRotatingBloom(capacity, ttl)
+	}
+	return s
+}
+
+func (c *core) newSeenCache() *seenCache {
+	return newSeenCache(c.config.SeenCacheSize, c.config.SeenCacheTTL, c.config.SeenCacheBloom)
+}
+
+// add records id and reports whether it had not been seen before.
+func (s *seenCache) add(id string) bool {
+	return s.addAt(id, time.Now())
+}
+
+func (s *seenCache) addAt(id string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.bloom != nil {
+		return s.bloom.add(id, now)
+	}
+
+	s.expire(now)
+	if _, ok := s.entries[id]; ok {
+		return false
+	}
+	s.entries[id] = s.order.PushBack(seenEntry{id: id, seen: now})
+	if s.capacity > 0 && s.order.Len() > s.capacity {
+		s.evict(s.order.Front())
+	}
+	return true
+}
+
+// contains reports whether id has been seen and not yet expired.
+func (s *seenCache) contains(id string) bool {
+	return s.containsAt(id, time.Now())
+}
+
+func (s *seenCache) containsAt(id string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.bloom != nil {
+		return s.bloom.contains(id, now)
+	}
+
+	s.expire(now)
+	_, ok := s.entries[id]
+	return ok
+}
+
+// len returns the number of IDs currently remembered.
+func (s *seenCache) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.bloom != nil {
+		return s.bloom.current.count + s.bloom.previous.count
+	}
+	return s.order.Len()
+}
+
+// expire drops entries older than ttl. Entries are kept in insertion order,
+// so it only ever looks at the front of the list.
+func (s *seenCache) expire(now time.Time) {
+	if s.ttl <= 0 {
+		return
+	}
+	for e := s.order.Front(); e != nil; e = s.order.Front() {
+		if now.Sub(e.Value.(seenEntry).seen) < s.ttl {
+			return
+		}
+		s.evict(e)
+	}
+}
+
+func (s *seenCache) evict(e *list.Element) {
+	delete(s.entries, e.Value.(seenEntry).id)
+	s.order.Remove(e)
+}
+
+// rotatingBloom is a pair of Bloom filters. New IDs go into current, lookups
+// check both, and current replaces previous once it is full or older than
+// the ttl, so every ID is remembered for at least one generation.
+type rotatingBloom struct {
+	current  *bloomFilter
+	previous *bloomFilter
+	capacity int
+	ttl      time.Duration
+}
+
+func newRotatingBloom(capacity int, ttl time.Duration) *rotatingBloom {
+	if capacity <= 0 {
+		capacity = defaultSeenCacheSize
+	}
+	now := time.Now()
+	return &rotatingBloom{
+		current:  newBloomFilter(capacity, now),
+		previous: newBloomFilter(capacity, now),
+		capacity: capacity,
+		ttl:      ttl,
+	}
+}
+
+func (r *rotatingBloom) rotate(now time.Time) {
+	if r.current.count >= r.capacity || (r.ttl > 0 && now.Sub(r.current.created) >= r.ttl) {
+		r.previous = r.current
+		r.current = newBloomFilter(r.capacity, now)
+	}
+}
+
+func (r *rotatingBloom) add(id string, now time.Time) bool {
+	if r.contains(id, now) {
+		return false
+	}
+	r.current.add(id)
+	return true
+}
+
+func (r *rotatingBloom) contains(id string, now time.Time) bool {
+	r.rotate(now)
+	return r.current.contains(id) || r.previous.contains(id)
+}
+
+// bloomFilter is sized for roughly a one percent false positive rate at
+// its capacity.
+type bloomFilter struct {
+	bits    []uint64
+	m       uint64
+	k       uint64
+	count   int
+	created time.Time
+}
+
+func newBloomFilter(capacity int, now time.Time) *bloomFilter {
+	m := uint64(math.Ceil(float64(capacity) * 9.6))
+	m = (m + 63) / 64 * 64
+	return &bloomFilter{
+		bits:    make([]uint64, m/64),
+		m:       m,
+		k:       7,
+		created: now,
+	}
+}
+
+func (b *bloomFilter) hashes(id string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	h1 := h.Sum64()
+	h.Write([]byte{0})
+	h2 := h.Sum64() | 1
+	return h1, h2
+}
+
+func (b *bloomFilter) add(id string) {
+	h1, h2 := b.hashes(id)
+	for i := uint64(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % b.m
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+	b.count++
+}
+
+func (b *bloomFilter) contains(id string) bool {
+	h1, h2 := b.hashes(id)
+	for i := uint64(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % b.m
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
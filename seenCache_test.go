@@ -0,0 +1,161 @@
+package p2p
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// benchmarkIDs returns n distinct message IDs shaped like the ones on the
+// wire.
+func benchmarkIDs(n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = "00000000-0000-4000-8000-" + strconv.FormatInt(int64(100000000000+i), 10)
+	}
+	return ids
+}
+
+func benchmarkSeenCacheAdd(b *testing.B, bloom bool) {
+	s := newSeenCache(defaultSeenCacheSize, defaultSeenCacheTTL, bloom)
+	ids := benchmarkIDs(b.N)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.add(ids[i])
+	}
+}
+
+func benchmarkSeenCacheDuplicate(b *testing.B, bloom bool) {
+	s := newSeenCache(defaultSeenCacheSize, defaultSeenCacheTTL, bloom)
+	ids := benchmarkIDs(1024)
+	for _, id := range ids {
+		s.add(id)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.add(ids[i%len(ids)])
+	}
+}
+
+func benchmarkSeenCacheFull(b *testing.B, bloom bool) {
+	const capacity = 10000
+	s := newSeenCache(capacity, time.Hour, bloom)
+	for _, id := range benchmarkIDs(capacity) {
+		s.add(id)
+	}
+	ids := benchmarkIDs(capacity + b.N)[capacity:]
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.add(ids[i])
+	}
+}
+
+func benchmarkSeenCacheParallel(b *testing.B, bloom bool) {
+	s := newSeenCache(defaultSeenCacheSize, defaultSeenCacheTTL, bloom)
+	ids := benchmarkIDs(1 << 16)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			s.add(ids[i%len(ids)])
+			i++
+		}
+	})
+}
+
+func BenchmarkSeenCacheAdd(b *testing.B)            { benchmarkSeenCacheAdd(b, false) }
+func BenchmarkSeenCacheAddBloom(b *testing.B)       { benchmarkSeenCacheAdd(b, true) }
+func BenchmarkSeenCacheDuplicate(b *testing.B)      { benchmarkSeenCacheDuplicate(b, false) }
+func BenchmarkSeenCacheDuplicateBloom(b *testing.B) { benchmarkSeenCacheDuplicate(b, true) }
+func BenchmarkSeenCacheFull(b *testing.B)           { benchmarkSeenCacheFull(b, false) }
+func BenchmarkSeenCacheFullBloom(b *testing.B)      { benchmarkSeenCacheFull(b, true) }
+func BenchmarkSeenCacheParallel(b *testing.B)       { benchmarkSeenCacheParallel(b, false) }
+func BenchmarkSeenCacheParallelBloom(b *testing.B)  { benchmarkSeenCacheParallel(b, true) }
+
+func TestSeenCache(t *testing.T) {
+	type step struct {
+		add  bool
+		id   string
+		at   time.Duration
+		want bool
+	}
+	tests := []struct {
+		name     string
+		capacity int
+		ttl      time.Duration
+		bloom    bool
+		steps    []step
+	}{
+		{"duplicates", 10, time.Minute, false, []step{
+			{true, "a", 0, true},
+			{true, "a", 0, false},
+			{false, "a", 0, true},
+			{false, "b", 0, false},
+		}},
+		{"ttl expiry", 10, time.Minute, false, []step{
+			{true, "a", 0, true},
+			{true, "b", 30 * time.Second, true},
+			{false, "a", 59 * time.Second, true},
+			{false, "a", time.Minute, false},
+			{false, "b", time.Minute, true},
+			{true, "a", time.Minute, true},
+		}},
+		{"eviction when full", 3, time.Minute, false, []step{
+			{true, "a", 0, true},
+			{true, "b", 0, true},
+			{true, "c", 0, true},
+			{true, "d", 0, true},
+			{false, "a", 0, false},
+			{false, "b", 0, true},
+			{false, "d", 0, true},
+			{true, "a", 0, true},
+			{false, "b", 0, false},
+		}},
+		{"bloom duplicates", 10, time.Minute, true, []step{
+			{true, "a", 0, true},
+			{true, "a", 0, false},
+			{false, "b", 0, false},
+		}},
+		{"bloom rotation by age", 10, time.Minute, true, []step{
+			{true, "a", 0, true},
+			// the first rotation keeps a in the previous filter
+			{false, "a", time.Minute, true},
+			{true, "b", time.Minute, true},
+			// the second forgets it
+			{false, "a", 2 * time.Minute, false},
+			{false, "b", 2 * time.Minute, true},
+		}},
+		{"bloom rotation when full", 3, time.Hour, true, []step{
+			{true, "a", 0, true},
+			{true, "b", 0, true},
+			{true, "c", 0, true},
+			{true, "d", 0, true},
+			{false, "a", 0, true},
+			{true, "e", 0, true},
+			{true, "f", 0, true},
+			{true, "g", 0, true},
+			{false, "a", 0, false},
+			{false, "d", 0, true},
+			{false, "g", 0, true},
+		}},
+	}
+	for _, test := range tests {
+		s := newSeenCache(test.capacity, test.ttl, test.bloom)
+		start := time.Now()
+		for i, st := range test.steps {
+			var got bool
+			if st.add {
+				got = s.addAt(st.id, start.Add(st.at))
+			} else {
+				got = s.containsAt(st.id, start.Add(st.at))
+			}
+			if got != st.want {
+				t.Errorf("%s: step %d on %q = %v, want %v", test.name, i, st.id, got, st.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package p2p
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bandwidth limits the bytes per second sent or received over a connection,
+// or over all of them. A nil bandwidth is unlimited.
+type bandwidth struct {
+	mu     sync.Mutex
+	bucket *tokenBucket
+}
+
+func newBandwidth(rate int64) *bandwidth {
+	if rate <= 0 {
+		return nil
+	}
+	return &bandwidth{bucket: newTokenBucket(float64(rate), int(rate))}
+}
+
+func (b *bandwidth) reserve(n int) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.bucket.reserve(time.Now(), float64(n))
+}
+
+// throttle waits until n bytes fit within every limit, and adds the time it
+// waited to waited, in nanoseconds.
+func throttle(n int, waited *uint64, limits ...*bandwidth) {
+	var wait time.Duration
+	for _, limit := range limits {
+		if w := limit.reserve(n); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		atomic.AddUint64(waited, uint64(wait))
+		time.Sleep(wait)
+	}
+}
+
+// sendQueue holds the frames waiting to be written to a connection, and
+// writes them from its own goroutine, so that a slow peer only holds up its
+// own frames. Under the total upload limit, the connections take turns
+// frame by frame, since each writer reserves one frame at a time. Pings and
+// pongs go ahead of the other frames and are not limited, so that a busy
+// link is not taken for a dead one.
+type sendQueue struct {
+	core  *core
+	write func([]byte)
+
+	mu     sync.Mutex
+	ready  *sync.Cond
+	limits []*bandwidth
+	urgent [][]byte
+	frames [][]byte
+	bytes  int64
+	closed bool
+}
+
+func newSendQueue(core *core, write func([]byte)) *sendQueue {
+	q := &sendQueue{
+		core:   core,
+		write:  write,
+		limits: []*bandwidth{newBandwidth(core.config.UploadRate), core.upload},
+	}
+	q.ready = sync.NewCond(&q.mu)
+	go q.run()
+	return q
+}
+
+// push queues a sealed frame. A frame that does not fit in the queue is
+// dropped, unless the queue is empty.
+func (q *sendQueue) push(frame []byte) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	if q.bytes > 0 && q.bytes+int64(len(frame)) > q.core.config.SendQueueSize {
+		atomic.AddUint64(&q.core.counters.sendQueueDrops, 1)
+		return
+	}
+	q.frames = append(q.frames, frame)
+	q.bytes += int64(len(frame))
+	q.ready.Signal()
+}
+
+// pushUrgent queues a sealed ping or pong ahead of the other frames.
+func (q *sendQueue) pushUrgent(frame []byte) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.urgent = append(q.urgent, frame)
+	q.ready.Signal()
+}
+
+func (q *sendQueue) run() {
+	for {
+		q.mu.Lock()
+		for len(q.urgent) == 0 && len(q.frames) == 0 && !q.closed {
+			q.ready.Wait()
+		}
+		if q.closed {
+			q.urgent = nil
+			q.frames = nil
+			q.bytes = 0
+			q.mu.Unlock()
+			return
+		}
+		if len(q.urgent) > 0 {
+			frame := q.urgent[0]
+			q.urgent = q.urgent[1:]
+			q.mu.Unlock()
+			q.write(frame)
+			continue
+		}
+		frame := q.frames[0]
+		q.frames[0] = nil
+		q.frames = q.frames[1:]
+		limits := q.limits
+		q.mu.Unlock()
+
+		throttle(len(frame), &q.core.counters.uploadWait, limits...)
+		q.write(frame)
+
+		q.mu.Lock()
+		q.bytes -= int64(len(frame))
+		q.mu.Unlock()
+	}
+}
+
+// exempt lifts the upload limits, for the connection to ourselves.
+func (q *sendQueue) exempt() {
+	q.mu.Lock()
+	q.limits = nil
+	q.mu.Unlock()
+}
+
+// len returns the number of bytes waiting to be written.
+func (q *sendQueue) len() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.bytes
+}
+
+// close drops the frames that are still queued and stops the writer.
+func (q *sendQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.ready.Broadcast()
+	q.mu.Unlock()
+}
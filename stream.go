@@ -0,0 +1,245 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/vmihailenco/msgpack"
+)
+
+var (
+	errStreamTooLarge = errors.New("stream exceeds the maximum stream size")
+	errNotConnected   = errors.New("no connection to peer")
+	errUnsupported    = errors.New("peer does not support this feature")
+)
+
+// streamAssembler collects the chunks of incoming streams and delivers each
+// stream as a single message once it is complete and its hash checks out.
+// Streams that grow past MaxStreamSize or stall for longer than
+// StreamTimeout are discarded.
+type streamAssembler struct {
+	core *core
+
+	mu      sync.Mutex
+	pending map[string]*pendingStream
+	// origins counts the pending streams of each origin, so that one origin
+	// cannot take every slot.
+	origins map[string]int
+	done    *seenCache
+}
+
+type pendingStream struct {
+	origin  string
+	chunks  map[int][]byte
+	size    int64
+	total   int
+	hash    []byte
+	updated time.Time
+}
+
+func newStreamAssembler(core *core) *streamAssembler {
+	s := &streamAssembler{
+		core:    core,
+		pending: make(map[string]*pendingStream),
+		origins: make(map[string]int),
+		done:    newSeenCache(core.config.MaxStreams*4, core.config.StreamTimeout*2, false),
+	}
+	go s.expireLoop()
+	return s
+}
+
+// add stores a chunk of the stream sent by origin.
+func (s *streamAssembler) add(origin string, data []byte) {
+	c := chunk{}
+	if err := msgpack.Unmarshal(data, &c); err != nil {
+		s.core.log.Error("Could not decode chunk", "origin", origin, "err", err)
+		return
+	}
+	key := origin + "/" + c.StreamID
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.done.contains(key) {
+		return
+	}
+	stream, ok := s.pending[key]
+	if !ok {
+		if len(s.pending) >= s.core.config.MaxStreams {
+			s.core.log.Warn("Too many incoming streams, dropping chunk", "streamID", c.StreamID, "origin", origin)
+			return
+		}
+		if s.origins[origin] >= s.core.config.MaxStreamsPerOrigin {
+			s.core.log.Warn("Too many incoming streams from origin, dropping chunk", "streamID", c.StreamID, "origin", origin)
+			return
+		}
+		stream = &pendingStream{origin: origin, chunks: make(map[int][]byte), total: -1}
+		s.pending[key] = stream
+		s.origins[origin]++
+	}
+	if _, ok := stream.chunks[c.Index]; ok {
+		return
+	}
+
+	stream.chunks[c.Index] = c.Data
+	stream.size += int64(len(c.Data))
+	stream.updated = time.Now()
+	if c.Final {
+		stream.total = c.Total
+		stream.hash = c.Hash
+	}
+
+	if stream.size > s.core.config.MaxStreamSize || len(stream.chunks) > int(s.core.config.MaxStreamSize/int64(s.core.config.ChunkSize))+1 {
+		s.core.log.Warn("Stream is too large, discarding it", "streamID", c.StreamID, "origin", origin)
+		s.abort(key)
+		return
+	}
+	if stream.total < 0 || len(stream.chunks) < stream.total {
+		return
+	}
+
+	indexes := make([]int, 0, len(stream.chunks))
+	for index := range stream.chunks {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	payload := make([]byte, 0, stream.size)
+	for i, index := range indexes {
+		if index != i {
+			s.core.log.Warn("Stream has missing chunks, discarding it", "streamID", c.StreamID, "origin", origin)
+			s.abort(key)
+			return
+		}
+		payload = append(payload, stream.chunks[index]...)
+	}
+	hash := sha256.Sum256(payload)
+	if !bytes.Equal(hash[:], stream.hash) {
+		s.core.log.Warn("Stream failed its integrity check, discarding it", "streamID", c.StreamID, "origin", origin)
+		s.abort(key)
+		return
+	}
+
+	s.remove(key)
+	s.done.add(key)
+	s.core.deliver(Message{ID: c.StreamID, Origin: origin, Time: time.Now(), Data: payload})
+}
+
+func (s *streamAssembler) abort(key string) {
+	s.remove(key)
+	s.done.add(key)
+}
+
+func (s *streamAssembler) remove(key string) {
+	stream, ok := s.pending[key]
+	if !ok {
+		return
+	}
+	delete(s.pending, key)
+	if s.origins[stream.origin]--; s.origins[stream.origin] <= 0 {
+		delete(s.origins, stream.origin)
+	}
+}
+
+func (s *streamAssembler) expireLoop() {
+	for {
+		time.Sleep(1 * time.Second)
+		s.mu.Lock()
+		for key, stream := range s.pending {
+			if time.Since(stream.updated) > s.core.config.StreamTimeout {
+				s.core.log.Warn("Stream timed out, discarding it", "stream", key)
+				s.abort(key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// writeStream splits everything read from r into chunks and hands each
+// packed chunk to send, in order.
+func (c *core) writeStream(r io.Reader, send func(data []byte) error) (uuid.UUID, error) {
+	streamID := uuid.NewV4()
+	hash := sha256.New()
+
+	var size int64
+	current := make([]byte, c.config.ChunkSize)
+	n, err := io.ReadFull(r, current)
+	for index := 0; ; index++ {
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return streamID, err
+		}
+		current = current[:n]
+		size += int64(n)
+		if size > c.config.MaxStreamSize {
+			return streamID, errStreamTooLarge
+		}
+		hash.Write(current)
+
+		next := make([]byte, c.config.ChunkSize)
+		nextN, nextErr := 0, io.EOF
+		if err == nil {
+			nextN, nextErr = io.ReadFull(r, next)
+		}
+		final := nextN == 0 && nextErr == io.EOF
+
+		chunk := chunk{
+			StreamID: streamID.String(),
+			Index:    index,
+			Data:     current,
+			Final:    final,
+		}
+		if final {
+			chunk.Total = index + 1
+			chunk.Size = size
+			chunk.Hash = hash.Sum(nil)
+		}
+		data, err := msgpack.Marshal(chunk)
+		if err != nil {
+			return streamID, err
+		}
+		if err := send(data); err != nil {
+			return streamID, err
+		}
+		if final {
+			return streamID, nil
+		}
+
+		current, n, err = next, nextN, nextErr
+	}
+}
+
+// BroadcastReader broadcasts everything read from r as a stream of chunks.
+// Every node reassembles the stream and delivers it through ReadMessage as
+// a single message. Chunks are sent no faster than the per-origin rate limit
+// allows, so relays do not drop them. Returns the stream's ID.
+func (d *DP2P) BroadcastReader(r io.Reader, opts ...BroadcastOption) (uuid.UUID, error) {
+	opts = append(opts, withKind("chunk"))
+	return d.core.writeStream(r, func(data []byte) error {
+		d.core.streamPace.wait("")
+		d.core.broadcast(data, opts...)
+		return nil
+	})
+}
+
+// SendStream sends everything read from r to a single peer we are connected
+// to, which delivers it through ReadMessage as a single message. Returns the
+// stream's ID.
+func (d *DP2P) SendStream(peer Peer, r io.Reader) (uuid.UUID, error) {
+	links := d.core.links.byKey(peer.SignKey)
+	if len(links) == 0 {
+		return uuid.UUID{}, errNotConnected
+	}
+	if !links[0].supports(capStream) {
+		return uuid.UUID{}, errUnsupported
+	}
+	return d.core.writeStream(r, func(data []byte) error {
+		links[0].cast(data, d.core.newDirect(data, "chunk"))
+		return nil
+	})
+}
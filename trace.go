@@ -0,0 +1,342 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/vmihailenco/msgpack"
+)
+
+// TraceHop is one node's record of a traced broadcast arriving from a peer.
+// Hop counts the nodes the copy passed through, starting at 1 for the
+// origin's direct peers.
+type TraceHop struct {
+	Node      string    `json:"node"`
+	Peer      string    `json:"peer"`
+	Hop       int       `json:"hop"`
+	Time      time.Time `json:"time"`
+	Duplicate bool      `json:"duplicate"`
+}
+
+// Trace is what the origin of a traced broadcast learned about how it
+// spread. Hop times come from each node's own clock, so latencies are only
+// as accurate as the clocks are synchronized.
+type Trace struct {
+	MessageID string     `json:"messageID"`
+	Origin    string     `json:"origin"`
+	Sent      time.Time  `json:"sent"`
+	Hops      []TraceHop `json:"hops"`
+}
+
+// TraceEdge is one edge of a broadcast's propagation tree: the first copy
+// of the message that reached To, and how long after From got it.
+type TraceEdge struct {
+	From    string        `json:"from"`
+	To      string        `json:"to"`
+	Hop     int           `json:"hop"`
+	Latency time.Duration `json:"latency"`
+}
+
+// arrivals returns the first arrival at each node, keyed by node, with the
+// origin arriving when the message was sent.
+func (t Trace) arrivals() map[string]TraceHop {
+	first := map[string]TraceHop{t.Origin: {Node: t.Origin, Time: t.Sent}}
+	for _, hop := range t.Hops {
+		if hop.Duplicate || hop.Node == t.Origin {
+			continue
+		}
+		if seen, ok := first[hop.Node]; !ok || hop.Time.Before(seen.Time) {
+			first[hop.Node] = hop
+		}
+	}
+	return first
+}
+
+// Tree rebuilds the propagation tree from the first arrival at every node
+// that reported back. The latency of an edge is zero when the sending node
+// did not report its own arrival.
+func (t Trace) Tree() []TraceEdge {
+	first := t.arrivals()
+	edges := []TraceEdge{}
+	for node, hop := range first {
+		if node == t.Origin {
+			continue
+		}
+		edge := TraceEdge{From: hop.Peer, To: node, Hop: hop.Hop}
+		if from, ok := first[hop.Peer]; ok {
+			edge.Latency = hop.Time.Sub(from.Time)
+		}
+		edges = append(edges, edge)
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].Hop != edges[j].Hop {
+			return edges[i].Hop < edges[j].Hop
+		}
+		return edges[i].To < edges[j].To
+	})
+	return edges
+}
+
+// JSON encodes the trace together with its propagation tree.
+func (t Trace) JSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Trace
+		Tree []TraceEdge `json:"tree"`
+	}{t, t.Tree()})
+}
+
+// OTLP encodes the trace as OpenTelemetry spans in the OTLP/JSON format,
+// ready to be posted to a collector's /v1/traces endpoint. The broadcast is
+// the root span, each node's first arrival is a span under the node it came
+// from, and duplicate arrivals are events on the receiving node's span.
+func (t Trace) OTLP() ([]byte, error) {
+	traceID := hex.EncodeToString(uuid.FromStringOrNil(t.MessageID).Bytes())
+	first := t.arrivals()
+
+	end := t.Sent
+	for _, hop := range t.Hops {
+		if hop.Time.After(end) {
+			end = hop.Time
+		}
+	}
+
+	type otlpValue struct {
+		StringValue string `json:"stringValue,omitempty"`
+		IntValue    string `json:"intValue,omitempty"`
+	}
+	type otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	type otlpEvent struct {
+		TimeUnixNano string          `json:"timeUnixNano"`
+		Name         string          `json:"name"`
+		Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	}
+	type otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Events            []otlpEvent     `json:"events,omitempty"`
+	}
+	str := func(key, value string) otlpAttribute {
+		return otlpAttribute{Key: key, Value: otlpValue{StringValue: value}}
+	}
+	nanos := func(t time.Time) string {
+		return strconv.FormatInt(t.UnixNano(), 10)
+	}
+
+	spans := []otlpSpan{{
+		TraceID:           traceID,
+		SpanID:            traceSpanID(t.Origin),
+		Name:              "broadcast",
+		Kind:              1,
+		StartTimeUnixNano: nanos(t.Sent),
+		EndTimeUnixNano:   nanos(end),
+		Attributes:        []otlpAttribute{str("p2p.message_id", t.MessageID), str("p2p.node", t.Origin)},
+	}}
+	index := map[string]int{t.Origin: 0}
+	for _, edge := range t.Tree() {
+		hop := first[edge.To]
+		start := hop.Time.Add(-edge.Latency)
+		index[edge.To] = len(spans)
+		spans = append(spans, otlpSpan{
+			TraceID:           traceID,
+			SpanID:            traceSpanID(edge.To),
+			ParentSpanID:      traceSpanID(edge.From),
+			Name:              "hop",
+			Kind:              1,
+			StartTimeUnixNano: nanos(start),
+			EndTimeUnixNano:   nanos(hop.Time),
+			Attributes: []otlpAttribute{
+				str("p2p.node", edge.To),
+				str("p2p.peer", edge.From),
+				{Key: "p2p.hop", Value: otlpValue{IntValue: strconv.Itoa(edge.Hop)}},
+			},
+		})
+	}
+	for _, hop := range t.Hops {
+		i, ok := index[hop.Node]
+		if !hop.Duplicate || !ok {
+			continue
+		}
+		spans[i].Events = append(spans[i].Events, otlpEvent{
+			TimeUnixNano: nanos(hop.Time),
+			Name:         "duplicate",
+			Attributes:   []otlpAttribute{str("p2p.peer", hop.Peer)},
+		})
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttribute{str("service.name", metricsPrefix)},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": progName, "version": version},
+				"spans": spans,
+			}},
+		}},
+	})
+}
+
+// traceSpanID derives a node's span ID from its sign key, so every report
+// about the same node lands on the same span.
+func traceSpanID(node string) string {
+	sum := sha256.Sum256([]byte(node))
+	return hex.EncodeToString(sum[:8])
+}
+
+// tracer records traced broadcasts passing through this node, and collects
+// the reports about the ones we sent.
+type tracer struct {
+	core *core
+	seen *seenCache
+
+	mu         sync.Mutex
+	traces     map[string]*Trace
+	traceOrder []string
+}
+
+func newTracer(core *core) *tracer {
+	return &tracer{
+		core:   core,
+		seen:   newSeenCache(traceCacheSize*16, core.config.SeenCacheTTL, false),
+		traces: make(map[string]*Trace),
+	}
+}
+
+// start begins collecting the trace of a broadcast we originated.
+func (t *tracer) start(meta broadcast) {
+	t.seen.add(meta.MessageID)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.traces[meta.MessageID] = &Trace{MessageID: meta.MessageID, Origin: meta.Origin, Sent: time.Now()}
+	t.traceOrder = append(t.traceOrder, meta.MessageID)
+	if len(t.traceOrder) > traceCacheSize {
+		delete(t.traces, t.traceOrder[0])
+		t.traceOrder = t.traceOrder[1:]
+	}
+}
+
+// traceHop records a traced broadcast that arrived from another node, and counts
+// the hop on meta before it is relayed any further.
+func (c *core) traceHop(from link, meta *broadcast) {
+	t := c.tracer
+	if !meta.Trace {
+		return
+	}
+	meta.Hops++
+	hop := TraceHop{
+		Node:      c.keys.signKeyHex(),
+		Peer:      from.peerKey(),
+		Hop:       meta.Hops,
+		Time:      time.Now(),
+		Duplicate: !t.seen.add(meta.MessageID),
+	}
+
+	e := messageEvent(MessageTraced, *meta)
+	e.Peer = hop.Peer
+	e.Hop = hop.Hop
+	e.Duplicate = hop.Duplicate
+	c.events.emit(e)
+	c.log.Debug("TRACE", "messageID", meta.MessageID, "peer", hop.Peer, "hop", hop.Hop, "duplicate", hop.Duplicate)
+
+	if meta.Origin == hop.Node {
+		t.add(meta.MessageID, hop)
+		return
+	}
+	if meta.TraceReport {
+		report := traceReport{
+			MessageID: meta.MessageID,
+			Origin:    meta.Origin,
+			Node:      hop.Node,
+			Peer:      hop.Peer,
+			Hop:       hop.Hop,
+			Time:      hop.Time.UnixNano(),
+			Duplicate: hop.Duplicate,
+		}
+		report.Signature = hex.EncodeToString(ed25519.Sign(c.keys.signKeys.Priv, traceReportDigest(report)))
+		data, _ := msgpack.Marshal(report)
+		c.reply(capTrace, data, report.MessageID, report.Origin)
+	}
+}
+
+// add stores a hop of one of our own traced broadcasts.
+func (t *tracer) add(messageID string, hop TraceHop) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if trace, ok := t.traces[messageID]; ok {
+		trace.Hops = append(trace.Hops, hop)
+	}
+}
+
+// receive handles a trace report sent to us by a peer, which is either ours
+// or passing through on its way back to the origin. Reports must be signed
+// by the node they are about.
+func (t *tracer) receive(data []byte) {
+	report := traceReport{}
+	if err := msgpack.Unmarshal(data, &report); err != nil {
+		t.core.log.Warn("Could not decode trace report", "err", err)
+		return
+	}
+	node, err := hex.DecodeString(report.Node)
+	signature, sigErr := hex.DecodeString(report.Signature)
+	if err != nil || sigErr != nil || len(node) != ed25519.PublicKeySize || !ed25519.Verify(node, traceReportDigest(report), signature) {
+		t.core.log.Warn("Dropped trace report with a bad signature", "messageID", report.MessageID, "node", report.Node)
+		return
+	}
+	if report.Origin == t.core.keys.signKeyHex() {
+		t.add(report.MessageID, TraceHop{
+			Node:      report.Node,
+			Peer:      report.Peer,
+			Hop:       report.Hop,
+			Time:      time.Unix(0, report.Time),
+			Duplicate: report.Duplicate,
+		})
+		return
+	}
+	t.core.reply(capTrace, data, report.MessageID, report.Origin)
+}
+
+func traceReportDigest(r traceReport) []byte {
+	digest := []byte("trace\x00" + r.MessageID + "\x00" + r.Origin + "\x00" + r.Node + "\x00" + r.Peer + "\x00")
+	digest = append(digest, make([]byte, 16)...)
+	binary.BigEndian.PutUint64(digest[len(digest)-16:], uint64(r.Hop))
+	binary.BigEndian.PutUint64(digest[len(digest)-8:], uint64(r.Time))
+	if r.Duplicate {
+		digest = append(digest, 1)
+	} else {
+		digest = append(digest, 0)
+	}
+	return digest
+}
+
+// Trace returns what was collected so far about a traced broadcast this
+// node sent. Reports keep arriving for a while after the broadcast, and only
+// the most recent traced broadcasts are kept.
+func (d *DP2P) Trace(messageID uuid.UUID) (Trace, bool) {
+	t := d.core.tracer
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	trace, ok := t.traces[messageID.String()]
+	if !ok {
+		return Trace{}, false
+	}
+	result := *trace
+	result.Hops = append([]TraceHop{}, trace.Hops...)
+	return result, true
+}
@@ -17,30 +17,219 @@ type message struct {
 }
 
 type challenge struct {
-	Type      string `msgpack:"type"`
-	Challenge string `msgpack:"challenge"`
+	Type         string   `msgpack:"type"`
+	Challenge    string   `msgpack:"challenge"`
+	Codecs       []string `msgpack:"codecs"`
+	Version      int      `msgpack:"version"`
+	Capabilities []string `msgpack:"capabilities"`
+	// Difficulty is the number of leading zero bits the puzzle solution
+	// must have, or zero when there is no puzzle.
+	Difficulty int `msgpack:"difficulty,omitempty"`
+	// the server's identity, sent in permissioned networks
+	SignKey     string       `msgpack:"signKey,omitempty"`
+	SealKey     string       `msgpack:"sealKey,omitempty"`
+	Proof       string       `msgpack:"proof,omitempty"`
+	Certificate *Certificate `msgpack:"certificate,omitempty"`
 }
 
 type response struct {
-	Type      string `msgpack:"type"`
-	Signed    string `msgpack:"signed"`
-	SignKey   string `msgpack:"signKey"`
-	SealKey   string `msgpack:"sealKey"`
-	Port      int    `msgpack:"port"`
-	NetworkID string `msgpack:"networkID"`
+	Type         string       `msgpack:"type"`
+	Signed       string       `msgpack:"signed"`
+	SignKey      string       `msgpack:"signKey"`
+	SealKey      string       `msgpack:"sealKey"`
+	Port         int          `msgpack:"port"`
+	NetworkID    string       `msgpack:"networkID"`
+	Codec        string       `msgpack:"codec"`
+	Version      int          `msgpack:"version"`
+	Capabilities []string     `msgpack:"capabilities"`
+	Certificate  *Certificate `msgpack:"certificate,omitempty"`
+	Solution     uint64       `msgpack:"solution,omitempty"`
+}
+
+type closeFrame struct {
+	Type   string    `msgpack:"type"`
+	Code   CloseCode `msgpack:"code"`
+	Reason string    `msgpack:"reason"`
 }
 
+// broadcast is a sealed frame. It is used both for broadcasts and, with the
+// type set to "direct", for frames sent to a single peer. Kind tells our own
+// payloads apart from application data, which has no kind.
 type broadcast struct {
 	Type      string `msgpack:"type"`
 	Secret    string `msgpack:"secret"`
 	Nonce     string `msgpack:"nonce"`
 	MessageID string `msgpack:"messageID"`
+	Seq       uint64 `msgpack:"seq"`
+	Timestamp int64  `msgpack:"timestamp"`
+	TTL       int    `msgpack:"ttl"`
+	Kind      string `msgpack:"kind"`
+	Codec     string `msgpack:"codec"`
+	Origin    string `msgpack:"origin"`
+	Signature string `msgpack:"signature"`
+
+	// Trace asks every node to record the broadcast's arrival, and
+	// TraceReport to send the record back to the origin. Hops counts the
+	// nodes it passed through, and is the only one of them that is not
+	// covered by the signature.
+	Trace       bool `msgpack:"trace,omitempty"`
+	TraceReport bool `msgpack:"traceReport,omitempty"`
+	Hops        int  `msgpack:"hops,omitempty"`
+
+	// Ack asks every recipient to acknowledge the broadcast to its origin.
+	// Ref is set on retries to the message ID of the first attempt. Both
+	// are covered by the signature.
+	Ack bool   `msgpack:"ack,omitempty"`
+	Ref string `msgpack:"ref,omitempty"`
+
+	// Clock is the origin's vector clock when it sent the broadcast, used
+	// for causal delivery. It is covered by the signature.
+	Clock vectorClock `msgpack:"clock,omitempty"`
+}
+
+type ihave struct {
+	Type       string   `msgpack:"type"`
+	MessageIDs []string `msgpack:"messageIDs"`
+}
+
+type graft struct {
+	Type      string `msgpack:"type"`
+	MessageID string `msgpack:"messageID"`
+}
+
+type traceReport struct {
+	MessageID string `msgpack:"messageID"`
+	Origin    string `msgpack:"origin"`
+	Node      string `msgpack:"node"`
+	Peer      string `msgpack:"peer"`
+	Hop       int    `msgpack:"hop"`
+	Time      int64  `msgpack:"time"`
+	Duplicate bool   `msgpack:"duplicate"`
+	// Signature is the reporting node's signature over the report.
+	Signature string `msgpack:"signature"`
+}
+
+type ack struct {
+	MessageID string `msgpack:"messageID"`
+	Origin    string `msgpack:"origin"`
+	Ref       string `msgpack:"ref"`
+	Node      string `msgpack:"node"`
+	Signature string `msgpack:"signature"`
+}
+
+type syncFrame struct {
+	Stage    string        `msgpack:"stage"`
+	Buckets  []syncBucket  `msgpack:"buckets,omitempty"`
+	IDs      []string      `msgpack:"ids,omitempty"`
+	Messages []syncMessage `msgpack:"messages,omitempty"`
+}
+
+type syncBucket struct {
+	Start int64  `msgpack:"start"`
+	Count int    `msgpack:"count"`
+	Hash  []byte `msgpack:"hash"`
+}
+
+type syncMessage struct {
+	MessageID string      `msgpack:"messageID"`
+	Origin    string      `msgpack:"origin"`
+	Signature string      `msgpack:"signature"`
+	Timestamp int64       `msgpack:"timestamp"`
+	Kind      string      `msgpack:"kind,omitempty"`
+	Flags     uint8       `msgpack:"flags,omitempty"`
+	Ref       string      `msgpack:"ref,omitempty"`
+	Clock     vectorClock `msgpack:"clock,omitempty"`
+	Data      []byte      `msgpack:"data"`
+}
+
+type raftMessage struct {
+	Type      string      `msgpack:"type"`
+	Term      uint64      `msgpack:"term"`
+	LastIndex uint64      `msgpack:"lastIndex,omitempty"`
+	LastTerm  uint64      `msgpack:"lastTerm,omitempty"`
+	Granted   bool        `msgpack:"granted,omitempty"`
+	PrevIndex uint64      `msgpack:"prevIndex,omitempty"`
+	PrevTerm  uint64      `msgpack:"prevTerm,omitempty"`
+	Entries   []raftEntry `msgpack:"entries,omitempty"`
+	Commit    uint64      `msgpack:"commit,omitempty"`
+	Success   bool        `msgpack:"success,omitempty"`
+	Match     uint64      `msgpack:"match,omitempty"`
+	// Held is the highest index every voter has, which followers may cut
+	// their log down to.
+	Held uint64 `msgpack:"held,omitempty"`
+}
+
+type orderedProposal struct {
+	// Kind is the kind of the proposal's broadcast, "propose" when empty.
+	Kind      string `msgpack:"kind,omitempty"`
+	MessageID string `msgpack:"messageID"`
+	Origin    string `msgpack:"origin"`
+	Timestamp int64  `msgpack:"timestamp"`
+	Signature string `msgpack:"signature"`
+	Data      []byte `msgpack:"data"`
+}
+
+type orderedEntry struct {
+	Index    uint64 `msgpack:"index"`
+	Prev     uint64 `msgpack:"prev"`
+	Proposal []byte `msgpack:"proposal"`
+}
+
+type channelFrame struct {
+	Channel string `msgpack:"channel"`
+	Data    []byte `msgpack:"data"`
+}
+
+type blobHave struct {
+	Hash string `msgpack:"hash"`
+	Size int64  `msgpack:"size"`
+}
+
+type blobManifest struct {
+	Size      int64    `msgpack:"size"`
+	ChunkSize int      `msgpack:"chunkSize"`
+	Chunks    [][]byte `msgpack:"chunks"`
+}
+
+type blobFrame struct {
+	Type  string `msgpack:"type"`
+	ID    string `msgpack:"id"`
+	Hash  string `msgpack:"hash"`
+	Index int    `msgpack:"index,omitempty"`
+	Data  []byte `msgpack:"data,omitempty"`
+	Reply bool   `msgpack:"reply,omitempty"`
+}
+
+type memberUpdate struct {
+	Node        string      `msgpack:"node"`
+	State       MemberState `msgpack:"state"`
+	Incarnation uint64      `msgpack:"incarnation"`
+	// Signature is set on what a member says about itself.
+	Signature string `msgpack:"signature,omitempty"`
+}
+
+type swimFrame struct {
+	Type    string         `msgpack:"type"`
+	Seq     uint64         `msgpack:"seq,omitempty"`
+	Target  string         `msgpack:"target,omitempty"`
+	Updates []memberUpdate `msgpack:"updates,omitempty"`
+}
+
+type chunk struct {
+	StreamID string `msgpack:"streamID"`
+	Index    int    `msgpack:"index"`
+	Data     []byte `msgpack:"data"`
+	Final    bool   `msgpack:"final"`
+	Total    int    `msgpack:"total"`
+	Size     int64  `msgpack:"size"`
+	Hash     []byte `msgpack:"hash"`
 }
 
 type infoRes struct {
 	PubSignKey string `json:"pubSignKey"`
 	PubSealKey string `json:"pubSealKey"`
 	Version    string `json:"version"`
+	Protocol   int    `json:"protocol"`
 }
 
 type verifyRes struct {
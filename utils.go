@@ -10,8 +10,6 @@ import (
 	"strconv"
 	"strings"
 	"time"
-
-	"github.com/op/go-logging"
 )
 
 func check(e error) {
@@ -48,21 +46,6 @@ func GetIP(r *http.Request) string {
 	return r.RemoteAddr
 }
 
-// LoggerConfig sets up the logger configuration.
-func LoggerConfig(config NetworkConfig) {
-	//initialize logger
-	format := logging.MustStringFormatter(
-		`%{color}%{time:15:04:05.000} › %{color:reset}%{message}`,
-	)
-	backend := logging.NewLogBackend(os.Stdin, "", 0)
-	if config.LogLevel < 1 {
-		backend = logging.NewLogBackend(ioutil.Discard, "", 0)
-	}
-
-	backendFormatter := logging.NewBackendFormatter(backend, format)
-	logging.SetBackend(backendFormatter)
-}
-
 func pass() {}
 
 func sealToString(value [32]byte) []byte {